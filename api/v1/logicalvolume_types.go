@@ -20,6 +20,16 @@ type LogicalVolumeSpec struct {
 	DeviceClass string            `json:"deviceClass,omitempty"`
 	NoCow       bool              `json:"noCow,omitempty"`
 
+	// 'compression' specifies the btrfs compression algorithm with optional level, i.e. zstd:3.
+	// noCow and compression may be changed, only files written afterwards get new options.
+	//+kubebuilder:validation:Optional
+	Compression string `json:"compression,omitempty"`
+
+	// 'quotaMode' specifies the mode of the volume limit, the mode of the device class is used if it is empty.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Enum=referenced;exclusive
+	QuotaMode string `json:"quotaMode,omitempty"`
+
 	// 'source' specifies the logicalvolume name of the source; if present.
 	// This field is populated only when LogicalVolume has a source.
 	//+kubebuilder:validation:Optional
@@ -40,6 +50,11 @@ type LogicalVolumeStatus struct {
 	Code        codes.Code         `json:"code,omitempty"`
 	Message     string             `json:"message,omitempty"`
 	CurrentSize *resource.Quantity `json:"currentSize,omitempty"`
+	// 'creationTime' is the time when the volume was created on the node.
+	CreationTime *metav1.Time `json:"creationTime,omitempty"`
+	// 'observedGeneration' is the generation of the spec which was last applied to the volume on the node,
+	// 'code' and 'message' report whether it failed.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -55,7 +70,8 @@ type LogicalVolume struct {
 	Status LogicalVolumeStatus `json:"status,omitempty"`
 }
 
-// IsCompatibleWith returns true if the LogicalVolume is compatible.
+// IsCompatibleWith returns true if the LogicalVolume is compatible, i.e. a retried request would create the same volume.
+// Volumes with a source are compared by their own size, which may be larger than the size of the source.
 func (lv *LogicalVolume) IsCompatibleWith(lv2 *LogicalVolume) bool {
 	if lv.Spec.Name != lv2.Spec.Name {
 		return false
@@ -63,6 +79,9 @@ func (lv *LogicalVolume) IsCompatibleWith(lv2 *LogicalVolume) bool {
 	if lv.Spec.Source != lv2.Spec.Source {
 		return false
 	}
+	if lv.Spec.AccessType != lv2.Spec.AccessType {
+		return false
+	}
 	if lv.Spec.Size.Cmp(lv2.Spec.Size) != 0 {
 		return false
 	}
@@ -0,0 +1,105 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SnapshotRetention specifies snapshots kept for each volume. A snapshot is kept if any rule keeps it,
+// all snapshots are kept if no rule is set.
+type SnapshotRetention struct {
+	// 'last' keeps the given number of the newest snapshots.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Minimum=0
+	Last int `json:"last,omitempty"`
+
+	// 'hourly' keeps the newest snapshot of each of the given number of the last hours with snapshots.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Minimum=0
+	Hourly int `json:"hourly,omitempty"`
+
+	// 'daily' keeps the newest snapshot of each of the given number of the last days with snapshots.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Minimum=0
+	Daily int `json:"daily,omitempty"`
+
+	// 'weekly' keeps the newest snapshot of each of the given number of the last ISO weeks with snapshots.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Minimum=0
+	Weekly int `json:"weekly,omitempty"`
+
+	// 'monthly' keeps the newest snapshot of each of the given number of the last months with snapshots.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Minimum=0
+	Monthly int `json:"monthly,omitempty"`
+}
+
+// SnapshotScheduleSpec defines the desired state of SnapshotSchedule
+type SnapshotScheduleSpec struct {
+	// 'schedule' is the cron expression in UTC, i.e. "0 * * * *" or "@daily".
+	Schedule string `json:"schedule"`
+
+	// 'selector' selects PVCs of TopoLS to snapshot.
+	Selector metav1.LabelSelector `json:"selector"`
+
+	// 'namespaces' limits namespaces of selected PVCs, PVCs of all namespaces are selected by default.
+	//+kubebuilder:validation:Optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	//+kubebuilder:validation:Optional
+	Retention SnapshotRetention `json:"retention,omitempty"`
+
+	// 'suspend' stops taking snapshots, expired snapshots are still pruned.
+	//+kubebuilder:validation:Optional
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// SnapshotFailure is a snapshot which can't be taken.
+type SnapshotFailure struct {
+	// 'persistentVolumeClaim' is namespace/name of the PVC.
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+	LogicalVolume         string `json:"logicalVolume,omitempty"`
+	Message               string `json:"message"`
+}
+
+// SnapshotScheduleStatus defines the observed state of SnapshotSchedule
+type SnapshotScheduleStatus struct {
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+	// 'snapshots' is the number of snapshots taken by the schedule.
+	Snapshots int `json:"snapshots,omitempty"`
+	// 'failures' are snapshots failed on the last run.
+	Failures []SnapshotFailure `json:"failures,omitempty"`
+	// 'message' is set if the schedule is invalid.
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Suspend",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Last",type=date,JSONPath=`.status.lastScheduleTime`
+//+kubebuilder:printcolumn:name="Next",type=date,JSONPath=`.status.nextScheduleTime`
+//+kubebuilder:printcolumn:name="Snapshots",type=integer,JSONPath=`.status.snapshots`
+
+// SnapshotSchedule is the Schema for the snapshotschedules API
+type SnapshotSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SnapshotScheduleSpec   `json:"spec,omitempty"`
+	Status SnapshotScheduleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SnapshotScheduleList contains a list of SnapshotSchedule
+type SnapshotScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SnapshotSchedule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SnapshotSchedule{}, &SnapshotScheduleList{})
+}
@@ -0,0 +1,139 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BackupPhase is the stage of a backup or a restore.
+type BackupPhase string
+
+const (
+	// BackupPending means the backup or the restore is not started yet.
+	BackupPending BackupPhase = ""
+	// BackupSnapshotting means the backup waits for the read-only snapshot of the volume.
+	BackupSnapshotting BackupPhase = "Snapshotting"
+	// BackupRunning means the stream is being uploaded or downloaded.
+	BackupRunning BackupPhase = "Running"
+	// BackupCompleted means the backup or the restore is done.
+	BackupCompleted BackupPhase = "Completed"
+	// BackupFailed means the backup or the restore can't be done.
+	BackupFailed BackupPhase = "Failed"
+)
+
+// Compression algorithms of backup streams.
+const (
+	BackupCompressionGzip = "gzip"
+	BackupCompressionNone = "none"
+)
+
+// BackupTarget is where backup streams are stored, exactly one target must be set.
+type BackupTarget struct {
+	// 'directory' stores streams in a directory of the node, i.e. an NFS mount of topols-node.
+	//+kubebuilder:validation:Optional
+	Directory *DirectoryTarget `json:"directory,omitempty"`
+
+	// 's3' stores streams in a bucket of an S3-compatible service.
+	//+kubebuilder:validation:Optional
+	S3 *S3Target `json:"s3,omitempty"`
+}
+
+// DirectoryTarget is a directory in topols-node.
+type DirectoryTarget struct {
+	Path string `json:"path"`
+}
+
+// S3Target is a bucket of an S3-compatible service, objects are addressed in path style.
+type S3Target struct {
+	// 'endpoint' is the URL of the service, i.e. http://minio.minio.svc:9000.
+	Endpoint string `json:"endpoint"`
+
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:default=us-east-1
+	Region string `json:"region,omitempty"`
+
+	Bucket string `json:"bucket"`
+
+	// 'prefix' is prepended to object keys.
+	//+kubebuilder:validation:Optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// 'secretRef' is the Secret with accessKeyID and secretAccessKey keys.
+	// It must be in the namespace of TopoLS, topols-node can't read other secrets.
+	SecretRef corev1.SecretReference `json:"secretRef"`
+}
+
+// VolumeBackupSpec defines the desired state of VolumeBackup
+type VolumeBackupSpec struct {
+	// 'logicalVolume' is the name of LogicalVolume to back up.
+	LogicalVolume string `json:"logicalVolume"`
+
+	Target BackupTarget `json:"target"`
+
+	// 'parent' is the completed VolumeBackup of the same volume, only the difference from it is stored.
+	// The parent is needed to restore the backup, its snapshot must still exist.
+	//+kubebuilder:validation:Optional
+	Parent string `json:"parent,omitempty"`
+
+	// 'compression' is gzip or none.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Enum=gzip;none
+	//+kubebuilder:default=gzip
+	Compression string `json:"compression,omitempty"`
+}
+
+// VolumeBackupStatus defines the observed state of VolumeBackup
+type VolumeBackupStatus struct {
+	Phase BackupPhase `json:"phase,omitempty"`
+	// 'nodeName' is the node of the volume, it takes the snapshot and uploads the stream.
+	NodeName string `json:"nodeName,omitempty"`
+	// 'snapshot' is the LogicalVolume of the read-only snapshot, it is deleted with VolumeBackup.
+	Snapshot string `json:"snapshot,omitempty"`
+	// 'key' is the key of the stream in the target.
+	Key string `json:"key,omitempty"`
+	// 'checksum' is the sha256 of the stored stream.
+	Checksum string `json:"checksum,omitempty"`
+	// 'storedBytes' is the size of the stored stream.
+	StoredBytes int64 `json:"storedBytes,omitempty"`
+
+	// Properties of the volume, a restored volume gets them.
+	DeviceClass string             `json:"deviceClass,omitempty"`
+	Size        *resource.Quantity `json:"size,omitempty"`
+	NoCow       bool               `json:"noCow,omitempty"`
+	Compression string             `json:"compression,omitempty"`
+
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="LogicalVolume",type=string,JSONPath=`.spec.logicalVolume`
+//+kubebuilder:printcolumn:name="Parent",type=string,JSONPath=`.spec.parent`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Stored",type=integer,JSONPath=`.status.storedBytes`
+
+// VolumeBackup is the Schema for the volumebackups API
+type VolumeBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeBackupSpec   `json:"spec,omitempty"`
+	Status VolumeBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VolumeBackupList contains a list of VolumeBackup
+type VolumeBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VolumeBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VolumeBackup{}, &VolumeBackupList{})
+}
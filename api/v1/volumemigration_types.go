@@ -0,0 +1,96 @@
+package v1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VolumeMigrationPhase is the stage of the migration.
+type VolumeMigrationPhase string
+
+const (
+	// MigrationPending means the migration is not started yet.
+	MigrationPending VolumeMigrationPhase = ""
+	// MigrationSyncing means the volume is copied by incremental passes while it is in use.
+	MigrationSyncing VolumeMigrationPhase = "Syncing"
+	// MigrationDetaching means pods using the volume must stop before the final pass.
+	MigrationDetaching VolumeMigrationPhase = "Detaching"
+	// MigrationSwitching means the final pass is done and the volume is switched to the target node.
+	MigrationSwitching VolumeMigrationPhase = "Switching"
+	// MigrationCompleted means the volume is on the target node.
+	MigrationCompleted VolumeMigrationPhase = "Completed"
+	// MigrationFailed means the migration can't be done, the volume stays on the source node.
+	MigrationFailed VolumeMigrationPhase = "Failed"
+)
+
+// VolumeMigrationSpec defines the desired state of VolumeMigration
+type VolumeMigrationSpec struct {
+	// 'logicalVolume' is the name of LogicalVolume to move.
+	LogicalVolume string `json:"logicalVolume"`
+
+	// 'targetNode' is the node to move the volume to, it must run the volume transfer service.
+	TargetNode string `json:"targetNode"`
+
+	// 'maxPasses' limits incremental passes done while the volume is in use.
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Minimum=1
+	//+kubebuilder:default=5
+	MaxPasses int `json:"maxPasses,omitempty"`
+
+	// 'syncThreshold' ends incremental passes when a pass transfers less bytes, 64Mi by default.
+	//+kubebuilder:validation:Optional
+	SyncThreshold *resource.Quantity `json:"syncThreshold,omitempty"`
+
+	// 'evictPods' evicts pods using the volume before the final pass.
+	// Otherwise the migration waits until they are stopped, i.e. by draining the source node.
+	//+kubebuilder:validation:Optional
+	EvictPods bool `json:"evictPods,omitempty"`
+}
+
+// VolumeMigrationStatus defines the observed state of VolumeMigration
+type VolumeMigrationStatus struct {
+	Phase       VolumeMigrationPhase `json:"phase,omitempty"`
+	SourceNode  string               `json:"sourceNode,omitempty"`
+	VolumeID    string               `json:"volumeID,omitempty"`
+	DeviceClass string               `json:"deviceClass,omitempty"`
+	// 'passes' is the number of completed passes.
+	Passes int `json:"passes,omitempty"`
+	// 'lastPassBytes' is the size of the stream of the last pass.
+	LastPassBytes int64  `json:"lastPassBytes,omitempty"`
+	Message       string `json:"message,omitempty"`
+	// 'sourceRemoved' is set when the volume is removed from the source node after the migration.
+	SourceRemoved  bool         `json:"sourceRemoved,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="LogicalVolume",type=string,JSONPath=`.spec.logicalVolume`
+//+kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.status.sourceNode`
+//+kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.spec.targetNode`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Passes",type=integer,JSONPath=`.status.passes`
+
+// VolumeMigration is the Schema for the volumemigrations API
+type VolumeMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeMigrationSpec   `json:"spec,omitempty"`
+	Status VolumeMigrationStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VolumeMigrationList contains a list of VolumeMigration
+type VolumeMigrationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VolumeMigration `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VolumeMigration{}, &VolumeMigrationList{})
+}
@@ -0,0 +1,75 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VolumeRestoreSpec defines the desired state of VolumeRestore
+type VolumeRestoreSpec struct {
+	// 'backup' is the completed VolumeBackup to restore, its parents are restored first.
+	Backup string `json:"backup"`
+
+	// 'nodeName' is the node to create the volume on.
+	NodeName string `json:"nodeName"`
+
+	// 'logicalVolume' is the name of LogicalVolume created for the volume.
+	LogicalVolume string `json:"logicalVolume"`
+
+	// 'deviceClass' is the device class of the volume, the device class of the backup by default.
+	//+kubebuilder:validation:Optional
+	DeviceClass string `json:"deviceClass,omitempty"`
+
+	// 'persistentVolumeClaim' is the PVC to bind the created PersistentVolume to.
+	// No PersistentVolume is created if it is not set.
+	//+kubebuilder:validation:Optional
+	PersistentVolumeClaim *corev1.ObjectReference `json:"persistentVolumeClaim,omitempty"`
+
+	//+kubebuilder:validation:Optional
+	StorageClassName string `json:"storageClassName,omitempty"`
+
+	//+kubebuilder:validation:Optional
+	//+kubebuilder:validation:Enum=Delete;Retain
+	//+kubebuilder:default=Delete
+	ReclaimPolicy corev1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+}
+
+// VolumeRestoreStatus defines the observed state of VolumeRestore
+type VolumeRestoreStatus struct {
+	Phase          BackupPhase  `json:"phase,omitempty"`
+	VolumeID       string       `json:"volumeID,omitempty"`
+	DeviceClass    string       `json:"deviceClass,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Backup",type=string,JSONPath=`.spec.backup`
+//+kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.spec.nodeName`
+//+kubebuilder:printcolumn:name="LogicalVolume",type=string,JSONPath=`.spec.logicalVolume`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+
+// VolumeRestore is the Schema for the volumerestores API
+type VolumeRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeRestoreSpec   `json:"spec,omitempty"`
+	Status VolumeRestoreStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VolumeRestoreList contains a list of VolumeRestore
+type VolumeRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VolumeRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VolumeRestore{}, &VolumeRestoreList{})
+}
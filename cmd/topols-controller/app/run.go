@@ -115,6 +115,12 @@ func subMain() error {
 		return err
 	}
 
+	scheduleController := controller.NewSnapshotScheduleReconciler(client, apiReader)
+	if err := scheduleController.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "SnapshotSchedule")
+		return err
+	}
+
 	//+kubebuilder:scaffold:builder
 
 	// Add health checker to manager
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/internal/driver"
+	"github.com/kvaster/topols/internal/lsm/btrfs"
+	"github.com/kvaster/topols/internal/recovery"
+	"github.com/kvaster/topols/pkg/lsm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var recoverConfig struct {
+	dryRun        bool
+	pvs           bool
+	storageClass  string
+	reclaimPolicy string
+}
+
+var recoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "Recreate LogicalVolumes for volumes of the node",
+	Long: `recover recreates LogicalVolumes for volumes of the node which have no LogicalVolume,
+i.e. after etcd is restored from an old backup or the CRD is deleted.
+It optionally creates PersistentVolumes bound to the PVCs recorded in volume metadata.
+
+Resources to create are printed first as a diff, nothing is created with --dry-run.
+The command needs permissions to create LogicalVolumes and PersistentVolumes.`,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		return recoverMain(cmd.Context())
+	},
+}
+
+func init() {
+	fs := recoverCmd.Flags()
+	fs.BoolVar(&recoverConfig.dryRun, "dry-run", false, "Only print resources to create")
+	fs.BoolVar(&recoverConfig.pvs, "persistent-volumes", false, "Create PersistentVolumes too")
+	fs.StringVar(&recoverConfig.storageClass, "storage-class", "", "StorageClass of created PersistentVolumes")
+	fs.StringVar(&recoverConfig.reclaimPolicy, "reclaim-policy", string(corev1.PersistentVolumeReclaimRetain), "Reclaim policy of created PersistentVolumes")
+
+	rootCmd.AddCommand(recoverCmd)
+}
+
+func recoverMain(ctx context.Context) error {
+	nodename := viper.GetString("nodename")
+	if len(nodename) == 0 {
+		return errors.New("node name is not given")
+	}
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&config.zapOpts)))
+
+	policy := corev1.PersistentVolumeReclaimPolicy(recoverConfig.reclaimPolicy)
+	if policy != corev1.PersistentVolumeReclaimRetain && policy != corev1.PersistentVolumeReclaimDelete {
+		return fmt.Errorf("invalid reclaim policy: %s", policy)
+	}
+
+	drivers, err := newDrivers()
+	if err != nil {
+		return err
+	}
+	// the running topols-node owns the volumes and their groups, they are only read here
+	lsmc, err := btrfs.ScanBtrfs(config.poolPath, drivers)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := nodeVolumes(ctx, lsmc)
+	if err != nil {
+		return err
+	}
+
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+
+	var lvs topolsv1.LogicalVolumeList
+	if err := c.List(ctx, &lvs); err != nil {
+		return err
+	}
+	var pvs corev1.PersistentVolumeList
+	if recoverConfig.pvs {
+		if err := c.List(ctx, &pvs); err != nil {
+			return err
+		}
+	}
+
+	plan := recovery.NewPlan(nodename, volumes, lvs.Items, pvs.Items, recovery.Options{
+		PersistentVolumes: recoverConfig.pvs,
+		StorageClass:      recoverConfig.storageClass,
+		ReclaimPolicy:     policy,
+	})
+	if err := plan.Print(os.Stdout); err != nil {
+		return err
+	}
+
+	if recoverConfig.dryRun || len(plan.LogicalVolumes) == 0 {
+		return nil
+	}
+
+	return plan.Apply(ctx, c)
+}
+
+// nodeVolumes returns volumes of all healthy device classes, recovery is refused if a device class is unhealthy.
+func nodeVolumes(ctx context.Context, lsmc lsm.Client) ([]*lsm.LogicalVolume, error) {
+	stats, err := lsmc.NodeStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Config.Err != nil {
+		return nil, fmt.Errorf("device class config is invalid: %w", stats.Config.Err)
+	}
+
+	var volumes []*lsm.LogicalVolume
+	for _, s := range stats.DeviceClasses {
+		if s.Err != nil {
+			return nil, fmt.Errorf("device class %s is unhealthy: %w", s.DeviceClass, s.Err)
+		}
+		vs, err := lsmc.GetLVList(ctx, s.DeviceClass)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vs {
+			if err := markBlock(lsmc, v); err != nil {
+				return nil, err
+			}
+		}
+		volumes = append(volumes, vs...)
+	}
+
+	return volumes, nil
+}
+
+// markBlock records block volumes published before their mode was kept in metadata by their backing file.
+func markBlock(lsmc lsm.Client, v *lsm.LogicalVolume) error {
+	if v.Meta != nil && v.Meta.Block {
+		return nil
+	}
+	block, err := driver.HasBlockFile(lsmc.GetPath(v))
+	if err != nil || !block {
+		return err
+	}
+
+	m := lsm.VolumeMeta{Name: v.Name, DeviceClass: v.DeviceClass, Size: v.Size}
+	if v.Meta != nil {
+		m = *v.Meta
+	}
+	m.Block = true
+	v.Meta = &m
+	return nil
+}
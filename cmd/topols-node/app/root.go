@@ -4,8 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/kvaster/topols"
+	"github.com/kvaster/topols/internal/lsm/btrfs"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/klog/v2"
@@ -17,6 +19,14 @@ var config struct {
 	metricsAddr         string
 	secureMetricsServer bool
 	poolPath            string
+	btrfsBackend        string
+	orphanInterval      time.Duration
+	removeOrphans       bool
+	orphanGracePeriod   time.Duration
+	repairLimits        bool
+	transferAddr        string
+	transferAdvertise   string
+	transferCertDir     string
 	zapOpts             zap.Options
 }
 
@@ -50,15 +60,26 @@ func init() {
 	fs.StringVar(&config.csiSocket, "csi-socket", topols.DefaultCSISocket, "UNIX domain socket filename for CSI")
 	fs.StringVar(&config.metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	fs.BoolVar(&config.secureMetricsServer, "secure-metrics-server", false, "Secures the metrics server")
-	fs.StringVar(&config.poolPath, "pool-path", "/mnt/pool", "Path to folder with config and mounted btrfs file systems")
-	fs.String("nodename", "", "The resource name of the running node")
+	fs.DurationVar(&config.orphanInterval, "orphan-check-interval", 10*time.Minute, "Interval of checks for volumes without LogicalVolume and for stale qgroups")
+	fs.BoolVar(&config.removeOrphans, "remove-orphans", false, "Remove volumes without LogicalVolume after the grace period")
+	fs.DurationVar(&config.orphanGracePeriod, "orphan-grace-period", 24*time.Hour, "How long a volume must stay without LogicalVolume before it is removed")
+	fs.BoolVar(&config.repairLimits, "repair-volume-limits", false, "Set the limit from LogicalVolume size for volumes found on the node without a limit")
+	fs.StringVar(&config.transferAddr, "transfer-address", "", "The address of the volume transfer service, i.e. :9444, it is disabled if empty")
+	fs.StringVar(&config.transferAdvertise, "transfer-advertise-address", "", "The address of the transfer service for other nodes, POD_IP with the port of --transfer-address by default")
+	fs.StringVar(&config.transferCertDir, "transfer-cert-dir", "/certs/transfer", "Directory with tls.crt, tls.key and ca.crt for the transfer service")
+
+	// flags shared with subcommands
+	pfs := rootCmd.PersistentFlags()
+	pfs.StringVar(&config.poolPath, "pool-path", "/mnt/pool", "Path to folder with config and mounted btrfs file systems")
+	pfs.StringVar(&config.btrfsBackend, "btrfs-backend", btrfs.BackendCLI, "How to access btrfs: 'cli' runs /sbin/btrfs, 'ioctl' calls the kernel directly")
+	pfs.String("nodename", "", "The resource name of the running node")
 
 	viper.BindEnv("nodename", "NODE_NAME")
-	viper.BindPFlag("nodename", fs.Lookup("nodename"))
+	viper.BindPFlag("nodename", pfs.Lookup("nodename"))
 
 	goflags := flag.NewFlagSet("klog", flag.ExitOnError)
 	klog.InitFlags(goflags)
 	config.zapOpts.BindFlags(goflags)
 
-	fs.AddGoFlagSet(goflags)
+	pfs.AddGoFlagSet(goflags)
 }
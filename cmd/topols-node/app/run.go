@@ -3,6 +3,8 @@ package app
 import (
 	"context"
 	"errors"
+	"net"
+	"os"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -12,7 +14,10 @@ import (
 	"github.com/kvaster/topols/internal/controller"
 	"github.com/kvaster/topols/internal/driver"
 	"github.com/kvaster/topols/internal/lsm/btrfs"
+	"github.com/kvaster/topols/internal/lsm/projquota"
 	"github.com/kvaster/topols/internal/runners"
+	"github.com/kvaster/topols/internal/transfer"
+	"github.com/kvaster/topols/pkg/lsm"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
 	storagev1 "k8s.io/api/storage/v1"
@@ -40,6 +45,57 @@ func init() {
 	//+kubebuilder:scaffold:scheme
 }
 
+// newDrivers returns drivers for all supported device class filesystems.
+func newDrivers() (lsm.DriverRegistry, error) {
+	btrfsDriver, err := btrfs.NewDriver(config.btrfsBackend)
+	if err != nil {
+		return nil, err
+	}
+	xfsDriver, err := projquota.NewDriver(projquota.FsTypeXFS)
+	if err != nil {
+		return nil, err
+	}
+	ext4Driver, err := projquota.NewDriver(projquota.FsTypeExt4)
+	if err != nil {
+		return nil, err
+	}
+
+	return lsm.DriverRegistry{
+		lsm.DefaultFsType:    btrfsDriver,
+		projquota.FsTypeXFS:  xfsDriver,
+		projquota.FsTypeExt4: ext4Driver,
+	}, nil
+}
+
+// setupTransfer adds the volume transfer server and its certificate watcher to the manager.
+func setupTransfer(mgr ctrl.Manager, client client.Client, lsmc lsm.Client, nodename string) (*transfer.Credentials, error) {
+	advertise := config.transferAdvertise
+	if advertise == "" {
+		_, port, err := net.SplitHostPort(config.transferAddr)
+		if err != nil {
+			return nil, err
+		}
+		ip := os.Getenv("POD_IP")
+		if ip == "" {
+			return nil, errors.New("transfer advertise address is not given and POD_IP is not set")
+		}
+		advertise = net.JoinHostPort(ip, port)
+	}
+
+	creds, watcher, err := transfer.NewCredentials(config.transferCertDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.Add(watcher); err != nil {
+		return nil, err
+	}
+	if err := mgr.Add(transfer.NewServer(client, lsmc, nodename, config.transferAddr, advertise, creds)); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
 func subMain() error {
 	nodename := viper.GetString("nodename")
 	if len(nodename) == 0 {
@@ -68,7 +124,13 @@ func subMain() error {
 	reader := clientwrapper.NewWrappedClient(mgr.GetClient())
 	apiReader := clientwrapper.NewWrappedReader(mgr.GetAPIReader(), mgr.GetClient().Scheme())
 
-	lsmc, err := btrfs.NewBtrfs(config.poolPath)
+	drivers, err := newDrivers()
+	if err != nil {
+		setupLog.Error(err, "unable to create filesystem drivers")
+		return err
+	}
+
+	lsmc, err := btrfs.NewBtrfs(config.poolPath, drivers)
 	if err != nil {
 		setupLog.Error(err, "unable to create ls client")
 		return err
@@ -77,11 +139,41 @@ func subMain() error {
 		return err
 	}
 
-	lvcontroller := controller.NewLogicalVolumeReconciler(reader, lsmc, nodename)
+	var receiver controller.VolumeReceiver
+	if config.transferAddr != "" {
+		creds, err := setupTransfer(mgr, reader, lsmc, nodename)
+		if err != nil {
+			setupLog.Error(err, "unable to set up volume transfer")
+			return err
+		}
+		r := transfer.NewReceiver(reader, lsmc, creds)
+		receiver = r
+
+		// the wrapped client does not create subresources, they are needed for evictions
+		migrationController := controller.NewVolumeMigrationReconciler(mgr.GetClient(), apiReader, lsmc, nodename, r)
+		if err := migrationController.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "VolumeMigration")
+			return err
+		}
+	}
+
+	lvcontroller := controller.NewLogicalVolumeReconciler(reader, lsmc, nodename, config.repairLimits, receiver)
 	if err := lvcontroller.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "LogicalVolume")
 		return err
 	}
+
+	backupController := controller.NewVolumeBackupReconciler(reader, apiReader, lsmc, nodename)
+	if err := backupController.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VolumeBackup")
+		return err
+	}
+
+	restoreController := controller.NewVolumeRestoreReconciler(reader, apiReader, lsmc, nodename)
+	if err := restoreController.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VolumeRestore")
+		return err
+	}
 	//+kubebuilder:scaffold:builder
 
 	// Add health checker to manager
@@ -93,7 +185,16 @@ func subMain() error {
 	// Add metrics exporter to manager.
 	// Note that grpc.ClientConn can be shared with multiple stubs/services.
 	// https://github.com/grpc/grpc-go/tree/master/examples/features/multiplex
-	if err := mgr.Add(runners.NewMetricsExporter(reader, lsmc, nodename)); err != nil {
+	if err := mgr.Add(runners.NewMetricsExporter(reader, lsmc, nodename, mgr.GetEventRecorderFor("topols-node"))); err != nil {
+		return err
+	}
+
+	orphanCollector := runners.NewOrphanCollector(reader, lsmc, nodename, mgr.GetEventRecorderFor("topols-node"), runners.OrphanCollectorOptions{
+		Interval:    config.orphanInterval,
+		Remove:      config.removeOrphans,
+		GracePeriod: config.orphanGracePeriod,
+	})
+	if err := mgr.Add(orphanCollector); err != nil {
 		return err
 	}
 
@@ -7,6 +7,12 @@ import (
 // CapacityKeyPrefix is the key prefix of Node annotation that represents VG free space.
 const CapacityKeyPrefix = "capacity.topols.kvaster.com/"
 
+// UnhealthyKeyPrefix is the key prefix of Node annotation that holds the reason why a device class is unhealthy.
+const UnhealthyKeyPrefix = "unhealthy.topols.kvaster.com/"
+
+// NodeConditionConfigLoaded is the Node condition type which is true when the device class config is applied.
+const NodeConditionConfigLoaded = corev1.NodeConditionType("TopoLSConfigLoaded")
+
 // CapacityResource is the resource name of topols capacity.
 const CapacityResource = corev1.ResourceName("topols.kvaster.com/capacity")
 
@@ -22,6 +28,30 @@ const DeviceClassKey = "topols.kvaster.com/device-class"
 // NoCowKey is the key used in CSI volume create requests to specify no-cow property of filesystem
 const NoCowKey = "topols.kvaster.com/no-cow"
 
+// NoDataCowKey is the key used in CSI volume create requests to disable copy-on-write, the same as NoCowKey
+const NoDataCowKey = "topols.kvaster.com/nodatacow"
+
+// NoDataSumKey is rejected in CSI volume create requests, NoDataCowKey disables data checksums too
+const NoDataSumKey = "topols.kvaster.com/nodatasum"
+
+// CompressionKey is the key used in CSI volume create requests to specify btrfs compression, i.e. zstd:3
+const CompressionKey = "topols.kvaster.com/compression"
+
+// QuotaModeKey is the key used in CSI volume create and modify requests to specify the volume limit mode,
+// either referenced or exclusive
+const QuotaModeKey = "topols.kvaster.com/quota-mode"
+
+// PVCNameKey is the parameter of CSI volume create requests with the PVC name,
+// it is passed by external-provisioner with --extra-create-metadata.
+// It is also the annotation of LogicalVolume with the PVC name.
+const PVCNameKey = "csi.storage.k8s.io/pvc/name"
+
+// PVCNamespaceKey is the same as PVCNameKey for the PVC namespace.
+const PVCNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+
+// RecoveredVolumeKey is the annotation of LogicalVolume recreated for an existing volume, the value is the volume name.
+const RecoveredVolumeKey = "topols.kvaster.com/recovered-volume"
+
 // ResizeRequestedAtKey is the key of LogicalVolume that represents the timestamp of the resize request.
 const ResizeRequestedAtKey = "topols.kvaster.com/resize-requested-at"
 
@@ -46,6 +76,16 @@ const DefaultDeviceClassAnnotationName = "00default"
 // DefaultDeviceClassName is the name for the default device-class.
 const DefaultDeviceClassName = ""
 
+// TransferAddressKey is the key of Node annotation with the address of the volume transfer service of topols-node.
+const TransferAddressKey = "topols.kvaster.com/transfer-address"
+
+// MigrationPersistentVolumeKey is the key of VolumeMigration annotation with the PersistentVolume saved
+// before it is recreated with the node affinity of the target node.
+const MigrationPersistentVolumeKey = "topols.kvaster.com/migration-persistent-volume"
+
+// SnapshotTimeKey is the key of LogicalVolume annotation with the scheduled time of the snapshot taken by SnapshotSchedule.
+const SnapshotTimeKey = "topols.kvaster.com/snapshot-time"
+
 // DefaultDeviceClassKey is the key that represents default device class on Node
 const DefaultDeviceClassKey = "topols.kvaster.com/default-device-class"
 
@@ -0,0 +1,158 @@
+// Package backup stores streams of volumes in backup targets.
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	checksumPrefix = "sha256:"
+
+	accessKeyIDKey     = "accessKeyID"
+	secretAccessKeyKey = "secretAccessKey"
+)
+
+// ErrChecksumMismatch is returned when the stored stream is corrupted.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Target stores objects by keys.
+type Target interface {
+	// Put stores the object read from r, the object is not visible until it is completely stored.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the reader of the object.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// NewTarget returns the target of the spec. Credentials of S3 are read from the secret with the reader.
+func NewTarget(ctx context.Context, reader client.Reader, spec topolsv1.BackupTarget) (Target, error) {
+	switch {
+	case spec.Directory != nil && spec.S3 != nil:
+		return nil, errors.New("only one backup target must be set")
+	case spec.Directory != nil:
+		return NewDirectoryTarget(spec.Directory.Path), nil
+	case spec.S3 != nil:
+		ref := spec.S3.SecretRef
+		if ref.Name == "" || ref.Namespace == "" {
+			return nil, errors.New("name and namespace of the S3 secret must be set")
+		}
+		secret := new(corev1.Secret)
+		if err := reader.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, secret); err != nil {
+			return nil, fmt.Errorf("failed to get S3 secret: %w", err)
+		}
+		accessKey, secretKey := string(secret.Data[accessKeyIDKey]), string(secret.Data[secretAccessKeyKey])
+		if accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("S3 secret must have %s and %s keys", accessKeyIDKey, secretAccessKeyKey)
+		}
+		return NewS3Target(spec.S3.Endpoint, spec.S3.Region, spec.S3.Bucket, spec.S3.Prefix, accessKey, secretKey)
+	}
+	return nil, errors.New("backup target is not set")
+}
+
+// Key returns the key of the stream of the backup.
+func Key(logicalVolume, backup, compression string) string {
+	key := logicalVolume + "/" + backup + ".btrfs"
+	if compression == topolsv1.BackupCompressionGzip {
+		key += ".gz"
+	}
+	return key
+}
+
+// Upload stores the stream written by send, it is compressed with the compression algorithm.
+// It returns the checksum and the size of the stored object.
+func Upload(ctx context.Context, t Target, key, compression string, send func(w io.Writer) error) (string, int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		if compression == topolsv1.BackupCompressionGzip {
+			zw := gzip.NewWriter(pw)
+			err = send(zw)
+			if err2 := zw.Close(); err == nil {
+				err = err2
+			}
+		} else {
+			err = send(pw)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	hr := &hashReader{r: pr, h: sha256.New()}
+	err := t.Put(ctx, key, hr)
+	// the sender is blocked if the object is not read to the end
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err != nil {
+		return "", 0, err
+	}
+
+	return checksumPrefix + hex.EncodeToString(hr.h.Sum(nil)), hr.n, nil
+}
+
+// Download passes the decompressed stream of the object to receive. ErrChecksumMismatch is returned
+// if the object does not match the checksum, the received data must be discarded then.
+func Download(ctx context.Context, t Target, key, compression, checksum string, receive func(r io.Reader) error) error {
+	rc, err := t.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var r io.Reader = &verifyingReader{hashReader: hashReader{r: rc, h: sha256.New()}, checksum: checksum}
+	if compression == topolsv1.BackupCompressionGzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	if err := receive(r); err != nil {
+		return err
+	}
+	// the checksum is verified at the end of the object
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+type hashReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// verifyingReader returns ErrChecksumMismatch instead of io.EOF if the checksum does not match.
+type verifyingReader struct {
+	hashReader
+	checksum string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.hashReader.Read(p)
+	if err == io.EOF {
+		if sum := checksumPrefix + hex.EncodeToString(r.h.Sum(nil)); sum != r.checksum {
+			return n, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, r.checksum, sum)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	topolsv1 "github.com/kvaster/topols/api/v1"
+)
+
+func TestDirectoryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	target := NewDirectoryTarget(dir)
+	data := bytes.Repeat([]byte("topols backup stream "), 1000)
+
+	for _, compression := range []string{topolsv1.BackupCompressionGzip, topolsv1.BackupCompressionNone} {
+		key := Key("lv", "backup-"+compression, compression)
+		checksum, size, err := Upload(ctx, target, key, compression, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression == topolsv1.BackupCompressionGzip && size >= int64(len(data)) {
+			t.Errorf("stream should be compressed: %d", size)
+		}
+		if fi, err := os.Stat(filepath.Join(dir, "lv", filepath.Base(key))); err != nil || fi.Size() != size {
+			t.Errorf("object should be stored with size %d: %v", size, err)
+		}
+
+		var received []byte
+		err = Download(ctx, target, key, compression, checksum, func(r io.Reader) error {
+			received, err = io.ReadAll(r)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Errorf("received stream is different with %s compression", compression)
+		}
+	}
+}
+
+func TestUploadFailed(t *testing.T) {
+	dir := t.TempDir()
+	sendErr := errors.New("send failed")
+	_, _, err := Upload(context.Background(), NewDirectoryTarget(dir), "lv/b.btrfs", topolsv1.BackupCompressionNone, func(w io.Writer) error {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return sendErr
+	})
+	if !errors.Is(err, sendErr) {
+		t.Errorf("error of send should be returned: %v", err)
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "lv")); len(files) != 0 {
+		t.Errorf("partial object should not be stored: %v", files)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	target := NewDirectoryTarget(dir)
+
+	checksum, _, err := Upload(ctx, target, "lv/b.btrfs", topolsv1.BackupCompressionNone, func(w io.Writer) error {
+		_, err := w.Write([]byte("data"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "lv", "b.btrfs"), []byte("date"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver does not read the stream to the end
+	err = Download(ctx, target, "lv/b.btrfs", topolsv1.BackupCompressionNone, checksum, func(r io.Reader) error {
+		_, err := r.Read(make([]byte, 2))
+		return err
+	})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("ErrChecksumMismatch should be returned: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type directoryTarget struct {
+	path string
+}
+
+// NewDirectoryTarget returns the target which stores objects as files in the directory, i.e. an NFS mount.
+func NewDirectoryTarget(path string) Target {
+	return &directoryTarget{path: path}
+}
+
+func (t *directoryTarget) Put(ctx context.Context, key string, r io.Reader) error {
+	path := filepath.Join(t.path, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (t *directoryTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(t.path, filepath.FromSlash(key)))
+}
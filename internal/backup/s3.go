@@ -0,0 +1,330 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// partSize is the size of parts of multipart uploads, S3 allows up to 10000 parts of at least 5MiB.
+	partSize = 64 << 20
+
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type s3Target struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	partSize  int
+	now       func() time.Time
+}
+
+// NewS3Target returns the target which stores objects in the bucket of an S3-compatible service.
+// Requests are signed with AWS Signature Version 4 and objects are addressed in path style.
+func NewS3Target(endpoint, region, bucket, prefix, accessKey, secretKey string) (Target, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("S3 bucket is not set")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Target{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		prefix:    strings.Trim(prefix, "/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    http.DefaultClient,
+		partSize:  partSize,
+		now:       time.Now,
+	}, nil
+}
+
+// Put stores small objects with a single request and others with a multipart upload.
+// Parts are buffered in memory because the size of the stream is not known.
+func (t *s3Target) Put(ctx context.Context, key string, r io.Reader) error {
+	buf := make([]byte, t.partSize)
+	n, err := readPart(r, buf)
+	if err == io.EOF {
+		resp, err := t.do(ctx, http.MethodPut, key, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := t.createMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	var parts []completedPart
+	err = func() error {
+		for num := 1; n > 0; num++ {
+			etag, err := t.uploadPart(ctx, key, uploadID, num, buf[:n])
+			if err != nil {
+				return err
+			}
+			parts = append(parts, completedPart{PartNumber: num, ETag: etag})
+
+			n, err = readPart(r, buf)
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err == nil {
+		err = t.completeMultipartUpload(ctx, key, uploadID, parts)
+	}
+	if err != nil {
+		if resp, err2 := t.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil); err2 == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *s3Target) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// readPart fills buf, io.EOF is returned with the rest of the stream.
+func readPart(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type s3Error struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (t *s3Target) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := t.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode S3 response: %w", err)
+	}
+	if result.UploadID == "" {
+		return "", errors.New("S3 did not return upload id")
+	}
+	return result.UploadID, nil
+}
+
+func (t *s3Target) uploadPart(ctx context.Context, key, uploadID string, num int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(num)}, "uploadId": {uploadID}}
+	resp, err := t.do(ctx, http.MethodPut, key, query, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (t *s3Target) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the error of the completion may be returned with 200 OK
+	var result s3Error
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 failed to complete upload of %s: %s: %s", key, result.Code, result.Message)
+	}
+	return nil
+}
+
+// do sends the signed request, the response is returned only for 2xx status codes.
+func (t *s3Target) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *t.endpoint
+	objectPath := "/" + t.bucket + "/" + key
+	if t.prefix != "" {
+		objectPath = "/" + t.bucket + "/" + t.prefix + "/" + key
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = escape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	t.sign(req, payloadHash, t.now())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var e s3Error
+		if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e); err == nil && e.Code != "" {
+			return nil, fmt.Errorf("S3 %s %s: %s: %s", method, key, e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("S3 %s %s: %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 to the request. Host and headers set in the request are signed.
+func (t *s3Target) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + t.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+t.secretKey), date)
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted by keys and values, they are escaped as required by the signature.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, escape(k, true)+"="+escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape encodes all bytes except unreserved characters, slashes are kept unless encodeSlash is set.
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -13,6 +13,7 @@ import (
 	"google.golang.org/grpc/status"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -26,17 +27,30 @@ type LogicalVolumeReconciler struct {
 	client.Client
 	nodeName string
 	lsmc     lsm.Client
+	// repairLimits enables adoption of volumes which exist on the node without a limit.
+	repairLimits bool
+	// receiver restores snapshots of other nodes, nil if volume transfer is disabled.
+	receiver VolumeReceiver
+}
+
+// VolumeReceiver creates volumes from read-only snapshots of other nodes.
+type VolumeReceiver interface {
+	Receive(ctx context.Context, source *topolsv1.LogicalVolume, name, deviceClass string, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error)
 }
 
 //+kubebuilder:rbac:groups=topols.kvaster.com,resources=logicalvolumes,verbs=get;list;watch;update;patch
 //+kubebuilder:rbac:groups=topols.kvaster.com,resources=logicalvolumes/status,verbs=get;update;patch
 
 // NewLogicalVolumeReconciler returns LogicalVolumeReconciler with creating lvService and vgService.
-func NewLogicalVolumeReconciler(client client.Client, lvmc lsm.Client, nodeName string) *LogicalVolumeReconciler {
+// If repairLimits is true, a volume which exists on the node without a limit gets the limit from Spec.Size.
+// Snapshots of other nodes are restored with receiver, it may be nil if volume transfer is disabled.
+func NewLogicalVolumeReconciler(client client.Client, lvmc lsm.Client, nodeName string, repairLimits bool, receiver VolumeReceiver) *LogicalVolumeReconciler {
 	return &LogicalVolumeReconciler{
-		Client:   client,
-		nodeName: nodeName,
-		lsmc:     lvmc,
+		Client:       client,
+		nodeName:     nodeName,
+		lsmc:         lvmc,
+		repairLimits: repairLimits,
+		receiver:     receiver,
 	}
 }
 
@@ -96,6 +110,10 @@ func (r *LogicalVolumeReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			return ctrl.Result{Requeue: true}, nil
 		}
 
+		if r.repairLimits {
+			r.adoptLV(ctx, log, lv)
+		}
+
 		if lv.Status.VolumeID == "" {
 			err := r.createLV(ctx, log, lv)
 			if err != nil {
@@ -104,9 +122,14 @@ func (r *LogicalVolumeReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			return ctrl.Result{}, err
 		}
 
-		err := r.expandLV(ctx, log, lv)
-		if err != nil {
+		if err := r.expandLV(ctx, log, lv); err != nil {
 			log.Error(err, "failed to expand LV", "name", lv.Name)
+			return ctrl.Result{}, err
+		}
+
+		err := r.modifyLV(ctx, log, lv)
+		if err != nil {
+			log.Error(err, "failed to modify LV", "name", lv.Name)
 		}
 		return ctrl.Result{}, err
 	}
@@ -142,7 +165,7 @@ func (r *LogicalVolumeReconciler) SetupWithManager(mgr ctrl.Manager) error {
 }
 
 func (r *LogicalVolumeReconciler) removeLVIfExists(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume) error {
-	err := r.lsmc.RemoveLV(string(lv.UID), lv.Spec.DeviceClass)
+	err := r.lsmc.RemoveLV(ctx, volumeName(lv), lv.Spec.DeviceClass)
 	if errors.Is(err, lsm.ErrNoVolume) {
 		log.Info("LV already removed", "name", lv.Name, "uid", lv.UID)
 		return nil
@@ -155,20 +178,45 @@ func (r *LogicalVolumeReconciler) removeLVIfExists(ctx context.Context, log logr
 	return nil
 }
 
-func (r *LogicalVolumeReconciler) volumeExists(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume) (bool, error) {
-	volumes, err := r.lsmc.GetLVList(lv.Spec.DeviceClass)
+// adoptLV sets the limit of the volume found on the node without a limit, after that the volume is
+// handled as an existing one. Errors are only logged, the volume is created or expanded as usual then.
+func (r *LogicalVolumeReconciler) adoptLV(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume) {
+	_, err := r.lsmc.AdoptLV(ctx, volumeName(lv), lv.Spec.DeviceClass, uint64(lv.Spec.Size.Value()))
+	if errors.Is(err, lsm.ErrNoVolume) {
+		return
+	}
+	if err != nil {
+		log.Error(err, "failed to repair LV limit", "name", lv.Name, "uid", lv.UID)
+		return
+	}
+	log.Info("repaired LV limit", "name", lv.Name, "uid", lv.UID, "size", lv.Spec.Size.Value())
+}
+
+// findVolume returns the volume of the LogicalVolume on the node, nil if it does not exist.
+func (r *LogicalVolumeReconciler) findVolume(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume) (*lsm.LogicalVolume, error) {
+	volumes, err := r.lsmc.GetLVList(ctx, lv.Spec.DeviceClass)
 	if err != nil {
 		log.Error(err, "failed to get list of LV")
-		return false, err
+		return nil, err
 	}
 
 	for _, v := range volumes {
-		if v.Name != string(lv.UID) {
+		if v.Name != volumeName(lv) {
 			continue
 		}
-		return true, nil
+		return v, nil
+	}
+	return nil, nil
+}
+
+// creationTime returns the time when the volume was created on the node,
+// the current time is returned for volumes without metadata.
+func creationTime(v *lsm.LogicalVolume) *metav1.Time {
+	t := metav1.Now()
+	if v.Meta != nil && !v.Meta.CreatedAt.IsZero() {
+		t = metav1.NewTime(v.Meta.CreatedAt)
 	}
-	return false, nil
+	return &t
 }
 
 func (r *LogicalVolumeReconciler) createLV(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume) error {
@@ -182,21 +230,35 @@ func (r *LogicalVolumeReconciler) createLV(ctx context.Context, log logr.Logger,
 
 	err := func() error {
 		// In case the controller crashed just after LVM LV creation, LV may already exist.
-		found, err := r.volumeExists(ctx, log, lv)
+		found, err := r.findVolume(ctx, log, lv)
 		if err != nil {
 			lv.Status.Code = codes.Internal
 			lv.Status.Message = "failed to check volume existence"
 			return err
 		}
-		if found {
+		if found != nil {
 			log.Info("set volumeID to existing LogicalVolume", "name", lv.Name, "uid", lv.UID, "status.volumeID", lv.Status.VolumeID)
+			if err := r.applySpec(ctx, log, lv, found.Name); err != nil {
+				return err
+			}
 			// Don't set CurrentSize here because the Spec.Size field may be updated after the LVM LV is created.
-			lv.Status.VolumeID = string(lv.UID)
+			lv.Status.VolumeID = volumeName(lv)
+			if lv.Status.CreationTime == nil {
+				lv.Status.CreationTime = creationTime(found)
+			}
+			lv.Status.ObservedGeneration = lv.Generation
 			lv.Status.Code = codes.OK
 			lv.Status.Message = ""
 			return nil
 		}
 
+		if name, ok := lv.Annotations[topols.RecoveredVolumeKey]; ok {
+			// the volume is lost too, an empty volume must not be created in place of it
+			lv.Status.Code = codes.NotFound
+			lv.Status.Message = fmt.Sprintf("recovered volume %s is not found", name)
+			return errors.New(lv.Status.Message)
+		}
+
 		var volume *lsm.LogicalVolume
 
 		// Create a snapshot LV
@@ -212,8 +274,13 @@ func (r *LogicalVolumeReconciler) createLV(ctx context.Context, log logr.Logger,
 			}
 			sourceVolID := sourcelv.Status.VolumeID
 
-			// Create a snapshot lv
-			volume, err = r.lsmc.CreateLVSnapshot(string(lv.UID), lv.Spec.DeviceClass, sourceVolID, uint64(reqBytes), lv.Spec.AccessType)
+			if sourcelv.Spec.NodeName != r.nodeName {
+				// Restore a snapshot of another node
+				volume, err = r.receiveLV(ctx, lv, sourcelv, uint64(reqBytes))
+			} else {
+				// Create a snapshot lv
+				volume, err = r.lsmc.CreateLVSnapshot(ctx, string(lv.UID), lv.Spec.DeviceClass, sourceVolID, uint64(reqBytes), lv.Spec.AccessType, volumeOwner(lv))
+			}
 			if err != nil {
 				code, message := extractFromError(err)
 				log.Error(err, message)
@@ -223,7 +290,7 @@ func (r *LogicalVolumeReconciler) createLV(ctx context.Context, log logr.Logger,
 			}
 		} else {
 			// Create a regular lv
-			volume, err = r.lsmc.CreateLV(string(lv.UID), lv.Spec.DeviceClass, lv.Spec.NoCow, uint64(reqBytes))
+			volume, err = r.lsmc.CreateLV(ctx, string(lv.UID), lv.Spec.DeviceClass, volumeOptions(lv), uint64(reqBytes), volumeOwner(lv))
 			if err != nil {
 				code, message := extractFromError(err)
 				log.Error(err, message)
@@ -233,8 +300,14 @@ func (r *LogicalVolumeReconciler) createLV(ctx context.Context, log logr.Logger,
 			}
 		}
 
+		if err := r.applySpec(ctx, log, lv, volume.Name); err != nil {
+			return err
+		}
+
 		lv.Status.VolumeID = volume.Name
+		lv.Status.CreationTime = creationTime(volume)
 		lv.Status.CurrentSize = resource.NewQuantity(reqBytes, resource.BinarySI)
+		lv.Status.ObservedGeneration = lv.Generation
 		lv.Status.Code = codes.OK
 		lv.Status.Message = ""
 		return nil
@@ -257,6 +330,35 @@ func (r *LogicalVolumeReconciler) createLV(ctx context.Context, log logr.Logger,
 	return nil
 }
 
+// applySpec applies the quota mode of the spec and options overridden for a clone to the new volume,
+// so the volume matches the spec generation which is recorded on creation.
+func (r *LogicalVolumeReconciler) applySpec(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume, name string) error {
+	if lv.Spec.AccessType == "ro" || (lv.Spec.Source == "" && lv.Spec.QuotaMode == "") {
+		return nil
+	}
+
+	err := r.lsmc.ModifyLV(ctx, name, lv.Spec.DeviceClass, volumeOptions(lv), lsm.QuotaMode(lv.Spec.QuotaMode))
+	if err != nil {
+		code, message := extractFromError(err)
+		log.Error(err, message)
+		lv.Status.Code = code
+		lv.Status.Message = message
+		return err
+	}
+	return nil
+}
+
+func (r *LogicalVolumeReconciler) receiveLV(ctx context.Context, lv, sourcelv *topolsv1.LogicalVolume, size uint64) (*lsm.LogicalVolume, error) {
+	if r.receiver == nil {
+		return nil, lsm.WrapError(codes.FailedPrecondition, fmt.Errorf("source volume is on node %s and volume transfer is disabled", sourcelv.Spec.NodeName))
+	}
+	if sourcelv.Spec.AccessType != "ro" {
+		return nil, lsm.WrapError(codes.InvalidArgument, errors.New("only snapshots can be restored on another node"))
+	}
+
+	return r.receiver.Receive(ctx, sourcelv, string(lv.UID), lv.Spec.DeviceClass, volumeOptions(lv), size, volumeOwner(lv))
+}
+
 func (r *LogicalVolumeReconciler) expandLV(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume) error {
 	// We denote unknown size as -1.
 	var origBytes int64 = -1
@@ -274,7 +376,7 @@ func (r *LogicalVolumeReconciler) expandLV(ctx context.Context, log logr.Logger,
 	reqBytes := lv.Spec.Size.Value()
 
 	err := func() error {
-		err := r.lsmc.ResizeLV(string(lv.UID), lv.Spec.DeviceClass, uint64(reqBytes))
+		err := r.lsmc.ResizeLV(ctx, volumeName(lv), lv.Spec.DeviceClass, uint64(reqBytes))
 		if err != nil {
 			code, message := extractFromError(err)
 			log.Error(err, message)
@@ -307,6 +409,63 @@ func (r *LogicalVolumeReconciler) expandLV(ctx context.Context, log logr.Logger,
 	return nil
 }
 
+// modifyLV applies options and the quota mode of the spec to the volume, the lsm client changes only what differs.
+// The generation is recorded with the result, so a failure is retried until the spec is applied.
+// Read-only snapshots are never modified.
+func (r *LogicalVolumeReconciler) modifyLV(ctx context.Context, log logr.Logger, lv *topolsv1.LogicalVolume) error {
+	if lv.Status.ObservedGeneration == lv.Generation && lv.Status.Code == codes.OK {
+		return nil
+	}
+
+	if lv.Status.ObservedGeneration == 0 && lv.Generation == 1 {
+		// the volume was created before generations were recorded and its spec was never changed,
+		// so it is already applied. Changed specs are applied, ModifyLV changes only what differs.
+		lv.Status.ObservedGeneration = lv.Generation
+		if err := r.Status().Update(ctx, lv); err != nil {
+			log.Error(err, "failed to update status", "name", lv.Name, "uid", lv.UID)
+			return err
+		}
+		log.Info("recorded generation of existing LV", "name", lv.Name, "uid", lv.UID, "generation", lv.Generation)
+		return nil
+	}
+
+	err := func() error {
+		if lv.Spec.Source != "" && lv.Spec.AccessType == "ro" {
+			return nil
+		}
+
+		err := r.lsmc.ModifyLV(ctx, volumeName(lv), lv.Spec.DeviceClass, volumeOptions(lv), lsm.QuotaMode(lv.Spec.QuotaMode))
+		if err != nil {
+			code, message := extractFromError(err)
+			log.Error(err, message)
+			lv.Status.Code = code
+			lv.Status.Message = message
+			return err
+		}
+		return nil
+	}()
+
+	lv.Status.ObservedGeneration = lv.Generation
+	if err != nil {
+		if err2 := r.Status().Update(ctx, lv); err2 != nil {
+			// err2 is logged but not returned because err is more important
+			log.Error(err2, "failed to update status", "name", lv.Name, "uid", lv.UID)
+		}
+		return err
+	}
+
+	lv.Status.Code = codes.OK
+	lv.Status.Message = ""
+	if err := r.Status().Update(ctx, lv); err != nil {
+		log.Error(err, "failed to update status", "name", lv.Name, "uid", lv.UID)
+		return err
+	}
+
+	log.Info("modified LV", "name", lv.Name, "uid", lv.UID, "status.volumeID", lv.Status.VolumeID,
+		"options", volumeOptions(lv), "quotaMode", lv.Spec.QuotaMode, "generation", lv.Generation)
+	return nil
+}
+
 type logicalVolumeFilter struct {
 	nodeName string
 }
@@ -337,10 +496,34 @@ func (f logicalVolumeFilter) Generic(e event.GenericEvent) bool {
 	return f.filter(e.Object.(*topolsv1.LogicalVolume))
 }
 
+func volumeOptions(lv *topolsv1.LogicalVolume) lsm.VolumeOptions {
+	return lsm.VolumeOptions{NoCow: lv.Spec.NoCow, Compression: lv.Spec.Compression}
+}
+
+// volumeName returns the name of the volume on the node. It is the uid of LogicalVolume
+// unless LogicalVolume is recreated for an existing volume.
+func volumeName(lv *topolsv1.LogicalVolume) string {
+	if lv.Status.VolumeID != "" {
+		return lv.Status.VolumeID
+	}
+	if name := lv.Annotations[topols.RecoveredVolumeKey]; name != "" {
+		return name
+	}
+	return string(lv.UID)
+}
+
+func volumeOwner(lv *topolsv1.LogicalVolume) lsm.VolumeOwner {
+	return lsm.VolumeOwner{
+		LogicalVolume: lv.Name,
+		PVCNamespace:  lv.Annotations[topols.PVCNamespaceKey],
+		PVCName:       lv.Annotations[topols.PVCNameKey],
+	}
+}
+
 func extractFromError(err error) (codes.Code, string) {
 	s, ok := status.FromError(err)
 	if !ok {
-		return codes.Internal, err.Error()
+		return lsm.ErrorCode(err), err.Error()
 	}
 	return s.Code(), s.Message()
 }
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/kvaster/topols"
@@ -20,6 +21,19 @@ import (
 
 var volumes = &[]*lsm.LogicalVolume{}
 
+func findMockVolume(name string) *lsm.LogicalVolume {
+	for _, v := range *volumes {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func addMockVolume(name, deviceClass string, size uint64) {
+	*volumes = append(*volumes, &lsm.LogicalVolume{Name: name, DeviceClass: deviceClass, Size: size})
+}
+
 type MockLsmClient struct {
 }
 
@@ -27,11 +41,11 @@ func (l MockLsmClient) Start(context.Context) error {
 	return nil
 }
 
-func (l MockLsmClient) GetLVList(deviceClass string) ([]*lsm.LogicalVolume, error) {
+func (l MockLsmClient) GetLVList(ctx context.Context, deviceClass string) ([]*lsm.LogicalVolume, error) {
 	return *volumes, nil
 }
 
-func (l MockLsmClient) CreateLV(name, deviceClass string, noCow bool, size uint64) (*lsm.LogicalVolume, error) {
+func (l MockLsmClient) CreateLV(ctx context.Context, name, deviceClass string, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error) {
 	lv := lsm.LogicalVolume{
 		Name:        name,
 		DeviceClass: deviceClass,
@@ -43,15 +57,48 @@ func (l MockLsmClient) CreateLV(name, deviceClass string, noCow bool, size uint6
 	return &lv, nil
 }
 
-func (l MockLsmClient) RemoveLV(name, deviceClass string) error {
+func (l MockLsmClient) RemoveLV(ctx context.Context, name, deviceClass string) error {
 	panic("unimplemented")
 }
 
-func (l MockLsmClient) ResizeLV(name, deviceClass string, size uint64) error {
-	panic("unimplemented")
+func (l MockLsmClient) ResizeLV(ctx context.Context, name, deviceClass string, size uint64) error {
+	v := findMockVolume(name)
+	if v == nil {
+		return lsm.ErrNoVolume
+	}
+	v.Size = size
+	return nil
 }
 
-func (l MockLsmClient) CreateLVSnapshot(name, deviceClass, sourceVolID string, size uint64, accessType string) (*lsm.LogicalVolume, error) {
+func (l MockLsmClient) CreateLVSnapshot(ctx context.Context, name, deviceClass, sourceVolID string, size uint64, accessType string, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error) {
+	lv := lsm.LogicalVolume{
+		Name:        name,
+		DeviceClass: deviceClass,
+		Size:        size,
+		Meta:        &lsm.VolumeMeta{Name: name, DeviceClass: deviceClass, Size: size, Source: sourceVolID, AccessType: accessType},
+	}
+
+	*volumes = append(*volumes, &lv)
+
+	return &lv, nil
+}
+
+func (l MockLsmClient) ModifyLV(ctx context.Context, name, deviceClass string, opts lsm.VolumeOptions, mode lsm.QuotaMode) error {
+	v := findMockVolume(name)
+	if v == nil {
+		return lsm.ErrNoVolume
+	}
+	m := lsm.VolumeMeta{Name: name, DeviceClass: deviceClass, Size: v.Size}
+	if v.Meta != nil {
+		m = *v.Meta
+	}
+	m.Options = opts
+	m.QuotaMode = mode
+	v.Meta = &m
+	return nil
+}
+
+func (l MockLsmClient) SetBlock(ctx context.Context, name, deviceClass string) error {
 	panic("unimplemented")
 }
 
@@ -59,11 +106,47 @@ func (l MockLsmClient) GetPath(v *lsm.LogicalVolume) string {
 	panic("unimplemented")
 }
 
-func (l MockLsmClient) VolumeStats(name, deviceClass string) (*lsm.VolumeStats, error) {
+func (l MockLsmClient) VolumeStats(ctx context.Context, name, deviceClass string) (*lsm.VolumeStats, error) {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) NodeStats(ctx context.Context) (*lsm.NodeStats, error) {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) SendLV(ctx context.Context, name, deviceClass, parent string, w io.Writer) error {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) ReceiveLV(ctx context.Context, name, deviceClass string, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner, r io.Reader) (*lsm.LogicalVolume, error) {
 	panic("unimplemented")
 }
 
-func (l MockLsmClient) NodeStats() (*lsm.NodeStats, error) {
+func (l MockLsmClient) SendLVIncremental(ctx context.Context, name, deviceClass string, pass int, w io.Writer) error {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) ReceiveLVIncremental(ctx context.Context, name, deviceClass string, pass int, r io.Reader) error {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) CompleteLVIncremental(ctx context.Context, name, deviceClass string, pass int, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error) {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) RemoveLVIncremental(ctx context.Context, name, deviceClass string) error {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) UnknownEntries(ctx context.Context, deviceClass string) ([]*lsm.UnknownEntry, error) {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) AdoptLV(ctx context.Context, name, deviceClass string, size uint64) (*lsm.LogicalVolume, error) {
+	panic("unimplemented")
+}
+
+func (l MockLsmClient) RemoveStale(ctx context.Context) (int, error) {
 	panic("unimplemented")
 }
 
@@ -85,7 +168,7 @@ var _ = Describe("LogicalVolume controller", func() {
 
 		lsm = MockLsmClient{}
 
-		reconciler := NewLogicalVolumeReconciler(mgr.GetClient(), lsm, "node"+suffix)
+		reconciler := NewLogicalVolumeReconciler(mgr.GetClient(), lsm, "node"+suffix, false, nil)
 		err = reconciler.SetupWithManager(mgr)
 		Expect(err).NotTo(HaveOccurred())
 
@@ -161,6 +244,43 @@ var _ = Describe("LogicalVolume controller", func() {
 		return lv
 	}
 
+	// setupRestore creates a volume, its snapshot and a volume restored from the snapshot.
+	setupRestore := func(ctx context.Context, suffix string, sourceSize, size int64) (topolsv1.LogicalVolume, topolsv1.LogicalVolume) {
+		createLV := func(name, source, accessType string, size int64) topolsv1.LogicalVolume {
+			lv := topolsv1.LogicalVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+				},
+				Spec: topolsv1.LogicalVolumeSpec{
+					Name:        name,
+					NodeName:    "node" + suffix,
+					DeviceClass: "ssd",
+					Size:        *resource.NewQuantity(size, resource.BinarySI),
+					Source:      source,
+					AccessType:  accessType,
+				},
+			}
+			err := k8sClient.Create(ctx, &lv)
+			Expect(err).NotTo(HaveOccurred())
+			return lv
+		}
+		waitCreated := func(lv *topolsv1.LogicalVolume) {
+			Eventually(func(g Gomega) {
+				err := k8sClient.Get(ctx, client.ObjectKeyFromObject(lv), lv)
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(lv.Status.VolumeID).NotTo(BeEmpty())
+			}).Should(Succeed())
+		}
+
+		origin := createLV("origin"+suffix, "", "", sourceSize)
+		waitCreated(&origin)
+		snapshot := createLV("snapshot"+suffix, origin.Name, "ro", sourceSize)
+		waitCreated(&snapshot)
+		lv := createLV("lv"+suffix, snapshot.Name, "rw", size)
+
+		return snapshot, lv
+	}
+
 	It("should add finalizer to LogicalVolume", func() {
 		startReconciler("-add-finalizer")
 
@@ -217,4 +337,196 @@ var _ = Describe("LogicalVolume controller", func() {
 			return !controllerutil.ContainsFinalizer(&lv, topols.LogicalVolumeFinalizer)
 		}, "2s").Should(BeTrue())
 	})
+
+	It("should restore a snapshot into a larger volume", func() {
+		startReconciler("-restore-larger")
+
+		ctx := context.Background()
+
+		// Setup
+		source, lv := setupRestore(ctx, "-restore-larger", 10<<30, 50<<30)
+
+		// Verify
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&lv), &lv)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(lv.Status.VolumeID).NotTo(BeEmpty())
+			g.Expect(lv.Status.CurrentSize).NotTo(BeNil())
+			g.Expect(lv.Status.CurrentSize.Value()).To(BeNumerically("==", 50<<30))
+		}).Should(Succeed())
+
+		v := findMockVolume(lv.Status.VolumeID)
+		Expect(v).NotTo(BeNil())
+		Expect(v.Size).To(BeNumerically("==", 50<<30))
+		Expect(v.Meta.Source).To(Equal(source.Status.VolumeID))
+		Expect(v.Meta.AccessType).To(Equal("rw"))
+	})
+
+	It("should adopt a larger restored volume created before its status was lost", func() {
+		startReconciler("-restore-retry")
+
+		ctx := context.Background()
+
+		// Setup
+		_, lv := setupRestore(ctx, "-restore-retry", 10<<30, 50<<30)
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&lv), &lv)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(lv.Status.VolumeID).NotTo(BeEmpty())
+		}).Should(Succeed())
+		volumeID := lv.Status.VolumeID
+
+		// Exercise
+		// the status is lost as if topols-node crashed just after the volume was created
+		lv.Status.VolumeID = ""
+		lv.Status.CurrentSize = nil
+		err := k8sClient.Status().Update(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Verify
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&lv), &lv)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(lv.Status.VolumeID).To(Equal(volumeID))
+			g.Expect(lv.Status.CurrentSize).NotTo(BeNil())
+			g.Expect(lv.Status.CurrentSize.Value()).To(BeNumerically("==", 50<<30))
+		}).Should(Succeed())
+
+		count := 0
+		for _, v := range *volumes {
+			if v.Name == volumeID {
+				count++
+			}
+		}
+		Expect(count).To(Equal(1))
+	})
+
+	It("should apply modified options and quota mode to the volume", func() {
+		startReconciler("-modify")
+
+		ctx := context.Background()
+
+		// Setup
+		lv := topolsv1.LogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "lv-modify",
+			},
+			Spec: topolsv1.LogicalVolumeSpec{
+				Name:        "lv-modify",
+				NodeName:    "node-modify",
+				DeviceClass: "ssd",
+				Size:        *resource.NewQuantity(1<<30, resource.BinarySI),
+			},
+		}
+		err := k8sClient.Create(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&lv), &lv)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(lv.Status.VolumeID).NotTo(BeEmpty())
+			g.Expect(lv.Status.ObservedGeneration).To(Equal(lv.Generation))
+		}).Should(Succeed())
+
+		// Exercise
+		lv.Spec.Compression = "zstd:3"
+		lv.Spec.QuotaMode = "exclusive"
+		err = k8sClient.Update(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Verify
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&lv), &lv)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(lv.Status.ObservedGeneration).To(Equal(lv.Generation))
+		}).Should(Succeed())
+
+		v := findMockVolume(lv.Status.VolumeID)
+		Expect(v).NotTo(BeNil())
+		Expect(v.Meta).NotTo(BeNil())
+		Expect(v.Meta.Options.Compression).To(Equal("zstd:3"))
+		Expect(v.Meta.QuotaMode).To(BeEquivalentTo("exclusive"))
+	})
+
+	It("should record the generation of an existing volume without modifying it", func() {
+		ctx := context.Background()
+
+		// Setup
+		lv := topolsv1.LogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "lv-observe",
+			},
+			Spec: topolsv1.LogicalVolumeSpec{
+				Name:        "lv-observe",
+				NodeName:    "node-observe",
+				DeviceClass: "ssd",
+				Size:        *resource.NewQuantity(1<<30, resource.BinarySI),
+				QuotaMode:   "exclusive",
+			},
+		}
+		err := k8sClient.Create(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+		lv.Status.VolumeID = "volume-observe"
+		lv.Status.CurrentSize = resource.NewQuantity(1<<30, resource.BinarySI)
+		err = k8sClient.Status().Update(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+		addMockVolume("volume-observe", "ssd", 1<<30)
+
+		// Exercise
+		startReconciler("-observe")
+
+		// Verify
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&lv), &lv)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(lv.Status.ObservedGeneration).To(Equal(lv.Generation))
+		}).Should(Succeed())
+
+		v := findMockVolume("volume-observe")
+		Expect(v).NotTo(BeNil())
+		Expect(v.Meta).To(BeNil())
+	})
+
+	It("should apply the spec of an existing volume changed before it is observed", func() {
+		ctx := context.Background()
+
+		// Setup
+		lv := topolsv1.LogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "lv-observe-changed",
+			},
+			Spec: topolsv1.LogicalVolumeSpec{
+				Name:        "lv-observe-changed",
+				NodeName:    "node-observe-changed",
+				DeviceClass: "ssd",
+				Size:        *resource.NewQuantity(1<<30, resource.BinarySI),
+			},
+		}
+		err := k8sClient.Create(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+		lv.Status.VolumeID = "volume-observe-changed"
+		lv.Status.CurrentSize = resource.NewQuantity(1<<30, resource.BinarySI)
+		err = k8sClient.Status().Update(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+		addMockVolume("volume-observe-changed", "ssd", 1<<30)
+
+		lv.Spec.Compression = "zstd:3"
+		err = k8sClient.Update(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lv.Generation).To(BeNumerically(">", 1))
+
+		// Exercise
+		startReconciler("-observe-changed")
+
+		// Verify
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(&lv), &lv)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(lv.Status.ObservedGeneration).To(Equal(lv.Generation))
+		}).Should(Succeed())
+
+		v := findMockVolume("volume-observe-changed")
+		Expect(v).NotTo(BeNil())
+		Expect(v.Meta).NotTo(BeNil())
+		Expect(v.Meta.Options.Compression).To(Equal("zstd:3"))
+	})
 })
@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/kvaster/topols"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/internal/cron"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// SnapshotScheduleReconciler takes read-only snapshots of selected PVCs by the cron schedule and prunes
+// snapshots expired by the retention. Snapshots are LogicalVolumes owned by SnapshotSchedule.
+type SnapshotScheduleReconciler struct {
+	client    client.Client
+	apiReader client.Reader
+	now       func() time.Time
+}
+
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=snapshotschedules,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=snapshotschedules/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=logicalvolumes,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get
+
+// NewSnapshotScheduleReconciler returns SnapshotScheduleReconciler.
+// PersistentVolumes are read with apiReader, so the controller does not cache them.
+func NewSnapshotScheduleReconciler(client client.Client, apiReader client.Reader) *SnapshotScheduleReconciler {
+	return &SnapshotScheduleReconciler{
+		client:    client,
+		apiReader: apiReader,
+		now:       time.Now,
+	}
+}
+
+// Reconcile takes snapshots if the schedule is due and prunes expired snapshots.
+func (r *SnapshotScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := crlog.FromContext(ctx)
+
+	ss := new(topolsv1.SnapshotSchedule)
+	if err := r.client.Get(ctx, req.NamespacedName, ss); err != nil {
+		if !apierrs.IsNotFound(err) {
+			log.Error(err, "unable to fetch SnapshotSchedule")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// snapshots are deleted by the garbage collector together with SnapshotSchedule
+	if ss.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+
+	schedule, err := cron.Parse(ss.Spec.Schedule)
+	if err != nil {
+		return ctrl.Result{}, r.invalid(ctx, log, ss, fmt.Sprintf("invalid schedule: %v", err))
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&ss.Spec.Selector)
+	if err != nil {
+		return ctrl.Result{}, r.invalid(ctx, log, ss, fmt.Sprintf("invalid selector: %v", err))
+	}
+
+	now := r.now().UTC()
+	last := ss.CreationTimestamp.UTC()
+	if ss.Status.LastScheduleTime != nil {
+		last = ss.Status.LastScheduleTime.UTC()
+	}
+	// missed runs are not caught up, only the latest one is done
+	var due time.Time
+	next := schedule.Next(last)
+	for !next.IsZero() && !next.After(now) {
+		due = next
+		next = schedule.Next(next)
+	}
+
+	if !due.IsZero() && !ss.Spec.Suspend {
+		failures, err := r.snapshot(ctx, log, ss, selector, due)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		t := metav1.NewTime(due)
+		ss.Status.LastScheduleTime = &t
+		ss.Status.Failures = failures
+		log.Info("took scheduled snapshots", "name", ss.Name, "time", due, "failures", len(failures))
+	}
+
+	if err := r.prune(ctx, log, ss); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	ss.Status.Message = ""
+	ss.Status.NextScheduleTime = nil
+	if !ss.Spec.Suspend && !next.IsZero() {
+		t := metav1.NewTime(next)
+		ss.Status.NextScheduleTime = &t
+	}
+	if err := r.updateStatus(ctx, log, ss); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if ss.Status.NextScheduleTime == nil {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{RequeueAfter: next.Sub(now)}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *SnapshotScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		// status updates of the schedule must not trigger it again
+		For(&topolsv1.SnapshotSchedule{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&topolsv1.LogicalVolume{}).
+		Complete(r)
+}
+
+// snapshot creates snapshots of selected PVCs for the scheduled time, failures are returned for PVCs without snapshots.
+func (r *SnapshotScheduleReconciler) snapshot(ctx context.Context, log logr.Logger, ss *topolsv1.SnapshotSchedule, selector labels.Selector, due time.Time) ([]topolsv1.SnapshotFailure, error) {
+	var pvcs []corev1.PersistentVolumeClaim
+	namespaces := ss.Spec.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, ns := range namespaces {
+		var pl corev1.PersistentVolumeClaimList
+		if err := r.client.List(ctx, &pl, client.InNamespace(ns), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, err
+		}
+		pvcs = append(pvcs, pl.Items...)
+	}
+
+	var lvl topolsv1.LogicalVolumeList
+	if err := r.client.List(ctx, &lvl); err != nil {
+		return nil, err
+	}
+	volumes := make(map[string]*topolsv1.LogicalVolume)
+	for i := range lvl.Items {
+		lv := &lvl.Items[i]
+		if lv.Status.VolumeID != "" {
+			volumes[lv.Status.VolumeID] = lv
+		}
+	}
+
+	var failures []topolsv1.SnapshotFailure
+	for _, pvc := range pvcs {
+		if pvc.Spec.VolumeName == "" || pvc.DeletionTimestamp != nil {
+			continue
+		}
+		pv := new(corev1.PersistentVolume)
+		if err := r.apiReader.Get(ctx, types.NamespacedName{Name: pvc.Spec.VolumeName}, pv); err != nil {
+			if apierrs.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != topols.PluginName {
+			continue
+		}
+
+		pvcName := pvc.Namespace + "/" + pvc.Name
+		lv, ok := volumes[pv.Spec.CSI.VolumeHandle]
+		if !ok {
+			failures = append(failures, topolsv1.SnapshotFailure{PersistentVolumeClaim: pvcName, Message: "LogicalVolume is not found"})
+			continue
+		}
+
+		snap := newScheduledSnapshot(ss, lv, due)
+		if err := controllerutil.SetControllerReference(ss, snap, r.client.Scheme()); err != nil {
+			return nil, err
+		}
+		if err := r.client.Create(ctx, snap); err != nil && !apierrs.IsAlreadyExists(err) {
+			log.Error(err, "failed to create snapshot LogicalVolume", "name", ss.Name, "snapshot", snap.Name)
+			failures = append(failures, topolsv1.SnapshotFailure{PersistentVolumeClaim: pvcName, LogicalVolume: lv.Name, Message: err.Error()})
+		}
+	}
+	return failures, nil
+}
+
+func newScheduledSnapshot(ss *topolsv1.SnapshotSchedule, lv *topolsv1.LogicalVolume, due time.Time) *topolsv1.LogicalVolume {
+	uid := string(ss.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	name := fmt.Sprintf("%s-%s-%s", lv.Name, uid, due.UTC().Format("200601021504"))
+	return &topolsv1.LogicalVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{topols.SnapshotTimeKey: due.UTC().Format(time.RFC3339)},
+		},
+		Spec: topolsv1.LogicalVolumeSpec{
+			Name:        name,
+			NodeName:    lv.Spec.NodeName,
+			Size:        lv.Spec.Size,
+			DeviceClass: lv.Spec.DeviceClass,
+			NoCow:       lv.Spec.NoCow,
+			Compression: lv.Spec.Compression,
+			Source:      lv.Name,
+			AccessType:  "ro",
+		},
+	}
+}
+
+// prune deletes snapshots expired by the retention and snapshots failed on nodes, the latter are reported as failures.
+func (r *SnapshotScheduleReconciler) prune(ctx context.Context, log logr.Logger, ss *topolsv1.SnapshotSchedule) error {
+	var lvl topolsv1.LogicalVolumeList
+	if err := r.client.List(ctx, &lvl); err != nil {
+		return err
+	}
+
+	var snapshots []*topolsv1.LogicalVolume
+	for i := range lvl.Items {
+		lv := &lvl.Items[i]
+		if !metav1.IsControlledBy(lv, ss) || lv.DeletionTimestamp != nil {
+			continue
+		}
+		if lv.Status.Code != codes.OK {
+			failed := false
+			for _, f := range ss.Status.Failures {
+				failed = failed || f.LogicalVolume == lv.Spec.Source
+			}
+			if !failed {
+				ss.Status.Failures = append(ss.Status.Failures, topolsv1.SnapshotFailure{LogicalVolume: lv.Spec.Source, Message: lv.Status.Message})
+			}
+			if err := r.client.Delete(ctx, lv); err != nil && !apierrs.IsNotFound(err) {
+				return err
+			}
+			log.Info("deleted failed snapshot", "name", ss.Name, "snapshot", lv.Name, "message", lv.Status.Message)
+			continue
+		}
+		snapshots = append(snapshots, lv)
+	}
+
+	kept := retainedSnapshots(snapshots, ss.Spec.Retention)
+	count := 0
+	for _, lv := range snapshots {
+		if kept[lv.Name] {
+			count++
+			continue
+		}
+		if err := r.client.Delete(ctx, lv); err != nil && !apierrs.IsNotFound(err) {
+			log.Error(err, "failed to delete expired snapshot", "name", ss.Name, "snapshot", lv.Name)
+			return err
+		}
+		log.Info("deleted expired snapshot", "name", ss.Name, "snapshot", lv.Name)
+	}
+	ss.Status.Snapshots = count
+	return nil
+}
+
+// retainedSnapshots returns names of snapshots kept by the retention, rules are applied to snapshots
+// of each volume separately. Snapshots which are not created yet are always kept.
+func retainedSnapshots(snapshots []*topolsv1.LogicalVolume, retention topolsv1.SnapshotRetention) map[string]bool {
+	kept := make(map[string]bool)
+	if retention == (topolsv1.SnapshotRetention{}) {
+		for _, lv := range snapshots {
+			kept[lv.Name] = true
+		}
+		return kept
+	}
+
+	bySource := make(map[string][]*topolsv1.LogicalVolume)
+	for _, lv := range snapshots {
+		if lv.Status.VolumeID == "" {
+			kept[lv.Name] = true
+			continue
+		}
+		bySource[lv.Spec.Source] = append(bySource[lv.Spec.Source], lv)
+	}
+
+	periods := []struct {
+		count int
+		key   func(t time.Time) string
+	}{
+		{count: retention.Last, key: func(t time.Time) string { return t.Format(time.RFC3339Nano) }},
+		{count: retention.Hourly, key: func(t time.Time) string { return t.Format("2006010215") }},
+		{count: retention.Daily, key: func(t time.Time) string { return t.Format("20060102") }},
+		{count: retention.Weekly, key: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{count: retention.Monthly, key: func(t time.Time) string { return t.Format("200601") }},
+	}
+
+	for _, lvs := range bySource {
+		sort.Slice(lvs, func(i, j int) bool { return snapshotTime(lvs[i]).After(snapshotTime(lvs[j])) })
+		for _, p := range periods {
+			seen := make(map[string]bool)
+			for _, lv := range lvs {
+				if len(seen) == p.count {
+					break
+				}
+				key := p.key(snapshotTime(lv))
+				if !seen[key] {
+					seen[key] = true
+					kept[lv.Name] = true
+				}
+			}
+		}
+	}
+	return kept
+}
+
+// snapshotTime returns the scheduled time of the snapshot, the creation time is used if there is no annotation.
+func snapshotTime(lv *topolsv1.LogicalVolume) time.Time {
+	if t, err := time.Parse(time.RFC3339, lv.Annotations[topols.SnapshotTimeKey]); err == nil {
+		return t
+	}
+	return lv.CreationTimestamp.UTC()
+}
+
+func (r *SnapshotScheduleReconciler) invalid(ctx context.Context, log logr.Logger, ss *topolsv1.SnapshotSchedule, message string) error {
+	ss.Status.Message = message
+	ss.Status.NextScheduleTime = nil
+	log.Info("invalid snapshot schedule", "name", ss.Name, "message", message)
+	return r.updateStatus(ctx, log, ss)
+}
+
+func (r *SnapshotScheduleReconciler) updateStatus(ctx context.Context, log logr.Logger, ss *topolsv1.SnapshotSchedule) error {
+	if err := r.client.Status().Update(ctx, ss); err != nil {
+		log.Error(err, "failed to update status", "name", ss.Name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/kvaster/topols"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("SnapshotSchedule controller", func() {
+	ctx := context.Background()
+	var stopFunc func()
+	errCh := make(chan error)
+
+	startReconciler := func(now time.Time) {
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme: scheme,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		reconciler := NewSnapshotScheduleReconciler(mgr.GetClient(), mgr.GetAPIReader())
+		reconciler.now = func() time.Time { return now }
+		err = reconciler.SetupWithManager(mgr)
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(ctx)
+		stopFunc = cancel
+		go func() {
+			errCh <- mgr.Start(ctx)
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	AfterEach(func() {
+		stopFunc()
+		Expect(<-errCh).NotTo(HaveOccurred())
+	})
+
+	setupVolume := func(ctx context.Context, suffix string) (corev1.PersistentVolumeClaim, topolsv1.LogicalVolume) {
+		lv := topolsv1.LogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "lv" + suffix,
+			},
+			Spec: topolsv1.LogicalVolumeSpec{
+				Name:        "lv" + suffix,
+				NodeName:    "node" + suffix,
+				DeviceClass: "ssd",
+				Size:        *resource.NewQuantity(1<<30, resource.BinarySI),
+			},
+		}
+		err := k8sClient.Create(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+		lv.Status.VolumeID = "volume" + suffix
+		err = k8sClient.Status().Update(ctx, &lv)
+		Expect(err).NotTo(HaveOccurred())
+
+		pv := corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "pv" + suffix,
+			},
+			Spec: corev1.PersistentVolumeSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				Capacity: corev1.ResourceList{
+					corev1.ResourceStorage: *resource.NewQuantity(1<<30, resource.BinarySI),
+				},
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{
+						Driver:       topols.PluginName,
+						VolumeHandle: lv.Status.VolumeID,
+					},
+				},
+			},
+		}
+		err = k8sClient.Create(ctx, &pv)
+		Expect(err).NotTo(HaveOccurred())
+
+		ns := createNamespace()
+		pvc := corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "pvc" + suffix,
+				Namespace: ns,
+				Labels:    map[string]string{"schedule": suffix},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: *resource.NewQuantity(1<<30, resource.BinarySI),
+					},
+				},
+				VolumeName: pv.Name,
+			},
+		}
+		err = k8sClient.Create(ctx, &pvc)
+		Expect(err).NotTo(HaveOccurred())
+
+		return pvc, lv
+	}
+
+	listSnapshots := func(ctx context.Context, ss *topolsv1.SnapshotSchedule) []topolsv1.LogicalVolume {
+		var lvl topolsv1.LogicalVolumeList
+		err := k8sClient.List(ctx, &lvl)
+		Expect(err).NotTo(HaveOccurred())
+		var snapshots []topolsv1.LogicalVolume
+		for _, lv := range lvl.Items {
+			if metav1.IsControlledBy(&lv, ss) && lv.DeletionTimestamp == nil {
+				snapshots = append(snapshots, lv)
+			}
+		}
+		return snapshots
+	}
+
+	It("should take snapshots of selected PVCs when the schedule is due", func() {
+		startReconciler(time.Now().Add(2 * time.Minute))
+
+		ctx := context.Background()
+
+		// Setup
+		_, lv := setupVolume(ctx, "-ss-due")
+
+		// Exercise
+		ss := &topolsv1.SnapshotSchedule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "ss-due",
+			},
+			Spec: topolsv1.SnapshotScheduleSpec{
+				Schedule: "* * * * *",
+				Selector: metav1.LabelSelector{MatchLabels: map[string]string{"schedule": "-ss-due"}},
+			},
+		}
+		err := k8sClient.Create(ctx, ss)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Verify
+		Eventually(func(g Gomega) {
+			snapshots := listSnapshots(ctx, ss)
+			g.Expect(snapshots).To(HaveLen(1))
+			g.Expect(snapshots[0].Spec.Source).To(Equal(lv.Name))
+			g.Expect(snapshots[0].Spec.AccessType).To(Equal("ro"))
+			g.Expect(snapshots[0].Spec.NodeName).To(Equal(lv.Spec.NodeName))
+			g.Expect(snapshots[0].Annotations).To(HaveKey(topols.SnapshotTimeKey))
+		}).Should(Succeed())
+
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(ss), ss)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(ss.Status.LastScheduleTime).NotTo(BeNil())
+			g.Expect(ss.Status.NextScheduleTime).NotTo(BeNil())
+			g.Expect(ss.Status.Failures).To(BeEmpty())
+		}).Should(Succeed())
+	})
+
+	It("should not take snapshots when the schedule is suspended", func() {
+		startReconciler(time.Now().Add(2 * time.Minute))
+
+		ctx := context.Background()
+
+		// Setup
+		setupVolume(ctx, "-ss-suspend")
+
+		// Exercise
+		ss := &topolsv1.SnapshotSchedule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "ss-suspend",
+			},
+			Spec: topolsv1.SnapshotScheduleSpec{
+				Schedule: "* * * * *",
+				Selector: metav1.LabelSelector{MatchLabels: map[string]string{"schedule": "-ss-suspend"}},
+				Suspend:  true,
+			},
+		}
+		err := k8sClient.Create(ctx, ss)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Verify
+		Consistently(func(g Gomega) {
+			g.Expect(listSnapshots(ctx, ss)).To(BeEmpty())
+		}, 2*time.Second).Should(Succeed())
+	})
+
+	It("should report an invalid schedule", func() {
+		startReconciler(time.Now())
+
+		ctx := context.Background()
+
+		// Exercise
+		ss := &topolsv1.SnapshotSchedule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "ss-invalid",
+			},
+			Spec: topolsv1.SnapshotScheduleSpec{
+				Schedule: "* * *",
+			},
+		}
+		err := k8sClient.Create(ctx, ss)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Verify
+		Eventually(func(g Gomega) {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(ss), ss)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(ss.Status.Message).To(HavePrefix("invalid schedule"))
+			g.Expect(ss.Status.NextScheduleTime).To(BeNil())
+		}).Should(Succeed())
+	})
+
+	It("should prune snapshots expired by the retention", func() {
+		startReconciler(time.Now())
+
+		ctx := context.Background()
+
+		// Setup
+		_, lv := setupVolume(ctx, "-ss-prune")
+		ss := &topolsv1.SnapshotSchedule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "ss-prune",
+			},
+			Spec: topolsv1.SnapshotScheduleSpec{
+				Schedule:  "@yearly",
+				Selector:  metav1.LabelSelector{MatchLabels: map[string]string{"schedule": "-ss-prune"}},
+				Suspend:   true,
+				Retention: topolsv1.SnapshotRetention{Daily: 2},
+			},
+		}
+		err := k8sClient.Create(ctx, ss)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Exercise
+		base := time.Date(2024, 3, 16, 10, 0, 0, 0, time.UTC)
+		times := []time.Time{
+			base,
+			base.Add(-time.Hour),
+			base.Add(-24 * time.Hour),
+			base.Add(-25 * time.Hour),
+			base.Add(-48 * time.Hour),
+		}
+		for _, t := range times {
+			snap := newScheduledSnapshot(ss, &lv, t)
+			snap.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(ss, topolsv1.GroupVersion.WithKind("SnapshotSchedule"))}
+			err := k8sClient.Create(ctx, snap)
+			Expect(err).NotTo(HaveOccurred())
+			snap.Status.VolumeID = snap.Name
+			err = k8sClient.Status().Update(ctx, snap)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		// Verify
+		Eventually(func(g Gomega) {
+			var names []string
+			for _, snap := range listSnapshots(ctx, ss) {
+				names = append(names, snap.Name)
+			}
+			g.Expect(names).To(ConsistOf(
+				newScheduledSnapshot(ss, &lv, times[0]).Name,
+				newScheduledSnapshot(ss, &lv, times[2]).Name,
+			))
+		}).Should(Succeed())
+	})
+})
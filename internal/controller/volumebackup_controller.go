@@ -0,0 +1,308 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/go-logr/logr"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/internal/backup"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc/codes"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const backupCheckInterval = 10 * time.Second
+
+// VolumeBackupReconciler backs up volumes of the node. It creates the read-only snapshot of the volume
+// as LogicalVolume owned by VolumeBackup and uploads its stream to the backup target.
+type VolumeBackupReconciler struct {
+	client    client.Client
+	apiReader client.Reader
+	nodeName  string
+	lsmc      lsm.Client
+}
+
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=volumebackups,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=volumebackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=logicalvolumes,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=core,namespace=topols-system,resources=secrets,verbs=get
+
+// NewVolumeBackupReconciler returns VolumeBackupReconciler.
+// Secrets of S3 targets are read with apiReader, so the node does not cache them.
+func NewVolumeBackupReconciler(client client.Client, apiReader client.Reader, lsmc lsm.Client, nodeName string) *VolumeBackupReconciler {
+	return &VolumeBackupReconciler{
+		client:    client,
+		apiReader: apiReader,
+		nodeName:  nodeName,
+		lsmc:      lsmc,
+	}
+}
+
+// Reconcile takes the snapshot and uploads it on the node of the volume.
+func (r *VolumeBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := crlog.FromContext(ctx)
+
+	vb := new(topolsv1.VolumeBackup)
+	if err := r.client.Get(ctx, req.NamespacedName, vb); err != nil {
+		if !apierrs.IsNotFound(err) {
+			log.Error(err, "unable to fetch VolumeBackup")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// the snapshot is deleted by the garbage collector together with VolumeBackup
+	if vb.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+
+	switch vb.Status.Phase {
+	case topolsv1.BackupPending:
+		return r.start(ctx, log, vb)
+	case topolsv1.BackupSnapshotting:
+		if vb.Status.NodeName != r.nodeName {
+			return ctrl.Result{}, nil
+		}
+		if err := r.snapshot(ctx, log, vb); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: vb.Status.Phase == topolsv1.BackupRunning}, nil
+	case topolsv1.BackupRunning:
+		if vb.Status.NodeName != r.nodeName {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, r.upload(ctx, log, vb)
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *VolumeBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&topolsv1.VolumeBackup{}).
+		Owns(&topolsv1.LogicalVolume{}).
+		Complete(r)
+}
+
+func (r *VolumeBackupReconciler) start(ctx context.Context, log logr.Logger, vb *topolsv1.VolumeBackup) (ctrl.Result, error) {
+	lv := new(topolsv1.LogicalVolume)
+	err := r.client.Get(ctx, types.NamespacedName{Name: vb.Spec.LogicalVolume}, lv)
+	switch {
+	case apierrs.IsNotFound(err):
+		// any node can tell that the volume does not exist
+		return ctrl.Result{}, r.fail(ctx, log, vb, "LogicalVolume is not found")
+	case err != nil:
+		return ctrl.Result{}, err
+	case lv.Spec.NodeName != r.nodeName:
+		return ctrl.Result{}, nil
+	case lv.DeletionTimestamp != nil:
+		return ctrl.Result{}, r.fail(ctx, log, vb, "LogicalVolume is being deleted")
+	case lv.Status.VolumeID == "":
+		return ctrl.Result{}, r.fail(ctx, log, vb, "volume of LogicalVolume is not created")
+	case lv.Spec.AccessType == "ro":
+		return ctrl.Result{}, r.fail(ctx, log, vb, "snapshots can't be backed up")
+	}
+
+	if _, err := backup.NewTarget(ctx, r.apiReader, vb.Spec.Target); err != nil {
+		return ctrl.Result{}, r.fail(ctx, log, vb, err.Error())
+	}
+
+	if vb.Spec.Parent != "" {
+		parent, message, err := r.parent(ctx, vb)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if message != "" {
+			return ctrl.Result{}, r.fail(ctx, log, vb, message)
+		}
+		if parent.Status.Phase != topolsv1.BackupCompleted {
+			return ctrl.Result{RequeueAfter: backupCheckInterval}, nil
+		}
+	}
+
+	now := metav1.Now()
+	size := lv.Spec.Size.DeepCopy()
+	vb.Status.Phase = topolsv1.BackupSnapshotting
+	vb.Status.NodeName = r.nodeName
+	vb.Status.Snapshot = "backup-" + vb.Name
+	vb.Status.Key = backup.Key(lv.Name, vb.Name, streamCompression(vb))
+	vb.Status.DeviceClass = lv.Spec.DeviceClass
+	vb.Status.Size = &size
+	vb.Status.NoCow = lv.Spec.NoCow
+	vb.Status.Compression = lv.Spec.Compression
+	vb.Status.StartTime = &now
+	if err := r.updateStatus(ctx, log, vb); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	log.Info("started volume backup", "name", vb.Name, "logicalVolume", lv.Name, "parent", vb.Spec.Parent)
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// parent returns the parent backup, the message is set if it can't be the parent.
+func (r *VolumeBackupReconciler) parent(ctx context.Context, vb *topolsv1.VolumeBackup) (*topolsv1.VolumeBackup, string, error) {
+	parent := new(topolsv1.VolumeBackup)
+	err := r.client.Get(ctx, types.NamespacedName{Name: vb.Spec.Parent}, parent)
+	switch {
+	case apierrs.IsNotFound(err):
+		return nil, "parent VolumeBackup is not found", nil
+	case err != nil:
+		return nil, "", err
+	case parent.Spec.LogicalVolume != vb.Spec.LogicalVolume:
+		return nil, "parent VolumeBackup is a backup of another LogicalVolume", nil
+	case parent.Status.Phase == topolsv1.BackupFailed:
+		return nil, "parent VolumeBackup is failed", nil
+	case parent.Status.NodeName != "" && parent.Status.NodeName != r.nodeName:
+		return nil, "parent VolumeBackup is taken on another node", nil
+	}
+	return parent, "", nil
+}
+
+// snapshot creates the read-only snapshot and waits until its volume is created by LogicalVolumeReconciler.
+func (r *VolumeBackupReconciler) snapshot(ctx context.Context, log logr.Logger, vb *topolsv1.VolumeBackup) error {
+	snap := new(topolsv1.LogicalVolume)
+	err := r.client.Get(ctx, types.NamespacedName{Name: vb.Status.Snapshot}, snap)
+	if apierrs.IsNotFound(err) {
+		snap = &topolsv1.LogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: vb.Status.Snapshot},
+			Spec: topolsv1.LogicalVolumeSpec{
+				Name:        vb.Status.Snapshot,
+				NodeName:    r.nodeName,
+				Size:        *vb.Status.Size,
+				DeviceClass: vb.Status.DeviceClass,
+				Source:      vb.Spec.LogicalVolume,
+				AccessType:  "ro",
+			},
+		}
+		if err := controllerutil.SetControllerReference(vb, snap, r.client.Scheme()); err != nil {
+			return err
+		}
+		if err := r.client.Create(ctx, snap); err != nil {
+			log.Error(err, "failed to create snapshot LogicalVolume", "name", vb.Name, "snapshot", snap.Name)
+			return err
+		}
+		log.Info("created snapshot LogicalVolume", "name", vb.Name, "snapshot", snap.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(snap, vb) {
+		return r.fail(ctx, log, vb, "LogicalVolume "+snap.Name+" is not a snapshot of the backup")
+	}
+	if snap.Status.Code != codes.OK {
+		return r.fail(ctx, log, vb, "failed to create snapshot: "+snap.Status.Message)
+	}
+	if snap.Status.VolumeID == "" {
+		return nil
+	}
+
+	vb.Status.Phase = topolsv1.BackupRunning
+	return r.updateStatus(ctx, log, vb)
+}
+
+func (r *VolumeBackupReconciler) upload(ctx context.Context, log logr.Logger, vb *topolsv1.VolumeBackup) error {
+	volumeID, err := r.snapshotVolumeID(ctx, vb.Status.Snapshot)
+	if err != nil {
+		return err
+	}
+	if volumeID == "" {
+		return r.fail(ctx, log, vb, "snapshot LogicalVolume is deleted")
+	}
+
+	parentID := ""
+	if vb.Spec.Parent != "" {
+		parent, message, err := r.parent(ctx, vb)
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			return r.fail(ctx, log, vb, message)
+		}
+		if parentID, err = r.snapshotVolumeID(ctx, parent.Status.Snapshot); err != nil {
+			return err
+		}
+		if parentID == "" {
+			return r.fail(ctx, log, vb, "snapshot of parent VolumeBackup is deleted")
+		}
+	}
+
+	target, err := backup.NewTarget(ctx, r.apiReader, vb.Spec.Target)
+	if err != nil {
+		return r.fail(ctx, log, vb, err.Error())
+	}
+
+	checksum, n, err := backup.Upload(ctx, target, vb.Status.Key, streamCompression(vb), func(w io.Writer) error {
+		return r.lsmc.SendLV(ctx, volumeID, vb.Status.DeviceClass, parentID, w)
+	})
+	if err != nil {
+		log.Error(err, "failed to upload volume backup", "name", vb.Name, "key", vb.Status.Key)
+		vb.Status.Message = err.Error()
+		if err2 := r.client.Status().Update(ctx, vb); err2 != nil {
+			// err2 is logged but not returned because err is more important
+			log.Error(err2, "failed to update status", "name", vb.Name)
+		}
+		return err
+	}
+
+	now := metav1.Now()
+	vb.Status.Phase = topolsv1.BackupCompleted
+	vb.Status.Checksum = checksum
+	vb.Status.StoredBytes = n
+	vb.Status.Message = ""
+	vb.Status.CompletionTime = &now
+	if err := r.updateStatus(ctx, log, vb); err != nil {
+		return err
+	}
+
+	log.Info("completed volume backup", "name", vb.Name, "key", vb.Status.Key, "bytes", n)
+	return nil
+}
+
+// snapshotVolumeID returns the volume of the snapshot LogicalVolume, it is empty if the snapshot is deleted.
+func (r *VolumeBackupReconciler) snapshotVolumeID(ctx context.Context, name string) (string, error) {
+	snap := new(topolsv1.LogicalVolume)
+	err := r.client.Get(ctx, types.NamespacedName{Name: name}, snap)
+	if apierrs.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if snap.DeletionTimestamp != nil {
+		return "", nil
+	}
+	return snap.Status.VolumeID, nil
+}
+
+func (r *VolumeBackupReconciler) fail(ctx context.Context, log logr.Logger, vb *topolsv1.VolumeBackup, message string) error {
+	vb.Status.Phase = topolsv1.BackupFailed
+	vb.Status.Message = message
+	log.Info("volume backup failed", "name", vb.Name, "message", message)
+	return r.updateStatus(ctx, log, vb)
+}
+
+func (r *VolumeBackupReconciler) updateStatus(ctx context.Context, log logr.Logger, vb *topolsv1.VolumeBackup) error {
+	if err := r.client.Status().Update(ctx, vb); err != nil {
+		log.Error(err, "failed to update status", "name", vb.Name)
+		return err
+	}
+	return nil
+}
+
+// streamCompression returns the compression of the stored stream, it is gzip for objects created without defaults.
+func streamCompression(vb *topolsv1.VolumeBackup) string {
+	if vb.Spec.Compression == "" {
+		return topolsv1.BackupCompressionGzip
+	}
+	return vb.Spec.Compression
+}
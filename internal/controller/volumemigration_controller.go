@@ -0,0 +1,508 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/kvaster/topols"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	defaultMaxPasses     = 5
+	defaultSyncThreshold = 64 << 20
+	detachCheckInterval  = 10 * time.Second
+)
+
+// VolumeMigrationReconciler moves volumes between nodes. The target node copies the volume from
+// the source node and switches LogicalVolume and PersistentVolume to itself, the source node removes
+// the volume after that.
+type VolumeMigrationReconciler struct {
+	client    client.Client
+	apiReader client.Reader
+	nodeName  string
+	lsmc      lsm.Client
+	receiver  IncrementalReceiver
+}
+
+// IncrementalReceiver receives incremental passes of volumes from other nodes.
+type IncrementalReceiver interface {
+	ReceiveIncremental(ctx context.Context, nodeName, name, deviceClass string, pass int) (int64, error)
+}
+
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=volumemigrations,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=volumemigrations/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;create;delete;patch
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=list
+//+kubebuilder:rbac:groups=core,resources=pods/eviction,verbs=create
+
+// NewVolumeMigrationReconciler returns VolumeMigrationReconciler.
+// PersistentVolumes and pods are read with apiReader, so the node does not cache them.
+func NewVolumeMigrationReconciler(client client.Client, apiReader client.Reader, lsmc lsm.Client, nodeName string, receiver IncrementalReceiver) *VolumeMigrationReconciler {
+	return &VolumeMigrationReconciler{
+		client:    client,
+		apiReader: apiReader,
+		nodeName:  nodeName,
+		lsmc:      lsmc,
+		receiver:  receiver,
+	}
+}
+
+// Reconcile advances the migration on the target node and cleans up the source node.
+func (r *VolumeMigrationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := crlog.FromContext(ctx)
+
+	vm := new(topolsv1.VolumeMigration)
+	if err := r.client.Get(ctx, req.NamespacedName, vm); err != nil {
+		if !apierrs.IsNotFound(err) {
+			log.Error(err, "unable to fetch VolumeMigration")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	switch r.nodeName {
+	case vm.Spec.TargetNode:
+		return r.reconcileTarget(ctx, log, vm)
+	case vm.Status.SourceNode:
+		return ctrl.Result{}, r.reconcileSource(ctx, log, vm)
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *VolumeMigrationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&topolsv1.VolumeMigration{}).
+		Complete(r)
+}
+
+func (r *VolumeMigrationReconciler) reconcileSource(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) error {
+	switch vm.Status.Phase {
+	case topolsv1.MigrationCompleted:
+		if vm.Status.SourceRemoved {
+			return nil
+		}
+		err := r.lsmc.RemoveLV(ctx, vm.Status.VolumeID, vm.Status.DeviceClass)
+		if err != nil && !errors.Is(err, lsm.ErrNoVolume) {
+			log.Error(err, "failed to remove migrated volume", "name", vm.Name, "volumeID", vm.Status.VolumeID)
+			return err
+		}
+		if err := r.lsmc.RemoveLVIncremental(ctx, vm.Status.VolumeID, vm.Status.DeviceClass); err != nil {
+			log.Error(err, "failed to remove snapshots of migration", "name", vm.Name, "volumeID", vm.Status.VolumeID)
+			return err
+		}
+		vm.Status.SourceRemoved = true
+		if err := r.updateStatus(ctx, log, vm); err != nil {
+			return err
+		}
+		log.Info("removed migrated volume", "name", vm.Name, "volumeID", vm.Status.VolumeID)
+	case topolsv1.MigrationFailed:
+		if err := r.lsmc.RemoveLVIncremental(ctx, vm.Status.VolumeID, vm.Status.DeviceClass); err != nil {
+			log.Error(err, "failed to remove snapshots of migration", "name", vm.Name, "volumeID", vm.Status.VolumeID)
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *VolumeMigrationReconciler) reconcileTarget(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) (ctrl.Result, error) {
+	if vm.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+
+	switch vm.Status.Phase {
+	case topolsv1.MigrationPending:
+		if err := r.start(ctx, log, vm); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	case topolsv1.MigrationSyncing:
+		if err := r.sync(ctx, log, vm); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	case topolsv1.MigrationDetaching:
+		return r.detach(ctx, log, vm)
+	case topolsv1.MigrationSwitching:
+		return r.switchNode(ctx, log, vm)
+	case topolsv1.MigrationFailed:
+		if vm.Status.VolumeID == "" {
+			return ctrl.Result{}, nil
+		}
+		if err := r.lsmc.RemoveLVIncremental(ctx, vm.Status.VolumeID, vm.Status.DeviceClass); err != nil {
+			log.Error(err, "failed to remove snapshots of migration", "name", vm.Name, "volumeID", vm.Status.VolumeID)
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *VolumeMigrationReconciler) start(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) error {
+	lv := new(topolsv1.LogicalVolume)
+	err := r.client.Get(ctx, types.NamespacedName{Name: vm.Spec.LogicalVolume}, lv)
+	switch {
+	case apierrs.IsNotFound(err):
+		return r.fail(ctx, log, vm, "LogicalVolume is not found")
+	case err != nil:
+		return err
+	case lv.DeletionTimestamp != nil:
+		return r.fail(ctx, log, vm, "LogicalVolume is being deleted")
+	case lv.Spec.NodeName == r.nodeName:
+		return r.fail(ctx, log, vm, "LogicalVolume is already on the target node")
+	case lv.Status.VolumeID == "":
+		return r.fail(ctx, log, vm, "volume of LogicalVolume is not created")
+	case lv.Spec.AccessType == "ro":
+		return r.fail(ctx, log, vm, "snapshots can't be migrated")
+	case r.receiver == nil:
+		return r.fail(ctx, log, vm, "volume transfer is disabled on the target node")
+	}
+
+	now := metav1.Now()
+	vm.Status.Phase = topolsv1.MigrationSyncing
+	vm.Status.SourceNode = lv.Spec.NodeName
+	vm.Status.VolumeID = lv.Status.VolumeID
+	vm.Status.DeviceClass = lv.Spec.DeviceClass
+	vm.Status.StartTime = &now
+	if err := r.updateStatus(ctx, log, vm); err != nil {
+		return err
+	}
+
+	log.Info("started volume migration", "name", vm.Name, "volumeID", vm.Status.VolumeID, "sourceNode", vm.Status.SourceNode)
+	return nil
+}
+
+// sync does an incremental pass while the volume is in use, the final pass is done after pods are stopped.
+func (r *VolumeMigrationReconciler) sync(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) error {
+	if err := r.pass(ctx, log, vm); err != nil {
+		return err
+	}
+
+	threshold := int64(defaultSyncThreshold)
+	if vm.Spec.SyncThreshold != nil {
+		threshold = vm.Spec.SyncThreshold.Value()
+	}
+	maxPasses := vm.Spec.MaxPasses
+	if maxPasses == 0 {
+		maxPasses = defaultMaxPasses
+	}
+	if vm.Status.LastPassBytes < threshold || vm.Status.Passes >= maxPasses {
+		vm.Status.Phase = topolsv1.MigrationDetaching
+	}
+
+	return r.updateStatus(ctx, log, vm)
+}
+
+func (r *VolumeMigrationReconciler) pass(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) error {
+	n, err := r.receiver.ReceiveIncremental(ctx, vm.Status.SourceNode, vm.Status.VolumeID, vm.Status.DeviceClass, vm.Status.Passes)
+	if err != nil {
+		log.Error(err, "failed to receive volume pass", "name", vm.Name, "pass", vm.Status.Passes)
+		vm.Status.Message = err.Error()
+		if err2 := r.client.Status().Update(ctx, vm); err2 != nil {
+			// err2 is logged but not returned because err is more important
+			log.Error(err2, "failed to update status", "name", vm.Name)
+		}
+		return err
+	}
+
+	vm.Status.Passes++
+	vm.Status.LastPassBytes = n
+	vm.Status.Message = ""
+	log.Info("received volume pass", "name", vm.Name, "passes", vm.Status.Passes, "bytes", n)
+	return nil
+}
+
+// detach waits until no pod uses the volume and does the final pass.
+func (r *VolumeMigrationReconciler) detach(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) (ctrl.Result, error) {
+	waiting, err := r.waitForPods(ctx, log, vm)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if waiting {
+		return ctrl.Result{RequeueAfter: detachCheckInterval}, nil
+	}
+
+	if err := r.pass(ctx, log, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	vm.Status.Phase = topolsv1.MigrationSwitching
+	if err := r.updateStatus(ctx, log, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// switchNode creates the volume from the final pass and moves LogicalVolume and PersistentVolume to the target node.
+func (r *VolumeMigrationReconciler) switchNode(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) (ctrl.Result, error) {
+	lv := new(topolsv1.LogicalVolume)
+	if err := r.client.Get(ctx, types.NamespacedName{Name: vm.Spec.LogicalVolume}, lv); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, r.fail(ctx, log, vm, "LogicalVolume is deleted")
+		}
+		return ctrl.Result{}, err
+	}
+
+	if lv.Spec.NodeName != r.nodeName {
+		// a pod may be started on the source node after the final pass
+		waiting, err := r.waitForPods(ctx, log, vm)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if waiting {
+			vm.Status.Phase = topolsv1.MigrationDetaching
+			if err := r.updateStatus(ctx, log, vm); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: detachCheckInterval}, nil
+		}
+
+		_, err = r.lsmc.CompleteLVIncremental(ctx, vm.Status.VolumeID, vm.Status.DeviceClass, vm.Status.Passes-1,
+			volumeOptions(lv), uint64(lv.Spec.Size.Value()), volumeOwner(lv))
+		if err != nil && !errors.Is(err, lsm.ErrAlreadyExists) {
+			log.Error(err, "failed to create migrated volume", "name", vm.Name, "volumeID", vm.Status.VolumeID)
+			return ctrl.Result{}, err
+		}
+
+		lv2 := lv.DeepCopy()
+		lv2.Spec.NodeName = r.nodeName
+		if err := r.client.Patch(ctx, lv2, client.MergeFrom(lv)); err != nil {
+			log.Error(err, "failed to switch LogicalVolume", "name", vm.Name, "logicalVolume", lv.Name)
+			return ctrl.Result{}, err
+		}
+		log.Info("switched LogicalVolume", "name", vm.Name, "logicalVolume", lv.Name)
+	}
+
+	done, err := r.switchPersistentVolume(ctx, log, vm, lv.Spec.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !done {
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	now := metav1.Now()
+	vm.Status.Phase = topolsv1.MigrationCompleted
+	vm.Status.CompletionTime = &now
+	vm.Status.Message = ""
+	if err := r.updateStatus(ctx, log, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	log.Info("completed volume migration", "name", vm.Name, "volumeID", vm.Status.VolumeID, "passes", vm.Status.Passes)
+	return ctrl.Result{}, nil
+}
+
+// switchPersistentVolume recreates PersistentVolume with the node affinity of the target node because the affinity
+// is immutable. The PersistentVolume is saved in the annotation of VolumeMigration before it is deleted.
+// It returns true when the PersistentVolume is on the target node or there is no PersistentVolume.
+func (r *VolumeMigrationReconciler) switchPersistentVolume(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration, name string) (bool, error) {
+	pv := new(corev1.PersistentVolume)
+	err := r.apiReader.Get(ctx, types.NamespacedName{Name: name}, pv)
+	if apierrs.IsNotFound(err) {
+		saved, ok := vm.Annotations[topols.MigrationPersistentVolumeKey]
+		if !ok {
+			return true, nil
+		}
+		if err := json.Unmarshal([]byte(saved), pv); err != nil {
+			return false, err
+		}
+		newPV := migratedPersistentVolume(pv, r.nodeName)
+		if err := r.client.Create(ctx, newPV); err != nil {
+			log.Error(err, "failed to create PersistentVolume", "name", vm.Name, "persistentVolume", name)
+			return false, err
+		}
+		log.Info("recreated PersistentVolume on the target node", "name", vm.Name, "persistentVolume", name)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if persistentVolumeNode(pv) == r.nodeName {
+		return true, nil
+	}
+
+	if pv.DeletionTimestamp == nil {
+		if _, ok := vm.Annotations[topols.MigrationPersistentVolumeKey]; !ok {
+			b, err := json.Marshal(pv)
+			if err != nil {
+				return false, err
+			}
+			vm2 := vm.DeepCopy()
+			if vm2.Annotations == nil {
+				vm2.Annotations = map[string]string{}
+			}
+			vm2.Annotations[topols.MigrationPersistentVolumeKey] = string(b)
+			if err := r.client.Patch(ctx, vm2, client.MergeFrom(vm)); err != nil {
+				return false, err
+			}
+			vm.ObjectMeta = vm2.ObjectMeta
+		}
+
+		// the provisioner must not delete the volume with the PersistentVolume
+		if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+			pv2 := pv.DeepCopy()
+			pv2.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+			if err := r.client.Patch(ctx, pv2, client.MergeFrom(pv)); err != nil {
+				return false, err
+			}
+			pv = pv2
+		}
+
+		if err := r.client.Delete(ctx, pv); err != nil && !apierrs.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	// the PersistentVolume is protected while it is bound to PVC
+	if len(pv.Finalizers) > 0 {
+		pv2 := pv.DeepCopy()
+		pv2.Finalizers = nil
+		if err := r.client.Patch(ctx, pv2, client.MergeFrom(pv)); err != nil && !apierrs.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	log.Info("deleted PersistentVolume of the source node", "name", vm.Name, "persistentVolume", name)
+	return false, nil
+}
+
+// waitForPods returns true if pods using the volume are still running, they are evicted if the migration asks for it.
+func (r *VolumeMigrationReconciler) waitForPods(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) (bool, error) {
+	pods, err := r.podsUsingVolume(ctx, vm)
+	if err != nil {
+		return false, err
+	}
+	if len(pods) == 0 {
+		return false, nil
+	}
+
+	if vm.Spec.EvictPods {
+		for i := range pods {
+			pod := &pods[i]
+			eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}}
+			if err := r.client.SubResource("eviction").Create(ctx, pod, eviction); err != nil {
+				// i.e. eviction is not allowed by PodDisruptionBudget now, it is retried
+				log.Info("failed to evict pod", "name", vm.Name, "pod", client.ObjectKeyFromObject(pod), "error", err.Error())
+			}
+		}
+	}
+
+	message := fmt.Sprintf("waiting for %d pods using the volume to stop", len(pods))
+	if vm.Status.Message != message {
+		vm.Status.Message = message
+		if err := r.updateStatus(ctx, log, vm); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (r *VolumeMigrationReconciler) podsUsingVolume(ctx context.Context, vm *topolsv1.VolumeMigration) ([]corev1.Pod, error) {
+	lv := new(topolsv1.LogicalVolume)
+	if err := r.client.Get(ctx, types.NamespacedName{Name: vm.Spec.LogicalVolume}, lv); err != nil {
+		return nil, err
+	}
+	pv := new(corev1.PersistentVolume)
+	err := r.apiReader.Get(ctx, types.NamespacedName{Name: lv.Spec.Name}, pv)
+	if apierrs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	claim := pv.Spec.ClaimRef
+	if claim == nil {
+		return nil, nil
+	}
+
+	var pl corev1.PodList
+	if err := r.apiReader.List(ctx, &pl, client.InNamespace(claim.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var pods []corev1.Pod
+	for _, pod := range pl.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, v := range pod.Spec.Volumes {
+			if v.PersistentVolumeClaim != nil && v.PersistentVolumeClaim.ClaimName == claim.Name {
+				pods = append(pods, pod)
+				break
+			}
+		}
+	}
+	return pods, nil
+}
+
+func (r *VolumeMigrationReconciler) fail(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration, message string) error {
+	vm.Status.Phase = topolsv1.MigrationFailed
+	vm.Status.Message = message
+	log.Info("volume migration failed", "name", vm.Name, "message", message)
+	return r.updateStatus(ctx, log, vm)
+}
+
+func (r *VolumeMigrationReconciler) updateStatus(ctx context.Context, log logr.Logger, vm *topolsv1.VolumeMigration) error {
+	if err := r.client.Status().Update(ctx, vm); err != nil {
+		log.Error(err, "failed to update status", "name", vm.Name)
+		return err
+	}
+	return nil
+}
+
+// persistentVolumeNode returns the node of the topology key in the node affinity.
+func persistentVolumeNode(pv *corev1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == topols.TopologyNodeKey && len(expr.Values) == 1 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// migratedPersistentVolume returns a new PersistentVolume from the saved one with the node affinity of the node.
+// It keeps the claim reference, so the PVC stays bound.
+func migratedPersistentVolume(saved *corev1.PersistentVolume, nodeName string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        saved.Name,
+			Labels:      saved.Labels,
+			Annotations: saved.Annotations,
+		},
+		Spec: *saved.Spec.DeepCopy(),
+	}
+	if pv.Spec.ClaimRef != nil {
+		pv.Spec.ClaimRef.ResourceVersion = ""
+	}
+	pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      topols.TopologyNodeKey,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{nodeName},
+				}},
+			}},
+		},
+	}
+	return pv
+}
@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/internal/backup"
+	"github.com/kvaster/topols/internal/recovery"
+	"github.com/kvaster/topols/pkg/lsm"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// VolumeRestoreReconciler restores backups into new volumes of the node. Streams of the backup and its
+// parents are received as incremental passes, LogicalVolume and PersistentVolume are created as on recovery.
+type VolumeRestoreReconciler struct {
+	client    client.Client
+	apiReader client.Reader
+	nodeName  string
+	lsmc      lsm.Client
+}
+
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=volumerestores,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=volumerestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=logicalvolumes,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=topols.kvaster.com,resources=logicalvolumes/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=list;create
+
+// NewVolumeRestoreReconciler returns VolumeRestoreReconciler.
+// PersistentVolumes and secrets are read with apiReader, so the node does not cache them.
+func NewVolumeRestoreReconciler(client client.Client, apiReader client.Reader, lsmc lsm.Client, nodeName string) *VolumeRestoreReconciler {
+	return &VolumeRestoreReconciler{
+		client:    client,
+		apiReader: apiReader,
+		nodeName:  nodeName,
+		lsmc:      lsmc,
+	}
+}
+
+// Reconcile restores the backup on the node given in VolumeRestore.
+func (r *VolumeRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := crlog.FromContext(ctx)
+
+	vr := new(topolsv1.VolumeRestore)
+	if err := r.client.Get(ctx, req.NamespacedName, vr); err != nil {
+		if !apierrs.IsNotFound(err) {
+			log.Error(err, "unable to fetch VolumeRestore")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if vr.Spec.NodeName != r.nodeName || vr.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+
+	switch vr.Status.Phase {
+	case topolsv1.BackupPending:
+		if err := r.start(ctx, log, vr); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: vr.Status.Phase == topolsv1.BackupRunning}, nil
+	case topolsv1.BackupRunning:
+		return ctrl.Result{}, r.restore(ctx, log, vr)
+	case topolsv1.BackupFailed:
+		if vr.Status.VolumeID == "" {
+			return ctrl.Result{}, nil
+		}
+		if err := r.lsmc.RemoveLVIncremental(ctx, vr.Status.VolumeID, vr.Status.DeviceClass); err != nil {
+			log.Error(err, "failed to remove received snapshots", "name", vr.Name, "volumeID", vr.Status.VolumeID)
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *VolumeRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&topolsv1.VolumeRestore{}).
+		Complete(r)
+}
+
+func (r *VolumeRestoreReconciler) start(ctx context.Context, log logr.Logger, vr *topolsv1.VolumeRestore) error {
+	chain, message, err := r.backupChain(ctx, vr.Spec.Backup)
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		return r.fail(ctx, log, vr, message)
+	}
+
+	lv := new(topolsv1.LogicalVolume)
+	err = r.client.Get(ctx, types.NamespacedName{Name: vr.Spec.LogicalVolume}, lv)
+	if err == nil {
+		return r.fail(ctx, log, vr, "LogicalVolume already exists")
+	}
+	if !apierrs.IsNotFound(err) {
+		return err
+	}
+
+	now := metav1.Now()
+	vr.Status.Phase = topolsv1.BackupRunning
+	vr.Status.VolumeID = string(vr.UID)
+	vr.Status.DeviceClass = vr.Spec.DeviceClass
+	if vr.Status.DeviceClass == "" {
+		vr.Status.DeviceClass = chain[len(chain)-1].Status.DeviceClass
+	}
+	vr.Status.StartTime = &now
+	if err := r.updateStatus(ctx, log, vr); err != nil {
+		return err
+	}
+
+	log.Info("started volume restore", "name", vr.Name, "backup", vr.Spec.Backup, "volumeID", vr.Status.VolumeID)
+	return nil
+}
+
+// backupChain returns completed backups needed to restore the backup, the full backup is the first one.
+// The message is set if the backup can't be restored.
+func (r *VolumeRestoreReconciler) backupChain(ctx context.Context, name string) ([]*topolsv1.VolumeBackup, string, error) {
+	var chain []*topolsv1.VolumeBackup
+	seen := make(map[string]bool)
+	for name != "" {
+		if seen[name] {
+			return nil, "parents of VolumeBackup form a cycle", nil
+		}
+		seen[name] = true
+
+		vb := new(topolsv1.VolumeBackup)
+		err := r.client.Get(ctx, types.NamespacedName{Name: name}, vb)
+		if apierrs.IsNotFound(err) {
+			return nil, fmt.Sprintf("VolumeBackup %s is not found", name), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if vb.Status.Phase != topolsv1.BackupCompleted {
+			return nil, fmt.Sprintf("VolumeBackup %s is not completed", name), nil
+		}
+		chain = append([]*topolsv1.VolumeBackup{vb}, chain...)
+		name = vb.Spec.Parent
+	}
+	return chain, "", nil
+}
+
+func (r *VolumeRestoreReconciler) restore(ctx context.Context, log logr.Logger, vr *topolsv1.VolumeRestore) error {
+	chain, message, err := r.backupChain(ctx, vr.Spec.Backup)
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		return r.fail(ctx, log, vr, message)
+	}
+	dc := vr.Status.DeviceClass
+
+	v, err := r.receive(ctx, log, vr, chain, dc)
+	if errors.Is(err, backup.ErrChecksumMismatch) {
+		return r.fail(ctx, log, vr, err.Error())
+	}
+	if err != nil {
+		vr.Status.Message = err.Error()
+		if err2 := r.client.Status().Update(ctx, vr); err2 != nil {
+			// err2 is logged but not returned because err is more important
+			log.Error(err2, "failed to update status", "name", vr.Name)
+		}
+		return err
+	}
+
+	var lvs topolsv1.LogicalVolumeList
+	if err := r.client.List(ctx, &lvs); err != nil {
+		return err
+	}
+	var pvs corev1.PersistentVolumeList
+	if vr.Spec.PersistentVolumeClaim != nil {
+		if err := r.apiReader.List(ctx, &pvs); err != nil {
+			return err
+		}
+	}
+
+	reclaimPolicy := vr.Spec.ReclaimPolicy
+	if reclaimPolicy == "" {
+		reclaimPolicy = corev1.PersistentVolumeReclaimDelete
+	}
+	plan := recovery.NewPlan(r.nodeName, []*lsm.LogicalVolume{v}, lvs.Items, pvs.Items, recovery.Options{
+		PersistentVolumes: vr.Spec.PersistentVolumeClaim != nil,
+		StorageClass:      vr.Spec.StorageClassName,
+		ReclaimPolicy:     reclaimPolicy,
+	})
+	if reason, ok := plan.Skipped[v.Name]; ok {
+		if err := r.lsmc.RemoveLV(ctx, v.Name, dc); err != nil && !errors.Is(err, lsm.ErrNoVolume) {
+			return err
+		}
+		return r.fail(ctx, log, vr, reason)
+	}
+	if err := plan.Apply(ctx, r.client); err != nil {
+		log.Error(err, "failed to create resources of restored volume", "name", vr.Name)
+		return err
+	}
+
+	now := metav1.Now()
+	vr.Status.Phase = topolsv1.BackupCompleted
+	vr.Status.Message = ""
+	vr.Status.CompletionTime = &now
+	if err := r.updateStatus(ctx, log, vr); err != nil {
+		return err
+	}
+
+	log.Info("completed volume restore", "name", vr.Name, "backup", vr.Spec.Backup, "volumeID", v.Name)
+	return nil
+}
+
+// receive downloads streams of the backups and creates the volume, the existing volume is returned
+// if it is already created.
+func (r *VolumeRestoreReconciler) receive(ctx context.Context, log logr.Logger, vr *topolsv1.VolumeRestore, chain []*topolsv1.VolumeBackup, dc string) (*lsm.LogicalVolume, error) {
+	volumes, err := r.lsmc.GetLVList(ctx, dc)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range volumes {
+		if v.Name == vr.Status.VolumeID {
+			return v, nil
+		}
+	}
+
+	for i, vb := range chain {
+		target, err := backup.NewTarget(ctx, r.apiReader, vb.Spec.Target)
+		if err != nil {
+			return nil, err
+		}
+		err = backup.Download(ctx, target, vb.Status.Key, streamCompression(vb), vb.Status.Checksum, func(rd io.Reader) error {
+			return r.lsmc.ReceiveLVIncremental(ctx, vr.Status.VolumeID, dc, i, rd)
+		})
+		if err != nil {
+			log.Error(err, "failed to receive volume backup", "name", vr.Name, "backup", vb.Name)
+			if err2 := r.lsmc.RemoveLVIncremental(ctx, vr.Status.VolumeID, dc); err2 != nil {
+				log.Error(err2, "failed to remove received snapshots", "name", vr.Name)
+			}
+			return nil, err
+		}
+		log.Info("received volume backup", "name", vr.Name, "backup", vb.Name)
+	}
+
+	last := chain[len(chain)-1]
+	opts := lsm.VolumeOptions{NoCow: last.Status.NoCow, Compression: last.Status.Compression}
+	owner := lsm.VolumeOwner{LogicalVolume: vr.Spec.LogicalVolume}
+	if pvc := vr.Spec.PersistentVolumeClaim; pvc != nil {
+		owner.PVCNamespace = pvc.Namespace
+		owner.PVCName = pvc.Name
+	}
+	return r.lsmc.CompleteLVIncremental(ctx, vr.Status.VolumeID, dc, len(chain)-1, opts, uint64(last.Status.Size.Value()), owner)
+}
+
+func (r *VolumeRestoreReconciler) fail(ctx context.Context, log logr.Logger, vr *topolsv1.VolumeRestore, message string) error {
+	vr.Status.Phase = topolsv1.BackupFailed
+	vr.Status.Message = message
+	log.Info("volume restore failed", "name", vr.Name, "message", message)
+	return r.updateStatus(ctx, log, vr)
+}
+
+func (r *VolumeRestoreReconciler) updateStatus(ctx context.Context, log logr.Logger, vr *topolsv1.VolumeRestore) error {
+	if err := r.client.Status().Update(ctx, vr); err != nil {
+		log.Error(err, "failed to update status", "name", vr.Name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// Saturday
+	base := time.Date(2024, 3, 16, 10, 17, 30, 0, time.UTC)
+
+	cases := []struct {
+		spec     string
+		from     time.Time
+		expected time.Time
+	}{
+		{spec: "* * * * *", from: base, expected: time.Date(2024, 3, 16, 10, 18, 0, 0, time.UTC)},
+		{spec: "@hourly", from: base, expected: time.Date(2024, 3, 16, 11, 0, 0, 0, time.UTC)},
+		{spec: "*/15 * * * *", from: base, expected: time.Date(2024, 3, 16, 10, 30, 0, 0, time.UTC)},
+		{spec: "5/20 * * * *", from: base, expected: time.Date(2024, 3, 16, 10, 25, 0, 0, time.UTC)},
+		{spec: "0 9-17 * * mon-fri", from: base, expected: time.Date(2024, 3, 18, 9, 0, 0, 0, time.UTC)},
+		{spec: "@daily", from: base, expected: time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 7", from: base, expected: time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{spec: "@monthly", from: base, expected: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 1 jan *", from: base, expected: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 12 29 feb *", from: base, expected: time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		// restricted day of month and day of week match either of them
+		{spec: "0 0 20 * 1", from: base, expected: time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)},
+		{spec: "17 10 * * *", from: base, expected: time.Date(2024, 3, 17, 10, 17, 0, 0, time.UTC)},
+		{spec: "0 0 31 2 *", from: base, expected: time.Time{}},
+	}
+
+	for _, tc := range cases {
+		s, err := Parse(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(tc.from); !got.Equal(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.spec, tc.expected, got)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every 1h",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%q should be invalid", spec)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/g0rbe/go-chattr"
+	"github.com/kvaster/topols/internal/loop"
+	"golang.org/x/sys/unix"
+	mountutil "k8s.io/mount-utils"
+)
+
+// blockFileName is the name of the file in the volume directory which backs the block volume.
+const blockFileName = "block"
+
+// blockFileReserve is the part of the volume limit, 1/blockFileReserve, which is left for metadata of the backing file.
+// Btrfs accounts extent items and tree blocks of the file to the volume, with random writes to a sparse file
+// they take up to 2% of the data.
+const blockFileReserve = 40
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+func blockFilePath(volumePath string) string {
+	return filepath.Join(volumePath, blockFileName)
+}
+
+// HasBlockFile returns true if the volume directory holds the backing file of a block volume.
+func HasBlockFile(volumePath string) (bool, error) {
+	_, err := os.Stat(blockFilePath(volumePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// blockFileSize returns the size of the backing file of a block volume with the size, the file is smaller
+// than the volume limit by the reserve for metadata, so the device can be filled without EDQUOT.
+// The size is aligned to 4KiB, the largest logical block size of loop devices.
+func blockFileSize(size uint64) uint64 {
+	return (size - size/blockFileReserve) &^ (4<<10 - 1)
+}
+
+// ensureBlockFile creates the sparse backing file of a block volume if it does not exist and grows it to size.
+// The file is created with nodatacow, so writes to the device do not fragment it.
+func ensureBlockFile(path string, size uint64) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return growBlockFile(path, size)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	// nodatacow can be set only while the file is empty, filesystems other than btrfs do not have it
+	if err := chattr.SetAttr(f, chattr.FS_NOCOW_FL); err != nil && !errors.Is(err, unix.EOPNOTSUPP) && !errors.Is(err, unix.ENOTTY) {
+		return fmt.Errorf("set nodatacow on %s: %w", path, err)
+	}
+
+	return f.Truncate(int64(size))
+}
+
+// growBlockFile grows the backing file of a block volume to size, the file is never shrunk.
+func growBlockFile(path string, size uint64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) >= size {
+		return nil
+	}
+	return os.Truncate(path, int64(size))
+}
+
+// loopDevice returns the loop device which the published block volume at path is bound to,
+// empty string if path is not a loop device.
+func loopDevice(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK || unix.Major(st.Rdev) != loop.Major {
+		return "", nil
+	}
+	return fmt.Sprintf("/dev/loop%d", unix.Minor(st.Rdev)), nil
+}
+
+// loopDeviceMounted reports whether the loop device is still bound to a target path of a published volume.
+// Bind mounts of device nodes have the path of the node in devtmpfs as their root.
+func loopDeviceMounted(device string) (bool, error) {
+	mounts, err := mountutil.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return false, err
+	}
+	root := "/" + filepath.Base(device)
+	for _, m := range mounts {
+		if m.Root == root {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// publishedTargets returns target paths where the volume at volumePath is published on the node.
+// Block volumes are bind mounts of the loop devices of the backing file. Filesystem volumes are bind mounts
+// of the volume directory, they are found by its path in the filesystem and confirmed by the device and the inode,
+// so a directory with the same name in another filesystem does not match.
+func publishedTargets(volumePath string, block bool) ([]string, error) {
+	mounts, err := mountutil.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+	if block {
+		devices, err := loop.Devices(blockFilePath(volumePath))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, device := range devices {
+			root := "/" + filepath.Base(device)
+			for _, m := range mounts {
+				if m.Root == root {
+					targets = append(targets, m.MountPoint)
+				}
+			}
+		}
+		return targets, nil
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(volumePath, &st); err != nil {
+		return nil, err
+	}
+	suffix := "/" + filepath.Base(volumePath)
+	for _, m := range mounts {
+		if !strings.HasSuffix(m.Root, suffix) {
+			continue
+		}
+		var mst unix.Stat_t
+		if err := unix.Stat(m.MountPoint, &mst); err != nil {
+			continue
+		}
+		if mst.Dev == st.Dev && mst.Ino == st.Ino {
+			targets = append(targets, m.MountPoint)
+		}
+	}
+	return targets, nil
+}
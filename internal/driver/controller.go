@@ -4,17 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/kvaster/topols"
 	v1 "github.com/kvaster/topols/api/v1"
 	"github.com/kvaster/topols/internal/driver/internal/k8s"
+	"github.com/kvaster/topols/internal/lock"
+	"github.com/kvaster/topols/pkg/lsm"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
@@ -29,8 +35,8 @@ func NewControllerServer(mgr manager.Manager) (csi.ControllerServer, error) {
 	}
 
 	return &controllerServer{
-		lockByName:     NewLockWithID(),
-		lockByVolumeID: NewLockWithID(),
+		lockByName:     lock.NewLockWithID(),
+		lockByVolumeID: lock.NewLockWithID(),
 		server: &controllerServerNoLocked{
 			lvService:   lvService,
 			nodeService: k8s.NewNodeService(mgr.GetClient()),
@@ -42,9 +48,9 @@ type controllerServer struct {
 	csi.UnimplementedControllerServer
 
 	// This protects server methods using a volume name.
-	lockByName *LockByID
+	lockByName *lock.LockByID
 	// This protects server methods using a volume id.
-	lockByVolumeID *LockByID
+	lockByVolumeID *lock.LockByID
 	server         *controllerServerNoLocked
 }
 
@@ -94,6 +100,12 @@ func (s *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSn
 	return s.server.DeleteSnapshot(ctx, req)
 }
 
+func (s *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	// Snapshots are listed from the cache like volumes.
+	// Therefore, it is unnecessary to take lock.
+	return s.server.ListSnapshots(ctx, req)
+}
+
 func (s *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	s.lockByVolumeID.LockByID(req.GetVolumeId())
 	defer s.lockByVolumeID.UnlockByID(req.GetVolumeId())
@@ -101,6 +113,26 @@ func (s *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 	return s.server.ControllerExpandVolume(ctx, req)
 }
 
+func (s *controllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	s.lockByVolumeID.LockByID(req.GetVolumeId())
+	defer s.lockByVolumeID.UnlockByID(req.GetVolumeId())
+
+	return s.server.ControllerModifyVolume(ctx, req)
+}
+
+func (s *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	// Volumes are listed from the cache, a listing is a snapshot of the state anyway.
+	// Therefore, it is unnecessary to take lock.
+	return s.server.ListVolumes(ctx, req)
+}
+
+func (s *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	s.lockByVolumeID.LockByID(req.GetVolumeId())
+	defer s.lockByVolumeID.UnlockByID(req.GetVolumeId())
+
+	return s.server.ControllerGetVolume(ctx, req)
+}
+
 // controllerServerNoLocked implements csi.ControllerServer.
 // It does not take any lock, gRPC calls may be interleaved.
 // Therefore, must not use it directly.
@@ -115,15 +147,32 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 	capabilities := req.GetVolumeCapabilities()
 	source := req.GetVolumeContentSource()
 	deviceClass := req.GetParameters()[topols.DeviceClassKey]
-	noCow, _ := strconv.ParseBool(req.GetParameters()[topols.NoCowKey])
+
+	mutableParams := req.GetMutableParameters()
+	if err := checkMutableParameters(mutableParams); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// mutable parameters of a VolumeAttributesClass take precedence over parameters of the StorageClass
+	params := mergeParameters(req.GetParameters(), mutableParams)
+
+	opts, err := volumeOptions(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mode, err := quotaMode(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	ctrlLogger.Info("CreateVolume called",
 		"name", req.GetName(),
 		"device_class", deviceClass,
-		"no_cow", noCow,
+		"options", opts,
 		"required", req.GetCapacityRange().GetRequiredBytes(),
 		"limit", req.GetCapacityRange().GetLimitBytes(),
 		"parameters", req.GetParameters(),
+		"mutable_parameters", mutableParams,
+		"quota_mode", mode,
 		"num_secrets", len(req.GetSecrets()),
 		"capabilities", capabilities,
 		"content_source", source,
@@ -133,7 +182,6 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 		// sourceID   string
 		sourceName string
 		sourceVol  *v1.LogicalVolume
-		err        error
 	)
 
 	if capabilities == nil {
@@ -156,10 +204,7 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 		if mode := capability.GetAccessMode(); mode != nil {
 			modeName := csi.VolumeCapability_AccessMode_Mode_name[int32(mode.GetMode())]
 			ctrlLogger.Info("CreateVolume specifies volume capability", "access_mode", modeName)
-			// we only support SINGLE_NODE_WRITER
-			switch mode.GetMode() {
-			case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
-			default:
+			if !accessModeSupported(mode.GetMode(), source != nil) {
 				return nil, status.Errorf(codes.InvalidArgument, "unsupported access mode: %s", modeName)
 			}
 		}
@@ -177,8 +222,7 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 		if err != nil {
 			return nil, err
 		}
-		// check if the volume has the same size as the source volume.
-		// TODO (Yuggupta27): Allow user to create a volume with more size than that of the source volume.
+		// the volume may be larger than the source, the limit of the volume is set to the requested size
 		sourceSizeBytes := sourceVol.Spec.Size.Value()
 		if requestBytes < sourceSizeBytes {
 			return nil, status.Error(codes.OutOfRange, "requested size is smaller than the size of the source")
@@ -189,7 +233,11 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 			return nil, status.Error(codes.InvalidArgument, "device class mismatch. Snapshots should be created with the same device class as the source.")
 		}
 		deviceClass = sourceVol.Spec.DeviceClass
-		noCow = sourceVol.Spec.NoCow
+		// snapshots and clones keep filesystem options of the source unless mutable parameters change them
+		opts, err = updateVolumeOptions(lsm.VolumeOptions{NoCow: sourceVol.Spec.NoCow, Compression: sourceVol.Spec.Compression}, mutableParams)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 		sourceName = sourceVol.Spec.Name
 	}
 
@@ -208,22 +256,12 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 			node = sourceVol.Spec.NodeName
 		} else {
 			sourceNode := sourceVol.Spec.NodeName
-			for _, topo := range requirements.Preferred {
-				if v, ok := topo.GetSegments()[topols.TopologyNodeKey]; ok {
-					if v == sourceNode {
-						node = v
-						break
-					}
-				}
-			}
-			if node == "" {
-				for _, topo := range requirements.Requisite {
-					if v, ok := topo.GetSegments()[topols.TopologyNodeKey]; ok {
-						if v == sourceNode {
-							node = v
-							break
-						}
-					}
+			node = findNode(requirements, func(v string) bool { return v == sourceNode })
+			if node == "" && sourceVol.Spec.AccessType == "ro" {
+				// read-only snapshots may be received from the source node by another node
+				node, err = s.findTransferNode(ctx, requirements, sourceNode)
+				if err != nil {
+					return nil, err
 				}
 			}
 			if node == "" {
@@ -250,20 +288,7 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 			}
 			node = nodeName
 		} else {
-			for _, topo := range requirements.Preferred {
-				if v, ok := topo.GetSegments()[topols.TopologyNodeKey]; ok {
-					node = v
-					break
-				}
-			}
-			if node == "" {
-				for _, topo := range requirements.Requisite {
-					if v, ok := topo.GetSegments()[topols.TopologyNodeKey]; ok {
-						node = v
-						break
-					}
-				}
-			}
+			node = findNode(requirements, func(string) bool { return true })
 			if node == "" {
 				return nil, status.Errorf(codes.InvalidArgument, "cannot find key '%s' in accessibility_requirements", topols.TopologyNodeKey)
 			}
@@ -277,7 +302,8 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 
 	name = strings.ToLower(name)
 
-	volumeID, err := s.lvService.CreateVolume(ctx, node, deviceClass, noCow, name, sourceName, requestBytes)
+	pvc := types.NamespacedName{Namespace: req.GetParameters()[topols.PVCNamespaceKey], Name: req.GetParameters()[topols.PVCNameKey]}
+	volumeID, err := s.lvService.CreateVolume(ctx, node, deviceClass, opts, mode, name, sourceName, pvc, requestBytes)
 	if err != nil {
 		_, ok := status.FromError(err)
 		if !ok {
@@ -300,6 +326,49 @@ func (s controllerServerNoLocked) CreateVolume(ctx context.Context, req *csi.Cre
 	}, nil
 }
 
+// findNode returns the first preferred node which matches, requisite nodes are checked if no preferred node matches.
+func findNode(requirements *csi.TopologyRequirement, match func(string) bool) string {
+	for _, topos := range [][]*csi.Topology{requirements.GetPreferred(), requirements.GetRequisite()} {
+		for _, topo := range topos {
+			if v, ok := topo.GetSegments()[topols.TopologyNodeKey]; ok && match(v) {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// findTransferNode returns the node to receive the snapshot from the source node,
+// it is empty if the source node or all nodes in requirements do not run the transfer service.
+func (s controllerServerNoLocked) findTransferNode(ctx context.Context, requirements *csi.TopologyRequirement, sourceNode string) (string, error) {
+	enabled, err := s.nodeService.TransferEnabled(ctx, sourceNode)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if !enabled {
+		return "", nil
+	}
+
+	var lastErr error
+	node := findNode(requirements, func(v string) bool {
+		ok, err := s.nodeService.TransferEnabled(ctx, v)
+		if err != nil && !apierrors.IsNotFound(err) {
+			lastErr = err
+		}
+		return ok
+	})
+	if node == "" && lastErr != nil {
+		return "", status.Error(codes.Internal, lastErr.Error())
+	}
+	if node != "" {
+		ctrlLogger.Info("snapshot will be transferred to another node", "source_node", sourceNode, "node", node)
+	}
+	return node, nil
+}
+
 // validateContentSource checks if the request has a data source and returns source volume information.
 func (s controllerServerNoLocked) validateContentSource(ctx context.Context, req *csi.CreateVolumeRequest) (*v1.LogicalVolume, string, error) {
 	volumeSource := req.VolumeContentSource
@@ -338,6 +407,28 @@ func (s controllerServerNoLocked) validateContentSource(ctx context.Context, req
 	return nil, "", status.Errorf(codes.InvalidArgument, "invalid volume source %v", volumeSource)
 }
 
+// accessModeSupported reports whether a volume can be published with the access mode.
+// Reader-only modes make sense only for volumes restored from snapshots or cloned from other volumes,
+// an empty volume which cannot be written is useless. Volumes are local, so MULTI_NODE_READER_ONLY
+// volumes are still published on a single node, all readers are scheduled to the node by the topology.
+func accessModeSupported(mode csi.VolumeCapability_AccessMode_Mode, hasSource bool) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return true
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return hasSource
+	}
+	return false
+}
+
+func isReaderOnly(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
 // CreateSnapshot creates a logical volume snapshot.
 func (s controllerServerNoLocked) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	// Since the kubernetes snapshots are Read-Only, we set accessType as 'ro' to activate thin-snapshots as read-only volumes
@@ -366,16 +457,13 @@ func (s controllerServerNoLocked) CreateSnapshot(ctx context.Context, req *csi.C
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	snapTimeStamp := &timestamp.Timestamp{
-		Seconds: time.Now().Unix(),
-		Nanos:   0,
-	}
 	// the snapshots are required to be created in the same node and device class as the source volume.
 	node := sourceVol.Spec.NodeName
 	deviceClass := sourceVol.Spec.DeviceClass
 	size := sourceVol.Spec.Size
 	sourceVolName := sourceVol.Spec.Name
-	snapshotID, err := s.lvService.CreateSnapshot(ctx, node, deviceClass, sourceVolName, name, accessType, size)
+	opts := lsm.VolumeOptions{NoCow: sourceVol.Spec.NoCow, Compression: sourceVol.Spec.Compression}
+	snapshotID, err := s.lvService.CreateSnapshot(ctx, node, deviceClass, sourceVolName, name, accessType, opts, size)
 	if err != nil {
 		_, ok := status.FromError(err)
 		if !ok {
@@ -384,17 +472,88 @@ func (s controllerServerNoLocked) CreateSnapshot(ctx context.Context, req *csi.C
 		return nil, err
 	}
 
+	// retries of the request return the snapshot created by the first one with its creation time
+	snapshotVol, err := s.lvService.GetVolume(ctx, snapshotID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SnapshotId:     snapshotID,
-			SourceVolumeId: sourceVolID,
-			SizeBytes:      sourceVol.Spec.Size.Value(),
-			CreationTime:   snapTimeStamp,
-			ReadyToUse:     true,
-		},
+		Snapshot: snapshotOf(snapshotVol, sourceVolID),
 	}, nil
 }
 
+func (s controllerServerNoLocked) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	ctrlLogger.V(1).Info("ListSnapshots called",
+		"max_entries", req.GetMaxEntries(),
+		"starting_token", req.GetStartingToken(),
+		"source_volume_id", req.GetSourceVolumeId(),
+		"snapshot_id", req.GetSnapshotId())
+
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+
+	lvs, err := s.lvService.ListVolumes(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// sources are referenced by names of their LogicalVolumes
+	volumeIDs := make(map[string]string, len(lvs))
+	for _, lv := range lvs {
+		volumeIDs[lv.Name] = lv.Status.VolumeID
+	}
+
+	var snapshots []*v1.LogicalVolume
+	for i := range lvs {
+		lv := &lvs[i]
+		if lv.Status.VolumeID == "" || !isSnapshot(lv) {
+			continue
+		}
+		if req.GetSnapshotId() != "" && lv.Status.VolumeID != req.GetSnapshotId() {
+			continue
+		}
+		if req.GetSourceVolumeId() != "" && volumeIDs[lv.Spec.Source] != req.GetSourceVolumeId() {
+			continue
+		}
+		snapshots = append(snapshots, lv)
+	}
+
+	page, next, err := paginate(snapshots, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*csi.ListSnapshotsResponse_Entry, len(page))
+	for i, lv := range page {
+		entries[i] = &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshotOf(lv, volumeIDs[lv.Spec.Source]),
+		}
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: next,
+	}, nil
+}
+
+// snapshotOf returns the CSI snapshot of the snapshot LogicalVolume, the source volume ID is empty if the source is deleted.
+func snapshotOf(lv *v1.LogicalVolume, sourceVolumeID string) *csi.Snapshot {
+	// snapshots created before the creation time was recorded have the time of their LogicalVolume
+	created := lv.CreationTimestamp.Time
+	if lv.Status.CreationTime != nil {
+		created = lv.Status.CreationTime.Time
+	}
+
+	return &csi.Snapshot{
+		SnapshotId:     lv.Status.VolumeID,
+		SourceVolumeId: sourceVolumeID,
+		SizeBytes:      lv.Spec.Size.Value(),
+		CreationTime:   timestamppb.New(created),
+		ReadyToUse:     true,
+	}
+}
+
 // DeleteSnapshot deletes an existing logical volume snapshot.
 func (s controllerServerNoLocked) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	ctrlLogger.Info("DeleteSnapshot called",
@@ -417,6 +576,74 @@ func (s controllerServerNoLocked) DeleteSnapshot(ctx context.Context, req *csi.D
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// volumeOptions parses and validates filesystem options from StorageClass parameters.
+func volumeOptions(params map[string]string) (lsm.VolumeOptions, error) {
+	return updateVolumeOptions(lsm.VolumeOptions{}, params)
+}
+
+// updateVolumeOptions replaces options with the ones present in params and validates the result,
+// options which are not in params are kept.
+func updateVolumeOptions(opts lsm.VolumeOptions, params map[string]string) (lsm.VolumeOptions, error) {
+	var noCow, hasNoCow bool
+	for _, key := range []string{topols.NoCowKey, topols.NoDataCowKey} {
+		if v, ok := params[key]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s: %s", key, v)
+			}
+			noCow = noCow || b
+			hasNoCow = true
+		}
+	}
+	if hasNoCow {
+		opts.NoCow = noCow
+	}
+
+	// btrfs can't disable checksums separately, a parameter which does nothing is rejected
+	if _, ok := params[topols.NoDataSumKey]; ok {
+		return opts, fmt.Errorf("%s is not supported, %s disables data checksums too", topols.NoDataSumKey, topols.NoDataCowKey)
+	}
+
+	if v, ok := params[topols.CompressionKey]; ok {
+		opts.Compression = v
+	}
+
+	if err := opts.Validate(); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// quotaMode parses the volume limit mode from parameters, empty mode means the mode of the device class.
+func quotaMode(params map[string]string) (string, error) {
+	mode := params[topols.QuotaModeKey]
+	switch lsm.QuotaMode(mode) {
+	case "", lsm.QuotaReferenced, lsm.QuotaExclusive:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid %s: %s", topols.QuotaModeKey, mode)
+}
+
+// mutableParameters are the parameters which may be changed by ControllerModifyVolume.
+var mutableParameters = []string{topols.NoCowKey, topols.NoDataCowKey, topols.CompressionKey, topols.QuotaModeKey}
+
+func checkMutableParameters(params map[string]string) error {
+	for key := range params {
+		if !slices.Contains(mutableParameters, key) {
+			return fmt.Errorf("unsupported mutable parameter: %s", key)
+		}
+	}
+	return nil
+}
+
+func mergeParameters(params, mutableParams map[string]string) map[string]string {
+	merged := make(map[string]string, len(params)+len(mutableParams))
+	maps.Copy(merged, params)
+	maps.Copy(merged, mutableParams)
+	return merged
+}
+
 func convertRequestCapacity(requestBytes, limitBytes int64) (int64, error) {
 	if requestBytes < 0 {
 		return 0, errors.New("required capacity must not be negative")
@@ -473,7 +700,7 @@ func (s controllerServerNoLocked) ValidateVolumeCapabilities(ctx context.Context
 		return nil, status.Error(codes.InvalidArgument, "volume capabilities are empty")
 	}
 
-	_, err := s.lvService.GetVolume(ctx, req.GetVolumeId())
+	lv, err := s.lvService.GetVolume(ctx, req.GetVolumeId())
 	if err != nil {
 		if err == k8s.ErrVolumeNotFound {
 			return nil, status.Errorf(codes.NotFound, "LogicalVolume for volume id %s is not found", req.GetVolumeId())
@@ -481,6 +708,15 @@ func (s controllerServerNoLocked) ValidateVolumeCapabilities(ctx context.Context
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	for _, capability := range req.GetVolumeCapabilities() {
+		mode := capability.GetAccessMode().GetMode()
+		if !accessModeSupported(mode, lv.Spec.Source != "") {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("unsupported access mode: %s", mode),
+			}, nil
+		}
+	}
+
 	// Since TopoLS does not provide means to pre-provision volumes,
 	// any existing volume is valid.
 	return &csi.ValidateVolumeCapabilitiesResponse{
@@ -547,6 +783,12 @@ func (s controllerServerNoLocked) ControllerGetCapabilities(context.Context, *cs
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	}
 
 	csiCaps := make([]*csi.ControllerServiceCapability, len(capabilities))
@@ -565,6 +807,210 @@ func (s controllerServerNoLocked) ControllerGetCapabilities(context.Context, *cs
 	}, nil
 }
 
+func (s controllerServerNoLocked) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	params := req.GetMutableParameters()
+	ctrlLogger.Info("ControllerModifyVolume called",
+		"volumeID", volumeID,
+		"mutable_parameters", params,
+		"num_secrets", len(req.GetSecrets()))
+
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+	if len(params) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "mutable parameters are empty")
+	}
+	if err := checkMutableParameters(params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	lv, err := s.lvService.GetVolume(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, k8s.ErrVolumeNotFound) {
+			return nil, status.Errorf(codes.NotFound, "LogicalVolume for volume id %s is not found", volumeID)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if isSnapshot(lv) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is a snapshot, snapshots are read-only", volumeID)
+	}
+
+	opts, err := updateVolumeOptions(lsm.VolumeOptions{NoCow: lv.Spec.NoCow, Compression: lv.Spec.Compression}, params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mode := lv.Spec.QuotaMode
+	if _, ok := params[topols.QuotaModeKey]; ok {
+		mode, err = quotaMode(params)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	err = s.lvService.ModifyVolume(ctx, volumeID, opts, mode)
+	if err != nil {
+		_, ok := status.FromError(err)
+		if !ok {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return nil, err
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+func (s controllerServerNoLocked) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	ctrlLogger.V(1).Info("ListVolumes called",
+		"max_entries", req.GetMaxEntries(),
+		"starting_token", req.GetStartingToken())
+
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+
+	lvs, err := s.lvService.ListVolumes(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	var volumes []*v1.LogicalVolume
+	for i := range lvs {
+		lv := &lvs[i]
+		if lv.Status.VolumeID == "" || isSnapshot(lv) {
+			continue
+		}
+		volumes = append(volumes, lv)
+	}
+
+	page, next, err := paginate(volumes, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*csi.ListVolumesResponse_Entry, len(page))
+	for i, lv := range page {
+		condition, err := s.volumeCondition(ctx, lv)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = &csi.ListVolumesResponse_Entry{
+			Volume: volumeOf(lv),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: condition,
+			},
+		}
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: next,
+	}, nil
+}
+
+func (s controllerServerNoLocked) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	ctrlLogger.V(1).Info("ControllerGetVolume called", "volume_id", volumeID)
+
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is nil")
+	}
+
+	lv, err := s.lvService.GetVolume(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, k8s.ErrVolumeNotFound) {
+			return nil, status.Errorf(codes.NotFound, "LogicalVolume for volume id %s is not found", volumeID)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	condition, err := s.volumeCondition(ctx, lv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volumeOf(lv),
+		// published nodes are not reported, volumes are published by topols-node without ControllerPublishVolume
+		// and the node of a volume is in its accessible topology
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}, nil
+}
+
+// volumeCondition reports the volume abnormal if its node failed to reconcile the LogicalVolume,
+// or if the node reports the device class of the volume unhealthy or does not exist.
+func (s controllerServerNoLocked) volumeCondition(ctx context.Context, lv *v1.LogicalVolume) (*csi.VolumeCondition, error) {
+	if lv.Status.Code != codes.OK {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("LogicalVolume failed with %s: %s", lv.Status.Code, lv.Status.Message),
+		}, nil
+	}
+
+	reason, err := s.nodeService.UnhealthyReason(ctx, lv.Spec.NodeName, lv.Spec.DeviceClass)
+	if apierrors.IsNotFound(err) {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("node %s is not found", lv.Spec.NodeName),
+		}, nil
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if reason != "" {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("device class is unhealthy on node %s: %s", lv.Spec.NodeName, reason),
+		}, nil
+	}
+
+	return &csi.VolumeCondition{Message: "volume is healthy"}, nil
+}
+
+// volumeOf returns the CSI volume of the LogicalVolume.
+func volumeOf(lv *v1.LogicalVolume) *csi.Volume {
+	capacity := lv.Spec.Size.Value()
+	if lv.Status.CurrentSize != nil {
+		capacity = lv.Status.CurrentSize.Value()
+	}
+
+	return &csi.Volume{
+		CapacityBytes: capacity,
+		VolumeId:      lv.Status.VolumeID,
+		AccessibleTopology: []*csi.Topology{
+			{
+				Segments: map[string]string{topols.TopologyNodeKey: lv.Spec.NodeName},
+			},
+		},
+	}
+}
+
+// isSnapshot returns true if the LogicalVolume is a read-only snapshot, clones are volumes.
+func isSnapshot(lv *v1.LogicalVolume) bool {
+	return lv.Spec.Source != "" && lv.Spec.AccessType == "ro"
+}
+
+// paginate returns up to maxEntries LogicalVolumes starting from the one with the name startingToken,
+// and the name of the LogicalVolume after them as the next token. LogicalVolumes must be sorted by name.
+// All LogicalVolumes are returned if maxEntries is zero. The listing is aborted if the LogicalVolume
+// of the token does not exist anymore, as the CSI spec requires for tokens which can't be used.
+func paginate(lvs []*v1.LogicalVolume, startingToken string, maxEntries int32) ([]*v1.LogicalVolume, string, error) {
+	start := 0
+	if startingToken != "" {
+		var found bool
+		start, found = sort.Find(len(lvs), func(i int) int { return strings.Compare(startingToken, lvs[i].Name) })
+		if !found {
+			return nil, "", status.Errorf(codes.Aborted, "invalid starting token: %s", startingToken)
+		}
+	}
+	lvs = lvs[start:]
+
+	if maxEntries == 0 || int(maxEntries) >= len(lvs) {
+		return lvs, "", nil
+	}
+	return lvs[:maxEntries], lvs[maxEntries].Name, nil
+}
+
 func (s controllerServerNoLocked) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	ctrlLogger.Info("ControllerExpandVolume called",
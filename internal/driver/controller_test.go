@@ -2,6 +2,16 @@ package driver
 
 import (
 	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kvaster/topols"
+	v1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestController(t *testing.T) {
@@ -52,3 +62,185 @@ func TestController(t *testing.T) {
 		t.Errorf("should be 2: %d", v)
 	}
 }
+
+func TestVolumeOptions(t *testing.T) {
+	opts, err := volumeOptions(map[string]string{topols.NoDataCowKey: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.NoCow {
+		t.Errorf("nodatacow should be set: %+v", opts)
+	}
+
+	_, err = volumeOptions(map[string]string{topols.NoDataCowKey: "true", topols.NoDataSumKey: "true"})
+	if err == nil {
+		t.Error("nodatasum should be rejected")
+	}
+
+	opts, err = volumeOptions(map[string]string{topols.CompressionKey: "zstd:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Compression != "zstd:3" {
+		t.Errorf("compression should be zstd:3: %s", opts.Compression)
+	}
+
+	_, err = volumeOptions(map[string]string{topols.NoCowKey: "yes please"})
+	if err == nil {
+		t.Error("should be error")
+	}
+
+	_, err = volumeOptions(map[string]string{topols.NoCowKey: "true", topols.CompressionKey: "zstd"})
+	if err == nil {
+		t.Error("should be error")
+	}
+
+	// options which are not in parameters are kept
+	opts, err = updateVolumeOptions(lsm.VolumeOptions{NoCow: true}, map[string]string{topols.QuotaModeKey: "exclusive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.NoCow {
+		t.Errorf("nodatacow should be kept: %+v", opts)
+	}
+
+	opts, err = updateVolumeOptions(lsm.VolumeOptions{Compression: "zstd"}, map[string]string{topols.CompressionKey: "", topols.NoCowKey: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.NoCow || opts.Compression != "" {
+		t.Errorf("compression should be replaced with nodatacow: %+v", opts)
+	}
+
+	_, err = updateVolumeOptions(lsm.VolumeOptions{Compression: "zstd"}, map[string]string{topols.NoCowKey: "true"})
+	if err == nil {
+		t.Error("should be error")
+	}
+}
+
+func TestMutableParameters(t *testing.T) {
+	if err := checkMutableParameters(map[string]string{topols.CompressionKey: "zstd", topols.QuotaModeKey: "exclusive"}); err != nil {
+		t.Error(err)
+	}
+	if err := checkMutableParameters(map[string]string{topols.DeviceClassKey: "ssd"}); err == nil {
+		t.Error("device class should not be mutable")
+	}
+
+	params := mergeParameters(map[string]string{topols.CompressionKey: "zlib", topols.DeviceClassKey: "ssd"}, map[string]string{topols.CompressionKey: "zstd"})
+	if params[topols.CompressionKey] != "zstd" || params[topols.DeviceClassKey] != "ssd" {
+		t.Errorf("mutable parameters should take precedence: %v", params)
+	}
+
+	for _, mode := range []string{"", "referenced", "exclusive"} {
+		if m, err := quotaMode(map[string]string{topols.QuotaModeKey: mode}); err != nil || m != mode {
+			t.Errorf("quota mode %q should be valid: %q, %v", mode, m, err)
+		}
+	}
+	if _, err := quotaMode(map[string]string{topols.QuotaModeKey: "shared"}); err == nil {
+		t.Error("should be error")
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	var lvs []*v1.LogicalVolume
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		lvs = append(lvs, &v1.LogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	names := func(lvs []*v1.LogicalVolume) string {
+		var s string
+		for _, lv := range lvs {
+			s += lv.Name
+		}
+		return s
+	}
+
+	cases := []struct {
+		token      string
+		maxEntries int32
+		expected   string
+		next       string
+		err        bool
+	}{
+		{token: "", maxEntries: 0, expected: "abcde", next: ""},
+		{token: "", maxEntries: 2, expected: "ab", next: "c"},
+		{token: "c", maxEntries: 2, expected: "cd", next: "e"},
+		{token: "e", maxEntries: 2, expected: "e", next: ""},
+		{token: "c", maxEntries: 3, expected: "cde", next: ""},
+		// the volume of the token may be deleted between calls
+		{token: "bb", maxEntries: 1, err: true},
+		{token: "f", maxEntries: 1, err: true},
+	}
+	for _, tc := range cases {
+		page, next, err := paginate(lvs, tc.token, tc.maxEntries)
+		if tc.err {
+			if status.Code(err) != codes.Aborted {
+				t.Errorf("%q/%d: listing should be aborted: %v", tc.token, tc.maxEntries, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q/%d: unexpected error: %v", tc.token, tc.maxEntries, err)
+		}
+		if names(page) != tc.expected || next != tc.next {
+			t.Errorf("%q/%d: expected %q and next %q, got %q and next %q", tc.token, tc.maxEntries, tc.expected, tc.next, names(page), next)
+		}
+	}
+}
+
+func TestSnapshotOf(t *testing.T) {
+	created := time.Date(2024, 3, 16, 10, 0, 0, 0, time.UTC)
+	lv := &v1.LogicalVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "snap",
+			CreationTimestamp: metav1.NewTime(created.Add(time.Hour)),
+		},
+		Spec: v1.LogicalVolumeSpec{
+			Size:       *resource.NewQuantity(1<<30, resource.BinarySI),
+			Source:     "vol",
+			AccessType: "ro",
+		},
+		Status: v1.LogicalVolumeStatus{
+			VolumeID: "snap-id",
+		},
+	}
+
+	// the time of the LogicalVolume is used if the creation time is not recorded
+	snap := snapshotOf(lv, "vol-id")
+	if !snap.GetCreationTime().AsTime().Equal(created.Add(time.Hour)) {
+		t.Errorf("creation time should be the time of LogicalVolume: %v", snap.GetCreationTime().AsTime())
+	}
+
+	ct := metav1.NewTime(created)
+	lv.Status.CreationTime = &ct
+	snap = snapshotOf(lv, "vol-id")
+	if snap.GetSnapshotId() != "snap-id" || snap.GetSourceVolumeId() != "vol-id" || snap.GetSizeBytes() != 1<<30 || !snap.GetReadyToUse() {
+		t.Errorf("unexpected snapshot: %v", snap)
+	}
+	if !snap.GetCreationTime().AsTime().Equal(created) {
+		t.Errorf("creation time should be %v: %v", created, snap.GetCreationTime().AsTime())
+	}
+}
+
+func TestAccessModeSupported(t *testing.T) {
+	cases := []struct {
+		mode      csi.VolumeCapability_AccessMode_Mode
+		hasSource bool
+		expected  bool
+	}{
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false, true},
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, false, true},
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER, false, true},
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, false, false},
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, true, true},
+		{csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, false, false},
+		{csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, true, true},
+		{csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, true, false},
+		{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, true, false},
+		{csi.VolumeCapability_AccessMode_UNKNOWN, false, false},
+	}
+	for _, c := range cases {
+		if actual := accessModeSupported(c.mode, c.hasSource); actual != c.expected {
+			t.Errorf("accessModeSupported(%s, %v) = %v, expected %v", c.mode, c.hasSource, actual, c.expected)
+		}
+	}
+}
@@ -4,17 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/kvaster/topols"
 	topolsv1 "github.com/kvaster/topols/api/v1"
 	clientwrapper "github.com/kvaster/topols/internal/client"
 	"github.com/kvaster/topols/internal/getter"
+	"github.com/kvaster/topols/pkg/lsm"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -117,6 +120,17 @@ func (v *volumeGetter) Get(ctx context.Context, volumeID string) (*topolsv1.Logi
 	return foundLv, nil
 }
 
+// List returns all LogicalVolumes sorted by name from the cache.
+// Volumes created just before may be missing, this is acceptable for listing.
+func (v *volumeGetter) List(ctx context.Context) ([]topolsv1.LogicalVolume, error) {
+	lvList := new(topolsv1.LogicalVolumeList)
+	if err := v.cacheReader.List(ctx, lvList); err != nil {
+		return nil, err
+	}
+	sort.Slice(lvList.Items, func(i, j int) bool { return lvList.Items[i].Name < lvList.Items[j].Name })
+	return lvList.Items, nil
+}
+
 //+kubebuilder:rbac:groups=topols.kvaster.com,resources=logicalvolumes,verbs=get;list;watch;create;delete
 //+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
 
@@ -140,9 +154,9 @@ func NewLogicalVolumeService(mgr manager.Manager) (*LogicalVolumeService, error)
 	}, nil
 }
 
-// CreateVolume creates volume
-func (s *LogicalVolumeService) CreateVolume(ctx context.Context, node, dc string, noCow bool, name, sourceName string, requestBytes int64) (string, error) {
-	logger.Info("k8s.CreateVolume called", "name", name, "node", node, "size", requestBytes, "sourceName", sourceName)
+// CreateVolume creates volume, pvc is recorded in LogicalVolume annotations if it is known.
+func (s *LogicalVolumeService) CreateVolume(ctx context.Context, node, dc string, opts lsm.VolumeOptions, quotaMode, name, sourceName string, pvc types.NamespacedName, requestBytes int64) (string, error) {
+	logger.Info("k8s.CreateVolume called", "name", name, "node", node, "size", requestBytes, "sourceName", sourceName, "quotaMode", quotaMode)
 
 	var lv *topolsv1.LogicalVolume
 	// if the create volume request has no source, proceed with regular lv creation.
@@ -155,7 +169,9 @@ func (s *LogicalVolumeService) CreateVolume(ctx context.Context, node, dc string
 				Name:        name,
 				NodeName:    node,
 				DeviceClass: dc,
-				NoCow:       noCow,
+				NoCow:       opts.NoCow,
+				Compression: opts.Compression,
+				QuotaMode:   quotaMode,
 				Size:        *resource.NewQuantity(requestBytes, resource.BinarySI),
 			},
 		}
@@ -168,7 +184,9 @@ func (s *LogicalVolumeService) CreateVolume(ctx context.Context, node, dc string
 				Name:        name,
 				NodeName:    node,
 				DeviceClass: dc,
-				NoCow:       noCow,
+				NoCow:       opts.NoCow,
+				Compression: opts.Compression,
+				QuotaMode:   quotaMode,
 				Size:        *resource.NewQuantity(requestBytes, resource.BinarySI),
 				Source:      sourceName,
 				AccessType:  "rw",
@@ -176,6 +194,13 @@ func (s *LogicalVolumeService) CreateVolume(ctx context.Context, node, dc string
 		}
 	}
 
+	if pvc.Name != "" {
+		lv.Annotations = map[string]string{
+			topols.PVCNamespaceKey: pvc.Namespace,
+			topols.PVCNameKey:      pvc.Name,
+		}
+	}
+
 	existingLV := new(topolsv1.LogicalVolume)
 	err := s.getter.Get(ctx, client.ObjectKey{Name: name}, existingLV)
 	if err != nil {
@@ -190,8 +215,9 @@ func (s *LogicalVolumeService) CreateVolume(ctx context.Context, node, dc string
 		logger.Info("created LogicalVolume CR", "name", name, "sourceID", lv.Spec.Source)
 	} else {
 		// LV with same name was found; check compatibility
-		// skip check of capabilities because (1) we allow both of two access types, and (2) we allow only one access mode
-		// for ease of comparison, sizes are compared strictly, not by compatibility of ranges
+		// skip check of capabilities because (1) we allow both of two access types, and (2) access modes are enforced on publish
+		// for ease of comparison, sizes are compared strictly, not by compatibility of ranges,
+		// so a retried clone or restore into a volume larger than the source is compatible only with the same size
 		if !existingLV.IsCompatibleWith(lv) {
 			return "", status.Error(codes.AlreadyExists, "Incompatible LogicalVolume already exists")
 		}
@@ -248,7 +274,7 @@ func (s *LogicalVolumeService) DeleteVolume(ctx context.Context, volumeID string
 }
 
 // CreateSnapshot creates a snapshot of existing volume.
-func (s *LogicalVolumeService) CreateSnapshot(ctx context.Context, node, dc, sourceVol, sname, accessType string, snapSize resource.Quantity) (string, error) {
+func (s *LogicalVolumeService) CreateSnapshot(ctx context.Context, node, dc, sourceVol, sname, accessType string, opts lsm.VolumeOptions, snapSize resource.Quantity) (string, error) {
 	logger.Info("CreateSnapshot called", "name", sname)
 	snapshotLV := &topolsv1.LogicalVolume{
 		ObjectMeta: metav1.ObjectMeta{
@@ -258,6 +284,8 @@ func (s *LogicalVolumeService) CreateSnapshot(ctx context.Context, node, dc, sou
 			Name:        sname,
 			NodeName:    node,
 			DeviceClass: dc,
+			NoCow:       opts.NoCow,
+			Compression: opts.Compression,
 			Size:        snapSize,
 			Source:      sourceVol,
 			AccessType:  accessType,
@@ -335,11 +363,74 @@ func (s *LogicalVolumeService) ExpandVolume(ctx context.Context, volumeID string
 	}
 }
 
+// ModifyVolume changes options and the quota mode of the volume and waits until topols-node applies them.
+func (s *LogicalVolumeService) ModifyVolume(ctx context.Context, volumeID string, opts lsm.VolumeOptions, quotaMode string) error {
+	logger.Info("k8s.ModifyVolume called", "volumeID", volumeID, "options", opts, "quotaMode", quotaMode)
+
+	var lv *topolsv1.LogicalVolume
+	for {
+		var err error
+		lv, err = s.GetVolume(ctx, volumeID)
+		if err != nil {
+			return err
+		}
+
+		lv.Spec.NoCow = opts.NoCow
+		lv.Spec.Compression = opts.Compression
+		lv.Spec.QuotaMode = quotaMode
+
+		if err := s.writer.Update(ctx, lv); err != nil {
+			if apierrors.IsConflict(err) {
+				logger.Info("detect conflict when LogicalVolume spec update", "name", lv.Name)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(1 * time.Second):
+				}
+				continue
+			}
+			logger.Error(err, "failed to update LogicalVolume spec", "name", lv.Name)
+			return err
+		}
+		break
+	}
+
+	// wait until topols-node applies the spec, the generation is not changed if the spec is the same
+	for {
+		logger.Info("waiting for update of 'status.observedGeneration'", "name", lv.Name, "generation", lv.Generation)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
+
+		var changedLV topolsv1.LogicalVolume
+		err := s.getter.Get(ctx, client.ObjectKey{Name: lv.Name}, &changedLV)
+		if err != nil {
+			logger.Error(err, "failed to get LogicalVolume", "name", lv.Name)
+			return err
+		}
+		// status.code belongs to an older spec until topols-node observes the new generation
+		if changedLV.Status.ObservedGeneration < lv.Generation {
+			continue
+		}
+		if changedLV.Status.Code != codes.OK {
+			return status.Error(changedLV.Status.Code, changedLV.Status.Message)
+		}
+		return nil
+	}
+}
+
 // GetVolume returns LogicalVolume by volume ID.
 func (s *LogicalVolumeService) GetVolume(ctx context.Context, volumeID string) (*topolsv1.LogicalVolume, error) {
 	return s.volumeGetter.Get(ctx, volumeID)
 }
 
+// ListVolumes returns all LogicalVolumes sorted by name.
+func (s *LogicalVolumeService) ListVolumes(ctx context.Context) ([]topolsv1.LogicalVolume, error) {
+	return s.volumeGetter.List(ctx)
+}
+
 // updateSpecSize updates .Spec.Size of LogicalVolume.
 func (s *LogicalVolumeService) updateSpecSize(ctx context.Context, volumeID string, size *resource.Quantity) error {
 	for {
@@ -0,0 +1,124 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// newFakeService returns the service backed by a fake client which increments the generation on spec updates
+// as the API server does.
+func newFakeService(t *testing.T, lv *topolsv1.LogicalVolume) (*LogicalVolumeService, client.Client) {
+	scheme := runtime.NewScheme()
+	if err := topolsv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(lv).
+		WithStatusSubresource(lv).
+		WithIndex(&topolsv1.LogicalVolume{}, indexFieldVolumeID, func(o client.Object) []string {
+			return []string{o.(*topolsv1.LogicalVolume).Status.VolumeID}
+		}).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				obj.SetGeneration(obj.GetGeneration() + 1)
+				return c.Update(ctx, obj, opts...)
+			},
+		}).
+		Build()
+
+	return &LogicalVolumeService{
+		writer:       c,
+		getter:       newRetryMissingGetter(c, c),
+		volumeGetter: &volumeGetter{cacheReader: c, apiReader: c},
+	}, c
+}
+
+// applyModify waits for the new generation of the LogicalVolume and records the result as topols-node does.
+// The result is recorded after the first poll of ModifyVolume, so it sees the old status.
+func applyModify(ctx context.Context, c client.Client, name string, code codes.Code) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		var lv topolsv1.LogicalVolume
+		if err := c.Get(ctx, client.ObjectKey{Name: name}, &lv); err != nil {
+			return err
+		}
+		if lv.Generation == lv.Status.ObservedGeneration {
+			continue
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+		lv.Status.ObservedGeneration = lv.Generation
+		lv.Status.Code = code
+		lv.Status.Message = code.String()
+		return c.Status().Update(ctx, &lv)
+	}
+}
+
+func TestModifyVolume(t *testing.T) {
+	testCases := []struct {
+		name string
+		code codes.Code
+	}{
+		{"applied after a failure of an older spec", codes.OK},
+		{"failed", codes.ResourceExhausted},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// the previous modification has failed
+			lv := &topolsv1.LogicalVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "lv", Generation: 2},
+				Spec:       topolsv1.LogicalVolumeSpec{Name: "lv", NodeName: "node", DeviceClass: "ssd"},
+				Status: topolsv1.LogicalVolumeStatus{
+					VolumeID:           "volume",
+					ObservedGeneration: 2,
+					Code:               codes.Internal,
+					Message:            "failed to set options",
+				},
+			}
+			s, c := newFakeService(t, lv)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- applyModify(ctx, c, lv.Name, tc.code)
+			}()
+
+			err := s.ModifyVolume(ctx, "volume", lsm.VolumeOptions{Compression: "zstd"}, "exclusive")
+			if status.Code(err) != tc.code {
+				t.Errorf("expected code %v, got %v", tc.code, err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+
+			var changed topolsv1.LogicalVolume
+			if err := c.Get(ctx, client.ObjectKey{Name: lv.Name}, &changed); err != nil {
+				t.Fatal(err)
+			}
+			if changed.Spec.Compression != "zstd" || changed.Spec.QuotaMode != "exclusive" {
+				t.Errorf("spec is not updated: %+v", changed.Spec)
+			}
+		})
+	}
+}
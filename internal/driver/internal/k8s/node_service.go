@@ -114,3 +114,30 @@ func (s NodeService) GetMaxCapacity(ctx context.Context, deviceClass string) (st
 	}
 	return nodeName, maxCapacity, nil
 }
+
+// TransferEnabled returns true if the node runs the volume transfer service.
+func (s NodeService) TransferEnabled(ctx context.Context, name string) (bool, error) {
+	n := new(v1.PartialObjectMetadata)
+	n.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Node"))
+	err := s.reader.Get(ctx, client.ObjectKey{Name: name}, n)
+	if err != nil {
+		return false, err
+	}
+
+	return n.Annotations[topols.TransferAddressKey] != "", nil
+}
+
+// UnhealthyReason returns the reason why the node reports the device class unhealthy, empty string if it is healthy.
+func (s NodeService) UnhealthyReason(ctx context.Context, name, deviceClass string) (string, error) {
+	n := new(v1.PartialObjectMetadata)
+	n.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Node"))
+	err := s.reader.Get(ctx, client.ObjectKey{Name: name}, n)
+	if err != nil {
+		return "", err
+	}
+
+	if deviceClass == topols.DefaultDeviceClassName {
+		deviceClass = n.Annotations[topols.DefaultDeviceClassKey]
+	}
+	return n.Annotations[topols.UnhealthyKeyPrefix+deviceClass], nil
+}
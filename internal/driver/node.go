@@ -3,11 +3,13 @@ package driver
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kvaster/topols"
 	"github.com/kvaster/topols/internal/driver/internal/k8s"
+	"github.com/kvaster/topols/internal/loop"
 	"github.com/kvaster/topols/pkg/lsm"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -116,18 +118,12 @@ func (s *nodeServerNoLocked) NodePublishVolume(ctx context.Context, req *csi.Nod
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "no volume_capability is provided")
 	}
+	isBlockVol := req.GetVolumeCapability().GetBlock() != nil
 	isFsVol := req.GetVolumeCapability().GetMount() != nil
-	if !isFsVol {
+	if !(isBlockVol || isFsVol) {
 		return nil, status.Errorf(codes.InvalidArgument, "no supported volume capability: %v", req.GetVolumeCapability())
 	}
-	// we only support SINGLE_NODE_WRITER
 	accessMode := req.GetVolumeCapability().GetAccessMode().GetMode()
-	switch accessMode {
-	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
-	default:
-		modeName := csi.VolumeCapability_AccessMode_Mode_name[int32(accessMode)]
-		return nil, status.Errorf(codes.FailedPrecondition, "unsupported access mode: %s (%d)", modeName, accessMode)
-	}
 
 	var lv *lsm.LogicalVolume
 	var err error
@@ -136,6 +132,10 @@ func (s *nodeServerNoLocked) NodePublishVolume(ctx context.Context, req *csi.Nod
 	if err != nil {
 		return nil, err
 	}
+	if !accessModeSupported(accessMode, lvr.Spec.Source != "") {
+		modeName := csi.VolumeCapability_AccessMode_Mode_name[int32(accessMode)]
+		return nil, status.Errorf(codes.FailedPrecondition, "unsupported access mode: %s (%d)", modeName, accessMode)
+	}
 	lv, err = s.getLvFromContext(ctx, lvr.Spec.DeviceClass, volumeID)
 	if err != nil {
 		return nil, err
@@ -144,8 +144,27 @@ func (s *nodeServerNoLocked) NodePublishVolume(ctx context.Context, req *csi.Nod
 		return nil, status.Errorf(codes.NotFound, "failed to find LV: %s", volumeID)
 	}
 
-	err = s.nodePublishFilesystemVolume(req, lv)
+	// SINGLE_NODE_WRITER and SINGLE_NODE_MULTI_WRITER volumes may be published at several target paths of the node,
+	// a SINGLE_NODE_SINGLE_WRITER volume is published only at one.
+	if accessMode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		targets, err := publishedTargets(s.client.GetPath(lv), isBlockVol)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "published target paths check failed: volume=%s, error=%v", volumeID, err)
+		}
+		for _, t := range targets {
+			if t != req.GetTargetPath() {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already published at %s", volumeID, t)
+			}
+		}
+	}
 
+	// reader-only volumes are always published read-only
+	readOnly := req.GetReadonly() || isReaderOnly(accessMode)
+	if isBlockVol {
+		err = s.nodePublishBlockVolume(ctx, req, lv, readOnly)
+	} else {
+		err = s.nodePublishFilesystemVolume(req, lv, readOnly)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -168,11 +187,11 @@ func makeMountOptions(readOnly bool, mountOption *csi.VolumeCapability_MountVolu
 	return mountOptions, nil
 }
 
-func (s *nodeServerNoLocked) nodePublishFilesystemVolume(req *csi.NodePublishVolumeRequest, lv *lsm.LogicalVolume) error {
+func (s *nodeServerNoLocked) nodePublishFilesystemVolume(req *csi.NodePublishVolumeRequest, lv *lsm.LogicalVolume, readOnly bool) error {
 	// Check request
 	mountOption := req.GetVolumeCapability().GetMount()
 
-	mountOptions, err := makeMountOptions(req.GetReadonly(), mountOption)
+	mountOptions, err := makeMountOptions(readOnly, mountOption)
 	if err != nil {
 		return err
 	}
@@ -223,6 +242,74 @@ func (s *nodeServerNoLocked) nodePublishFilesystemVolume(req *csi.NodePublishVol
 	return nil
 }
 
+func (s *nodeServerNoLocked) nodePublishBlockVolume(ctx context.Context, req *csi.NodePublishVolumeRequest, lv *lsm.LogicalVolume, readOnly bool) error {
+	volumeId := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+
+	// the file is created on the first publish, read-only volumes are snapshots of block volumes which have it
+	filePath := blockFilePath(s.client.GetPath(lv))
+	if !readOnly {
+		if err := ensureBlockFile(filePath, blockFileSize(lv.Size)); err != nil {
+			return status.Errorf(codes.Internal, "block file create failed: volume=%s, file=%s, error=%v", volumeId, filePath, err)
+		}
+	}
+	// the volume mode is recorded for recovery, volumes published before it was recorded get it here too
+	if err := s.client.SetBlock(ctx, lv.Name, lv.DeviceClass); err != nil {
+		return status.Errorf(codes.Internal, "block volume mark failed: volume=%s, error=%v", volumeId, err)
+	}
+
+	// loop devices do not survive reboots, the device is attached again when the volume is published after a reboot
+	device, err := loop.Attach(filePath, readOnly)
+	if err != nil {
+		return status.Errorf(codes.Internal, "loop device attach failed: volume=%s, file=%s, error=%v", volumeId, filePath, err)
+	}
+
+	isMnt, err := s.mounter.IsMountPoint(targetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return status.Errorf(codes.Internal, "target path check failed: volume=%s, target=%s, error=%v", volumeId, targetPath, err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return status.Errorf(codes.Internal, "target directory create failed: volume=%s, target=%s, error=%v", volumeId, targetPath, err)
+		}
+		f, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return status.Errorf(codes.Internal, "target path create failed: volume=%s, target=%s, error=%v", volumeId, targetPath, err)
+		}
+		_ = f.Close()
+
+		nodeLogger.Info("NodePublishVolume(block) target path created",
+			"volume_id", volumeId,
+			"target_path", targetPath,
+		)
+
+		isMnt = false
+	}
+
+	if isMnt {
+		nodeLogger.Info("NodePublishVolume(block) target path is already mounted",
+			"volume_id", volumeId,
+			"target_path", targetPath,
+		)
+	} else {
+		mountOptions := []string{"bind"}
+		if readOnly {
+			mountOptions = append(mountOptions, "ro")
+		}
+		if err := s.mounter.Mount(device, targetPath, "", mountOptions); err != nil {
+			return status.Errorf(codes.Internal, "bind mount failed: volume=%s, device=%s, target=%s, error=%v", volumeId, device, targetPath, err)
+		}
+	}
+
+	nodeLogger.Info("NodePublishVolume(block) succeeded",
+		"volume_id", volumeId,
+		"target_path", targetPath,
+		"device", device)
+
+	return nil
+}
+
 func (s *nodeServerNoLocked) findVolumeByID(volumes []*lsm.LogicalVolume, name string) *lsm.LogicalVolume {
 	for _, v := range volumes {
 		if v.Name == name {
@@ -233,7 +320,7 @@ func (s *nodeServerNoLocked) findVolumeByID(volumes []*lsm.LogicalVolume, name s
 }
 
 func (s *nodeServerNoLocked) getLvFromContext(ctx context.Context, deviceClass, volumeID string) (*lsm.LogicalVolume, error) {
-	listResp, err := s.client.GetLVList(deviceClass)
+	listResp, err := s.client.GetLVList(ctx, deviceClass)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to list LV: %v", err)
 	}
@@ -261,11 +348,11 @@ func (s *nodeServerNoLocked) NodeUnpublishVolume(ctx context.Context, req *csi.N
 		return nil, status.Errorf(codes.Internal, "stat failed for %s: %v", targetPath, err)
 	}
 
-	if !info.IsDir() {
-		return nil, status.Errorf(codes.Internal, "target_path is not directory: %s", targetPath)
+	if info.IsDir() {
+		err = s.nodeUnpublishFilesystemVolume(req)
+	} else {
+		err = s.nodeUnpublishBlockVolume(req)
 	}
-
-	err = s.nodeUnpublishFilesystemVolume(req)
 	if err != nil {
 		return nil, err
 	}
@@ -307,6 +394,61 @@ func (s *nodeServerNoLocked) nodeUnpublishFilesystemVolume(req *csi.NodeUnpublis
 	return nil
 }
 
+func (s *nodeServerNoLocked) nodeUnpublishBlockVolume(req *csi.NodeUnpublishVolumeRequest) error {
+	targetPath := req.GetTargetPath()
+	volumeId := req.GetVolumeId()
+
+	isMnt, err := s.mounter.IsMountPoint(targetPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "target path check failed: volume=%s, target=%s, error=%v", volumeId, targetPath, err)
+	}
+
+	var device string
+	if isMnt {
+		device, err = loopDevice(targetPath)
+		if err != nil {
+			return status.Errorf(codes.Internal, "target path stat failed: volume=%s, target=%s, error=%v", volumeId, targetPath, err)
+		}
+
+		if err := s.mounter.Unmount(targetPath); err != nil {
+			return status.Errorf(codes.Internal, "target path unmount failed: volume=%s, target=%s, error=%v", volumeId, targetPath, err)
+		}
+
+		nodeLogger.Info("NodeUnpublishVolume(block) target path unmounted",
+			"volume_id", volumeId,
+			"target_path", targetPath,
+		)
+	}
+
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "error removing target path: volume=%s, target=%s, error=%v", volumeId, targetPath, err)
+	}
+
+	// the device is detached when it is not bound to other target paths of the volume
+	if device != "" {
+		mounted, err := loopDeviceMounted(device)
+		if err != nil {
+			return status.Errorf(codes.Internal, "mount info read failed: volume=%s, error=%v", volumeId, err)
+		}
+		if !mounted {
+			if err := loop.Detach(device); err != nil {
+				return status.Errorf(codes.Internal, "loop device detach failed: volume=%s, device=%s, error=%v", volumeId, device, err)
+			}
+
+			nodeLogger.Info("NodeUnpublishVolume(block) loop device detached",
+				"volume_id", volumeId,
+				"device", device,
+			)
+		}
+	}
+
+	nodeLogger.Info("NodeUnpublishVolume(block) is succeeded",
+		"volume_id", volumeId,
+		"target_path", targetPath)
+
+	return nil
+}
+
 func (s *nodeServerNoLocked) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	volumeId := req.GetVolumeId()
 	volumePath := req.GetVolumePath()
@@ -327,16 +469,24 @@ func (s *nodeServerNoLocked) NodeGetVolumeStats(ctx context.Context, req *csi.No
 		return nil, err
 	}
 
-	stats, err := s.client.VolumeStats(lv.Name, lv.DeviceClass)
+	stats, err := s.client.VolumeStats(ctx, lv.Name, lv.DeviceClass)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "stat on %s was failed: %v", volumePath, err)
 	}
 
+	nodeLogger.V(1).Info("NodeGetVolumeStats usage", "volume_id", volumeId,
+		"referenced", stats.ReferencedBytes, "exclusive", stats.ExclusiveBytes, "shared", stats.SharedBytes)
+
+	// used bytes are counted the same way as the volume limit, exclusive bytes for exclusive limits
+	var available uint64
+	if stats.TotalBytes > stats.UsedBytes {
+		available = stats.TotalBytes - stats.UsedBytes
+	}
 	usage := []*csi.VolumeUsage{{
 		Unit:      csi.VolumeUsage_BYTES,
 		Total:     int64(stats.TotalBytes),
 		Used:      int64(stats.UsedBytes),
-		Available: int64(stats.TotalBytes - stats.UsedBytes),
+		Available: int64(available),
 	}}
 
 	return &csi.NodeGetVolumeStatsResponse{Usage: usage}, nil
@@ -362,11 +512,23 @@ func (s *nodeServerNoLocked) NodeExpandVolume(ctx context.Context, req *csi.Node
 
 	// We need to check the capacity range but don't use the converted value
 	// because the filesystem can be resized without the requested size.
-	_, err := convertRequestCapacity(req.GetCapacityRange().GetRequiredBytes(), req.GetCapacityRange().GetLimitBytes())
+	requested, err := convertRequestCapacity(req.GetCapacityRange().GetRequiredBytes(), req.GetCapacityRange().GetLimitBytes())
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	isBlockVol := req.GetVolumeCapability().GetBlock() != nil
+	if req.GetVolumeCapability() == nil {
+		info, err := os.Stat(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "volume path is not found: %s", volumePath)
+		}
+		isBlockVol = !info.IsDir()
+	}
+	if isBlockVol {
+		return s.nodeExpandBlockVolume(ctx, req, requested)
+	}
+
 	// Filesystem should be already expanded by qouta change in logicalvolume controller
 
 	// `capacity_bytes` in NodeExpandVolumeResponse is defined as OPTIONAL.
@@ -376,10 +538,50 @@ func (s *nodeServerNoLocked) NodeExpandVolume(ctx context.Context, req *csi.Node
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
+// nodeExpandBlockVolume grows the backing file of the block volume and updates the size of its loop devices.
+func (s *nodeServerNoLocked) nodeExpandBlockVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest, requested int64) (*csi.NodeExpandVolumeResponse, error) {
+	volumeId := req.GetVolumeId()
+
+	lvr, err := s.k8sLVService.GetVolume(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	lv, err := s.getLvFromContext(ctx, lvr.Spec.DeviceClass, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	if lv == nil {
+		return nil, status.Errorf(codes.NotFound, "failed to find LV: %s", volumeId)
+	}
+
+	filePath := blockFilePath(s.client.GetPath(lv))
+	if err := growBlockFile(filePath, blockFileSize(uint64(requested))); err != nil {
+		return nil, status.Errorf(codes.Internal, "block file resize failed: volume=%s, file=%s, error=%v", volumeId, filePath, err)
+	}
+
+	devices, err := loop.Devices(filePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "loop device lookup failed: volume=%s, file=%s, error=%v", volumeId, filePath, err)
+	}
+	for _, device := range devices {
+		if err := loop.SetCapacity(device); err != nil {
+			return nil, status.Errorf(codes.Internal, "loop device resize failed: volume=%s, device=%s, error=%v", volumeId, device, err)
+		}
+	}
+
+	nodeLogger.Info("NodeExpandVolume(block) succeeded",
+		"volume_id", volumeId,
+		"size", requested,
+		"devices", devices)
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: requested}, nil
+}
+
 func (s *nodeServerNoLocked) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	capabilities := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 
 	csiCaps := make([]*csi.NodeServiceCapability, len(capabilities))
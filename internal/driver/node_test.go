@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"os"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -14,3 +15,58 @@ func TestMakeMountOptions(t *testing.T) {
 		t.Fatalf("err should happen")
 	}
 }
+
+func TestEnsureBlockFile(t *testing.T) {
+	path := blockFilePath(t.TempDir())
+
+	if err := ensureBlockFile(path, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	assertSize := func(expected int64) {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != expected {
+			t.Errorf("size should be %d: %d", expected, info.Size())
+		}
+	}
+	assertSize(1 << 20)
+
+	if err := ensureBlockFile(path, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	assertSize(2 << 20)
+
+	// the file is never shrunk
+	if err := growBlockFile(path, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	assertSize(2 << 20)
+
+	device, err := loopDevice(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device != "" {
+		t.Errorf("regular file should not be a loop device: %s", device)
+	}
+}
+
+func TestBlockFileSize(t *testing.T) {
+	testCases := []struct {
+		size     uint64
+		expected uint64
+	}{
+		{1 << 30, 1046896640},
+		{100 << 30, 99840 << 20},
+		{1 << 20, 1019904},
+	}
+
+	for _, tc := range testCases {
+		if size := blockFileSize(tc.size); size != tc.expected {
+			t.Errorf("block file of %d should be %d: %d", tc.size, tc.expected, size)
+		}
+	}
+}
@@ -1,4 +1,5 @@
-package driver
+// Package lock provides locks keyed by string IDs.
+package lock
 
 import (
 	"fmt"
@@ -0,0 +1,209 @@
+// Package loop attaches files to loop devices and manages attached devices.
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Major is the major number of loop devices.
+const Major = 7
+
+const (
+	controlPath = "/dev/loop-control"
+	devDir      = "/dev"
+	sysDir      = "/sys/block"
+
+	// attachRetries limits attempts to take a free device which is taken by another process before it is configured.
+	attachRetries = 10
+)
+
+// Find returns the loop device of the file attached with the same read-only mode, empty string if there is none.
+// Devices are matched by the device and the inode of the file, so paths may differ in mount namespaces.
+func Find(path string, readOnly bool) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(sysDir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "loop") {
+			continue
+		}
+		// only attached devices have the backing file
+		if _, err := os.Stat(filepath.Join(sysDir, e.Name(), "loop", "backing_file")); err != nil {
+			continue
+		}
+
+		device := filepath.Join(devDir, e.Name())
+		info, err := status(device)
+		if err != nil {
+			// the device is detached or removed concurrently
+			if errors.Is(err, unix.ENXIO) || errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return "", err
+		}
+		if info.Device == st.Dev && info.Inode == st.Ino && (info.Flags&unix.LO_FLAGS_READ_ONLY != 0) == readOnly {
+			return device, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Attach attaches the file to a free loop device and returns the device.
+// If the file is already attached with the same read-only mode, its device is returned.
+func Attach(path string, readOnly bool) (string, error) {
+	if device, err := Find(path, readOnly); err != nil || device != "" {
+		return device, err
+	}
+
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	ctl, err := os.OpenFile(controlPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = ctl.Close() }()
+
+	for i := 0; i < attachRetries; i++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", fmt.Errorf("LOOP_CTL_GET_FREE: %w", err)
+		}
+		device, err := deviceNode(n)
+		if err != nil {
+			return "", err
+		}
+		err = configure(device, f, readOnly)
+		if errors.Is(err, unix.EBUSY) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return device, nil
+	}
+
+	return "", fmt.Errorf("no free loop device for %s", path)
+}
+
+// Detach detaches the file from the loop device. The device is detached when it is closed by
+// its last user if it is still open. It is not an error if the device is not attached.
+func Detach(device string) error {
+	d, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	if err := unix.IoctlSetInt(int(d.Fd()), unix.LOOP_CLR_FD, 0); err != nil && !errors.Is(err, unix.ENXIO) {
+		return fmt.Errorf("LOOP_CLR_FD %s: %w", device, err)
+	}
+	return nil
+}
+
+// SetCapacity updates the size of the loop device to the current size of the attached file.
+func SetCapacity(device string) error {
+	d, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	if err := unix.IoctlSetInt(int(d.Fd()), unix.LOOP_SET_CAPACITY, 0); err != nil {
+		return fmt.Errorf("LOOP_SET_CAPACITY %s: %w", device, err)
+	}
+	return nil
+}
+
+// Devices returns loop devices attached to the file, both read-write and read-only.
+func Devices(path string) ([]string, error) {
+	var devices []string
+	for _, readOnly := range []bool{false, true} {
+		device, err := Find(path, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		if device != "" {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+func configure(device string, f *os.File, readOnly bool) error {
+	// the device is read-only if it is opened read-only
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	d, err := os.OpenFile(device, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	fd := int(d.Fd())
+
+	if err := unix.IoctlSetInt(fd, unix.LOOP_SET_FD, int(f.Fd())); err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			return err
+		}
+		return fmt.Errorf("LOOP_SET_FD %s: %w", device, err)
+	}
+
+	info := &unix.LoopInfo64{}
+	copy(info.File_name[:unix.LO_NAME_SIZE-1], f.Name())
+	if err := unix.IoctlLoopSetStatus64(fd, info); err != nil {
+		_ = unix.IoctlSetInt(fd, unix.LOOP_CLR_FD, 0)
+		return fmt.Errorf("LOOP_SET_STATUS64 %s: %w", device, err)
+	}
+
+	// direct I/O avoids caching data twice, in pages of the file and of the device,
+	// it is not supported if the block size of the device is smaller than the one of the file
+	_ = unix.IoctlSetInt(fd, unix.LOOP_SET_DIRECT_IO, 1)
+
+	return nil
+}
+
+// deviceNode returns the path of the loop device with the number, the node is created if /dev does not have it,
+// i.e. if /dev is not devtmpfs.
+func deviceNode(n int) (string, error) {
+	device := filepath.Join(devDir, "loop"+strconv.Itoa(n))
+	if _, err := os.Stat(device); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return device, err
+	}
+	if err := unix.Mknod(device, unix.S_IFBLK|0660, int(unix.Mkdev(Major, uint32(n)))); err != nil && !errors.Is(err, unix.EEXIST) {
+		return "", fmt.Errorf("mknod %s: %w", device, err)
+	}
+	return device, nil
+}
+
+func status(device string) (*unix.LoopInfo64, error) {
+	d, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = d.Close() }()
+
+	return unix.IoctlLoopGetStatus64(int(d.Fd()))
+}
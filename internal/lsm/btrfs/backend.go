@@ -0,0 +1,96 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/kvaster/topols/pkg/lsm"
+)
+
+const (
+	// BackendCLI runs btrfs-progs (/sbin/btrfs) for every filesystem operation.
+	BackendCLI = "cli"
+	// BackendIoctl talks to the kernel directly with btrfs ioctls.
+	BackendIoctl = "ioctl"
+)
+
+// qgroupLevelShift is the position of the level in a qgroup id, i.e. 1/N is 1<<48|N.
+const qgroupLevelShift = 48
+
+// qgroupID returns the id of qgroup level/id.
+func qgroupID(level, id uint64) uint64 {
+	return level<<qgroupLevelShift | id
+}
+
+// subvolume is the information about a subvolume needed by the device class manager.
+type subvolume struct {
+	ID         uint64
+	Limit      lsm.Limit
+	Referenced uint64
+	Exclusive  uint64
+}
+
+// usage is the space of the whole filesystem in logical bytes, i.e. after RAID profile is applied.
+type usage struct {
+	Size uint64
+	Free uint64
+}
+
+// backend is a set of low level btrfs operations.
+// All paths are absolute paths of subvolumes.
+type backend interface {
+	createSubvolume(ctx context.Context, path string) error
+	createSnapshot(ctx context.Context, srcPath, path string, readOnly bool) error
+	removeSubvolume(ctx context.Context, path string) error
+	// setLimit sets the limit of the given mode and clears the limit of the other mode.
+	setLimit(ctx context.Context, path string, limit lsm.Limit) error
+	// createQgroup creates the qgroup on the filesystem of path, it is not an error if the qgroup exists.
+	createQgroup(ctx context.Context, path string, qgroupid uint64) error
+	// setQgroupLimit is setLimit for the qgroup on the filesystem of path, zero size clears the limit.
+	setQgroupLimit(ctx context.Context, path string, qgroupid uint64, limit lsm.Limit) error
+	// assignQgroup makes the qgroup of the subvolume a member of the parent qgroup,
+	// it is not an error if it is a member already.
+	assignQgroup(ctx context.Context, path string, parent uint64) error
+	subvolumeInfo(ctx context.Context, path string) (*subvolume, error)
+	// removeStaleQgroups destroys level-0 qgroups of deleted subvolumes on the filesystem of path
+	// and returns the number of destroyed qgroups.
+	removeStaleQgroups(ctx context.Context, path string) (int, error)
+	// checkQuota returns lsm.ErrQuotaDisabled if quotas are not enabled on the filesystem of path.
+	checkQuota(ctx context.Context, path string) error
+	usage(ctx context.Context, path string) (*usage, error)
+}
+
+// subvolumeLimit returns the limit from referenced and exclusive limits, zero means no limit.
+func subvolumeLimit(rfer, excl uint64) lsm.Limit {
+	if rfer == 0 && excl != 0 {
+		return lsm.Limit{Size: excl, Mode: lsm.QuotaExclusive}
+	}
+	return lsm.Limit{Size: rfer, Mode: lsm.QuotaReferenced}
+}
+
+// checkSubvolume returns lsm.ErrNotVolume if path is not a subvolume, the root directory of a subvolume
+// always has the first free inode number.
+func checkSubvolume(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || st.Ino != btrfsFirstFreeObjectID {
+		return fmt.Errorf("%s: %w", path, lsm.ErrNotVolume)
+	}
+	return nil
+}
+
+func newBackend(name string) (backend, error) {
+	switch name {
+	case BackendCLI, "":
+		return &cliBackend{}, nil
+	case BackendIoctl:
+		return &ioctlBackend{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown btrfs backend: %s", name)
+}
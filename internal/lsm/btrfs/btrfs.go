@@ -3,63 +3,99 @@ package btrfs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/g0rbe/go-chattr"
+	"github.com/kvaster/topols/internal/lock"
 	"github.com/kvaster/topols/pkg/lsm"
-	"k8s.io/apimachinery/pkg/api/resource"
+	"google.golang.org/grpc/codes"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/yaml"
 )
 
 var btrfsLogger = ctrl.Log.WithName("lsm").WithName("btrfs")
 
-var limitRegexp = regexp.MustCompile(`\s*Limit referenced:\s*(\d+)\s*`)
-var usageRegexp = regexp.MustCompile(`\s*Usage referenced:\s*(\d+)\s*`)
-var subvolRegexp = regexp.MustCompile(`\s*Subvolume ID:\s*(\d+)\s*`)
-
-var errParseInfo = errors.New("error parsing info")
 var errWatch = errors.New("watch error")
-var errExec = errors.New("execute error")
 
 const configFile = "devices.yml"
 
-type deviceClassConfig struct {
-	Name    string `json:"name"`
-	Default bool   `json:"default"`
-	Size    string `json:"size"`
-}
+const unhealthyRecheckInterval = time.Minute
 
-type config struct {
-	DeviceClasses []*deviceClassConfig `json:"device-classes"`
-}
+const (
+	// AccountingLimit counts volume limits as used capacity.
+	AccountingLimit = "limit"
+	// AccountingExclusive counts bytes exclusively used by volumes as used capacity.
+	AccountingExclusive = "exclusive"
+)
+
+const (
+	// CapacityConfigured limits the device class capacity by the configured size only.
+	CapacityConfigured = "configured"
+	// CapacityFilesystem additionally limits the device class capacity by the free space of the filesystem.
+	CapacityFilesystem = "filesystem"
+)
 
 type deviceClass struct {
 	Name    string
 	Default bool
 	Size    uint64
+	Type    string
+	Path    string
+	// Capacity is the capacity mode, CapacityConfigured or CapacityFilesystem.
+	Capacity        string
+	OvercommitRatio float64
+	Spare           uint
+	QuotaMode       lsm.QuotaMode
+	Accounting      string
+	// Qgroup is the group of all volumes, zero if the device class has no group.
+	Qgroup  uint64
 	Volumes []*lsm.LogicalVolume
+	// Unknown are the entries of the device class directory which are not managed volumes.
+	Unknown []*lsm.UnknownEntry
+	// Err is the reason why the device class is unhealthy, nil if it is healthy.
+	Err error
+
+	// pending is the size reserved by volumes which are being created or expanded.
+	pending map[string]uint64
+	driver  lsm.Driver
 }
 
 type btrfs struct {
 	poolPath string
+	drivers  lsm.DriverRegistry
 
+	// mu protects in-memory state only and is never held during filesystem operations.
+	// Operations on the same volume are serialized with volumeLock.
 	deviceClasses []*deviceClass
 	mu            sync.Mutex
+	volumeLock    *lock.LockByID
 	watches       []chan struct{}
+	// config is the result of the last config load
+	config lsm.ConfigStatus
+	// scanOnly disables changes of the filesystem when the config is loaded
+	scanOnly bool
 }
 
-func NewBtrfs(path string) (lsm.Client, error) {
-	fs := &btrfs{poolPath: path}
-	fs.loadConfig()
+// NewBtrfs returns lsm.Client for device classes under path.
+// Volumes of each device class are managed by the driver registered for the class filesystem type.
+func NewBtrfs(path string, drivers lsm.DriverRegistry) (lsm.Client, error) {
+	fs := &btrfs{poolPath: path, drivers: drivers, volumeLock: lock.NewLockWithID()}
+	fs.loadConfig(context.Background())
+	return fs, nil
+}
+
+// ScanBtrfs returns lsm.Client which only reads volumes of device classes under path,
+// groups of device classes are not reconciled. It is used while topols-node owns the volumes,
+// so the client must not be used to change them.
+func ScanBtrfs(path string, drivers lsm.DriverRegistry) (lsm.Client, error) {
+	fs := &btrfs{poolPath: path, drivers: drivers, volumeLock: lock.NewLockWithID(), scanOnly: true}
+	fs.loadConfig(context.Background())
 	return fs, nil
 }
 
@@ -79,7 +115,7 @@ func (c *btrfs) notify() {
 	}
 }
 
-func (c *btrfs) GetLVList(deviceClass string) ([]*lsm.LogicalVolume, error) {
+func (c *btrfs) GetLVList(ctx context.Context, deviceClass string) ([]*lsm.LogicalVolume, error) {
 	btrfsLogger.Info("GetLVList", "DeviceClass", deviceClass)
 
 	c.mu.Lock()
@@ -90,16 +126,587 @@ func (c *btrfs) GetLVList(deviceClass string) ([]*lsm.LogicalVolume, error) {
 	dc := c.findDeviceClass(deviceClass)
 	if dc != nil {
 		for _, v := range dc.Volumes {
-			volumes = append(volumes, &lsm.LogicalVolume{Name: v.Name, DeviceClass: dc.Name, Size: v.Size})
+			volumes = append(volumes, &lsm.LogicalVolume{Name: v.Name, DeviceClass: dc.Name, Size: v.Size, Meta: v.Meta})
 		}
 	}
 
 	return volumes, nil
 }
 
-func (c *btrfs) CreateLV(name, deviceClass string, noCow bool, size uint64) (*lsm.LogicalVolume, error) {
-	btrfsLogger.Info("CreateLV", "Name", name, "DeviceClass", deviceClass, "Size", size)
+func (c *btrfs) CreateLV(ctx context.Context, name, deviceClass string, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error) {
+	btrfsLogger.Info("CreateLV", "Name", name, "DeviceClass", deviceClass, "Size", size, "Options", opts)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	c.mu.Lock()
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	if err == nil && dc.findVolume(name) != nil {
+		err = lsm.ErrAlreadyExists
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.reserve(ctx, dc, name, size); err != nil {
+		return nil, err
+	}
+
+	err = dc.driver.CreateVolume(ctx, dc.volumePath(name), dc.limit(size), opts)
+	if err == nil {
+		err = dc.assignGroup(ctx, name)
+	}
+
+	var meta *lsm.VolumeMeta
+	if err == nil {
+		meta = &lsm.VolumeMeta{VolumeOwner: owner, Name: name, DeviceClass: dc.Name, Size: size, Options: opts, CreatedAt: time.Now().UTC()}
+		dc.saveMeta(meta)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(dc.pending, name)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &lsm.LogicalVolume{Name: name, DeviceClass: dc.Name, Size: size, Meta: meta}
+	dc.Volumes = append(dc.Volumes, v)
+
+	c.notify()
+
+	return v, nil
+}
+
+func (c *btrfs) CreateLVSnapshot(ctx context.Context, name, deviceClass, sourceVolID string, size uint64, accessType string, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error) {
+	btrfsLogger.Info("CreateLVSNapshot", "Name", name, "DeviceClass", deviceClass, "Size", size, "sourceVolID", sourceVolID, "accessType", accessType)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	c.mu.Lock()
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	if err == nil && dc.findVolume(name) != nil {
+		err = lsm.ErrAlreadyExists
+	}
+	var opts lsm.VolumeOptions
+	var block bool
+	if err == nil {
+		if source := dc.findVolume(sourceVolID); source == nil {
+			err = fmt.Errorf("source volume %s: %w", sourceVolID, lsm.ErrNoVolume)
+		} else if source.Meta != nil {
+			// the snapshot shares file attributes and the backing file of a block volume with the source
+			opts = source.Meta.Options
+			block = source.Meta.Block
+		}
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.reserve(ctx, dc, name, size); err != nil {
+		return nil, err
+	}
+
+	err = dc.driver.CreateSnapshot(ctx, dc.volumePath(sourceVolID), dc.volumePath(name), dc.limit(size), accessType == "ro")
+	if err == nil {
+		err = dc.assignGroup(ctx, name)
+	}
+
+	var meta *lsm.VolumeMeta
+	if err == nil {
+		meta = &lsm.VolumeMeta{VolumeOwner: owner, Name: name, DeviceClass: dc.Name, Size: size, Options: opts,
+			Source: sourceVolID, AccessType: accessType, CreatedAt: time.Now().UTC(), Block: block}
+		dc.saveMeta(meta)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(dc.pending, name)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &lsm.LogicalVolume{Name: name, DeviceClass: dc.Name, Size: size, Meta: meta}
+	dc.Volumes = append(dc.Volumes, v)
+
+	c.notify()
+
+	return v, nil
+}
+
+func (c *btrfs) RemoveLV(ctx context.Context, name, deviceClass string) error {
+	btrfsLogger.Info("RemoveLV", "Name", name, "DeviceClass", deviceClass)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	dc, _, err := c.findVolume(deviceClass, name)
+	if err != nil {
+		return err
+	}
+
+	if err := dc.driver.RemoveVolume(ctx, dc.volumePath(name)); err != nil {
+		return err
+	}
+	if err := dc.removeMeta(name); err != nil {
+		// the record is removed with other stale leftovers later
+		btrfsLogger.Info("Warning: error removing volume metadata", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dc.removeVolume(name)
+
+	c.notify()
+
+	return nil
+}
+
+func (c *btrfs) ResizeLV(ctx context.Context, name, deviceClass string, size uint64) error {
+	btrfsLogger.Info("ResizeLV", "Name", name, "DeviceClass", deviceClass, "Size", size)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	dc, v, err := c.findVolume(deviceClass, name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	current := v.Size
+	meta := v.Meta
+	c.mu.Unlock()
+
+	if size > current {
+		if err := c.reserve(ctx, dc, name, size-current); err != nil {
+			return err
+		}
+	}
+
+	err = dc.driver.SetLimit(ctx, dc.volumePath(name), dc.volumeLimit(meta, size))
+
+	if err == nil && meta != nil {
+		m := *meta
+		m.Size = size
+		meta = &m
+		dc.saveMeta(meta)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(dc.pending, name)
+	if err != nil {
+		return err
+	}
+
+	v.Size = size
+	v.Meta = meta
+
+	c.notify()
+
+	return nil
+}
+
+func (c *btrfs) ModifyLV(ctx context.Context, name, deviceClass string, opts lsm.VolumeOptions, mode lsm.QuotaMode) error {
+	btrfsLogger.Info("ModifyLV", "Name", name, "DeviceClass", deviceClass, "Options", opts, "QuotaMode", mode)
+
+	if err := opts.Validate(); err != nil {
+		return lsm.WrapError(codes.InvalidArgument, err)
+	}
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	dc, v, err := c.findVolume(deviceClass, name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	size := v.Size
+	meta := v.Meta
+	c.mu.Unlock()
+
+	// a volume without metadata is assumed to have default options, as it was created before options were recorded
+	m := lsm.VolumeMeta{Name: name, DeviceClass: dc.Name, Size: size}
+	if meta != nil {
+		m = *meta
+	}
+
+	if m.Options != opts {
+		od, ok := dc.driver.(lsm.OptionsDriver)
+		if !ok {
+			return lsm.ErrNotSupported
+		}
+		if err := od.SetOptions(ctx, dc.volumePath(name), opts); err != nil {
+			return err
+		}
+	}
+
+	if dc.quotaMode(m.QuotaMode) != dc.quotaMode(mode) {
+		if err := dc.driver.SetLimit(ctx, dc.volumePath(name), lsm.Limit{Size: size, Mode: dc.quotaMode(mode)}); err != nil {
+			return err
+		}
+	}
+
+	m.Options = opts
+	m.QuotaMode = mode
+	meta = &m
+	dc.saveMeta(meta)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v.Meta = meta
+
+	c.notify()
+
+	return nil
+}
+
+func (c *btrfs) SetBlock(ctx context.Context, name, deviceClass string) error {
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	dc, v, err := c.findVolume(deviceClass, name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	size := v.Size
+	meta := v.Meta
+	c.mu.Unlock()
+
+	// it is called on each publish of a block volume, so the metadata is written only once
+	if meta != nil && meta.Block {
+		return nil
+	}
+
+	btrfsLogger.Info("SetBlock", "Name", name, "DeviceClass", deviceClass)
+
+	m := lsm.VolumeMeta{Name: name, DeviceClass: dc.Name, Size: size}
+	if meta != nil {
+		m = *meta
+	}
+	m.Block = true
+	dc.saveMeta(&m)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v.Meta = &m
+
+	c.notify()
+
+	return nil
+}
+
+func (c *btrfs) SendLV(ctx context.Context, name, deviceClass, parent string, w io.Writer) error {
+	btrfsLogger.Info("SendLV", "Name", name, "DeviceClass", deviceClass, "Parent", parent)
+
+	dc, _, err := c.findVolume(deviceClass, name)
+	if err != nil {
+		return err
+	}
+
+	parentPath := ""
+	if parent != "" {
+		if _, _, err := c.findVolume(deviceClass, parent); err != nil {
+			return fmt.Errorf("parent: %w", err)
+		}
+		parentPath = dc.volumePath(parent)
+	}
+
+	sd, ok := dc.driver.(lsm.StreamDriver)
+	if !ok {
+		return lsm.ErrNotSupported
+	}
+
+	return sd.Send(ctx, dc.volumePath(name), parentPath, w)
+}
+
+func (c *btrfs) ReceiveLV(ctx context.Context, name, deviceClass string, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner, r io.Reader) (*lsm.LogicalVolume, error) {
+	btrfsLogger.Info("ReceiveLV", "Name", name, "DeviceClass", deviceClass, "Size", size)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	c.mu.Lock()
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	if err == nil && dc.findVolume(name) != nil {
+		err = lsm.ErrAlreadyExists
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sd, ok := dc.driver.(lsm.StreamDriver)
+	if !ok {
+		return nil, lsm.ErrNotSupported
+	}
+
+	if err := c.reserve(ctx, dc, name, size); err != nil {
+		return nil, err
+	}
+
+	err = dc.receive(ctx, sd, name, size, r)
+	if err == nil {
+		err = dc.assignGroup(ctx, name)
+	}
+
+	var meta *lsm.VolumeMeta
+	if err == nil {
+		meta = &lsm.VolumeMeta{VolumeOwner: owner, Name: name, DeviceClass: dc.Name, Size: size, Options: opts, CreatedAt: time.Now().UTC()}
+		dc.saveMeta(meta)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(dc.pending, name)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &lsm.LogicalVolume{Name: name, DeviceClass: dc.Name, Size: size, Meta: meta}
+	dc.Volumes = append(dc.Volumes, v)
+
+	c.notify()
+
+	return v, nil
+}
+
+func (c *btrfs) SendLVIncremental(ctx context.Context, name, deviceClass string, pass int, w io.Writer) error {
+	btrfsLogger.Info("SendLVIncremental", "Name", name, "DeviceClass", deviceClass, "Pass", pass)
+
+	dc, sd, err := c.snapshotIncremental(ctx, name, deviceClass, pass)
+	if err != nil {
+		return err
+	}
+
+	parent := ""
+	if pass > 0 {
+		parent = dc.incrementalPath(name, pass-1)
+	}
+
+	return sd.Send(ctx, dc.incrementalPath(name, pass), parent, w)
+}
+
+// snapshotIncremental takes the read-only snapshot of the volume for the pass. The snapshot of the previous pass
+// is kept as the parent, it is needed on both sides if the pass is repeated.
+func (c *btrfs) snapshotIncremental(ctx context.Context, name, deviceClass string, pass int) (*deviceClass, lsm.StreamDriver, error) {
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	dc, _, err := c.findVolume(deviceClass, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sd, ok := dc.driver.(lsm.StreamDriver)
+	if !ok {
+		return nil, nil, lsm.ErrNotSupported
+	}
+
+	if err := os.MkdirAll(dc.incrementalDir(name), 0700); err != nil {
+		return nil, nil, err
+	}
+	if err := dc.removeIncremental(ctx, name, func(p int) bool { return p < pass-1 || p >= pass }); err != nil {
+		return nil, nil, err
+	}
+
+	if err := dc.driver.CreateSnapshot(ctx, dc.volumePath(name), dc.incrementalPath(name, pass), lsm.Limit{}, true); err != nil {
+		return nil, nil, err
+	}
+
+	return dc, sd, nil
+}
+
+func (c *btrfs) ReceiveLVIncremental(ctx context.Context, name, deviceClass string, pass int, r io.Reader) error {
+	btrfsLogger.Info("ReceiveLVIncremental", "Name", name, "DeviceClass", deviceClass, "Pass", pass)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	c.mu.Lock()
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	if err == nil && dc.findVolume(name) != nil {
+		err = lsm.ErrAlreadyExists
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sd, ok := dc.driver.(lsm.StreamDriver)
+	if !ok {
+		return lsm.ErrNotSupported
+	}
+
+	dir := dc.incrementalDir(name)
+	if pass == 0 {
+		// snapshots left by an earlier transfer of the volume can't be parents of the new one
+		if err := dc.removeReceived(ctx, dir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// the snapshot of the pass may be left partially received by an aborted pass
+	if err := dc.removeIncremental(ctx, name, func(p int) bool { return p >= pass }); err != nil {
+		return err
+	}
+
+	path, err := sd.Receive(ctx, dir, r)
+	if err != nil {
+		return err
+	}
+	// the received snapshot has the name of the sent one, which is not the pass for streams of other sources
+	if path != dc.incrementalPath(name, pass) {
+		if err := os.Rename(path, dc.incrementalPath(name, pass)); err != nil {
+			return err
+		}
+	}
+
+	return dc.removeIncremental(ctx, name, func(p int) bool { return p < pass-1 })
+}
+
+func (c *btrfs) CompleteLVIncremental(ctx context.Context, name, deviceClass string, pass int, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error) {
+	btrfsLogger.Info("CompleteLVIncremental", "Name", name, "DeviceClass", deviceClass, "Pass", pass, "Size", size)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	c.mu.Lock()
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	if err == nil && dc.findVolume(name) != nil {
+		err = lsm.ErrAlreadyExists
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.reserve(ctx, dc, name, size); err != nil {
+		return nil, err
+	}
+
+	err = dc.driver.CreateSnapshot(ctx, dc.incrementalPath(name, pass), dc.volumePath(name), dc.limit(size), false)
+	if err == nil {
+		err = dc.assignGroup(ctx, name)
+	}
+
+	var meta *lsm.VolumeMeta
+	if err == nil {
+		meta = &lsm.VolumeMeta{VolumeOwner: owner, Name: name, DeviceClass: dc.Name, Size: size, Options: opts, CreatedAt: time.Now().UTC()}
+		dc.saveMeta(meta)
+		if err := dc.removeReceived(ctx, dc.incrementalDir(name)); err != nil {
+			btrfsLogger.Info("Warning: error removing received snapshots", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(dc.pending, name)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &lsm.LogicalVolume{Name: name, DeviceClass: dc.Name, Size: size, Meta: meta}
+	dc.Volumes = append(dc.Volumes, v)
+
+	c.notify()
+
+	return v, nil
+}
+
+func (c *btrfs) RemoveLVIncremental(ctx context.Context, name, deviceClass string) error {
+	btrfsLogger.Info("RemoveLVIncremental", "Name", name, "DeviceClass", deviceClass)
+
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	c.mu.Lock()
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return dc.removeReceived(ctx, dc.incrementalDir(name))
+}
+
+func (c *btrfs) GetPath(v *lsm.LogicalVolume) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dc := c.findDeviceClass(v.DeviceClass)
+	if dc == nil {
+		return filepath.Join(c.poolPath, v.DeviceClass, v.Name)
+	}
+
+	return dc.volumePath(v.Name)
+}
+
+func (c *btrfs) VolumeStats(ctx context.Context, name, deviceClass string) (*lsm.VolumeStats, error) {
+	btrfsLogger.Info("VolumeStats", "Name", name, "DeviceClass", deviceClass)
+
+	dc, _, err := c.findVolume(deviceClass, name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := dc.driver.VolumeInfo(ctx, dc.volumePath(name))
+	if err != nil {
+		btrfsLogger.Info("Error reading volume info", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
+		return nil, err
+	}
+
+	return info.Stats(), nil
+}
+
+func (c *btrfs) NodeStats(ctx context.Context) (*lsm.NodeStats, error) {
+	btrfsLogger.Info("NodeStats called")
+
+	c.mu.Lock()
+	dcs := slices.Clone(c.deviceClasses)
+	c.mu.Unlock()
+
+	usages := make([]*fsUsage, len(dcs))
+	for i, dc := range dcs {
+		usages[i] = c.fsUsage(ctx, dc)
+	}
+
+	var defaultDc *lsm.DeviceClassStats
+	var stats []*lsm.DeviceClassStats
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, dc := range dcs {
+		s := dc.stats(usages[i])
+		stats = append(stats, s)
+		if dc.Default {
+			defaultDc = s
+		}
+	}
+
+	return &lsm.NodeStats{DeviceClasses: stats, Default: defaultDc, Config: c.config}, nil
+}
 
+func (c *btrfs) UnknownEntries(ctx context.Context, deviceClass string) ([]*lsm.UnknownEntry, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -108,33 +715,57 @@ func (c *btrfs) CreateLV(name, deviceClass string, noCow bool, size uint64) (*ls
 		return nil, lsm.ErrNoDeviceClass
 	}
 
-	v := &lsm.LogicalVolume{Name: name, DeviceClass: dc.Name, Size: size}
-	path := c.GetPath(v)
+	var entries []*lsm.UnknownEntry
+	for _, e := range dc.Unknown {
+		entry := *e
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+func (c *btrfs) AdoptLV(ctx context.Context, name, deviceClass string, size uint64) (*lsm.LogicalVolume, error) {
+	btrfsLogger.Info("AdoptLV", "Name", name, "DeviceClass", deviceClass, "Size", size)
 
-	_, err := runCmd("/sbin/btrfs", "subvol", "create", path)
+	c.volumeLock.LockByID(name)
+	defer c.volumeLock.UnlockByID(name)
+
+	c.mu.Lock()
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	if err == nil && dc.findUnknown(name, lsm.EntryUnknownVolume) == nil {
+		err = lsm.ErrNoVolume
+	}
+	c.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = runCmd("/sbin/btrfs", "qgroup", "limit", strconv.FormatUint(size, 10), path)
-	if err != nil {
-		_ = removeSubvol(path)
+	// the data is already there, so the capacity is not checked
+	if err := dc.driver.SetLimit(ctx, dc.volumePath(name), dc.limit(size)); err != nil {
 		return nil, err
 	}
 
-	if noCow {
-		f, err := os.OpenFile(path, os.O_RDONLY, 0666)
-		if err == nil {
-			defer func() { _ = f.Close() }()
-			err = chattr.SetAttr(f, chattr.FS_NOCOW_FL)
-		}
-
-		if err != nil {
-			_ = removeSubvol(path)
-			return nil, err
+	meta, err := dc.readMeta(name)
+	if err != nil {
+		btrfsLogger.Info("Warning: error reading volume metadata", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
+	}
+	if meta == nil {
+		meta = &lsm.VolumeMeta{Name: name, DeviceClass: dc.Name}
+	}
+	meta.Size = size
+	dc.saveMeta(meta)
+	if dc.Qgroup != 0 {
+		// reconcileGroups assigns the volume on the next config load
+		if err := dc.driver.(lsm.GroupDriver).AssignGroup(ctx, dc.volumePath(name), dc.Qgroup); err != nil {
+			btrfsLogger.Info("Warning: error assigning volume to group", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
 		}
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dc.Unknown = slices.DeleteFunc(dc.Unknown, func(e *lsm.UnknownEntry) bool { return e.Name == name })
+	v := &lsm.LogicalVolume{Name: name, DeviceClass: dc.Name, Size: size, Meta: meta}
 	dc.Volumes = append(dc.Volumes, v)
 
 	c.notify()
@@ -142,191 +773,341 @@ func (c *btrfs) CreateLV(name, deviceClass string, noCow bool, size uint64) (*ls
 	return v, nil
 }
 
-func (c *btrfs) CreateLVSnapshot(name, deviceClass, sourceVolID string, size uint64, accessType string) (*lsm.LogicalVolume, error) {
-	btrfsLogger.Info("CreateLVSNapshot", "Name", name, "DeviceClass", deviceClass, "Size", size, "sourceVolID", sourceVolID, "accessType", accessType)
+func (c *btrfs) RemoveStale(ctx context.Context) (int, error) {
+	btrfsLogger.Info("RemoveStale called")
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	dcs := slices.Clone(c.deviceClasses)
+	c.mu.Unlock()
 
-	dc := c.findDeviceClass(deviceClass)
-	if dc == nil {
-		return nil, lsm.ErrNoDeviceClass
-	}
+	removed := 0
+	for _, dc := range dcs {
+		if dc.Err != nil {
+			continue
+		}
 
-	v := &lsm.LogicalVolume{Name: name, DeviceClass: dc.Name, Size: size}
-	path := c.GetPath(v)
+		c.removeStaleMeta(dc)
 
-	sv := &lsm.LogicalVolume{Name: sourceVolID, DeviceClass: dc.Name, Size: size}
-	srcPath := c.GetPath(sv)
+		sd, ok := dc.driver.(lsm.StaleDriver)
+		if !ok {
+			continue
+		}
 
-	args := []string{"subvol", "snapshot"}
-	if accessType == "ro" {
-		args = append(args, "-r")
+		n, err := sd.RemoveStale(ctx, dc.Path)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
 	}
-	args = append(args, srcPath, path)
 
-	_, err := runCmd("/sbin/btrfs", args...)
-	if err != nil {
-		return nil, err
-	}
+	return removed, nil
+}
 
-	_, err = runCmd("/sbin/btrfs", "qgroup", "limit", strconv.FormatUint(size, 10), path)
+// removeStaleMeta removes metadata records of volumes which do not exist.
+// Records of volumes without a limit are kept, they are needed to adopt such volumes.
+func (c *btrfs) removeStaleMeta(dc *deviceClass) {
+	names, err := dc.metaNames()
 	if err != nil {
-		_ = removeSubvol(path)
-		return nil, err
+		btrfsLogger.Info("Warning: error listing volume metadata", "DeviceClass", dc.Name, "Err", err.Error())
+		return
 	}
 
-	dc.Volumes = append(dc.Volumes, v)
-
-	c.notify()
+	for _, name := range names {
+		c.volumeLock.LockByID(name)
 
-	return v, nil
-}
+		c.mu.Lock()
+		stale := dc.findVolume(name) == nil && dc.findUnknown(name, lsm.EntryUnknownVolume) == nil
+		c.mu.Unlock()
 
-func removeSubvol(path string) error {
-	_, _, subvolId, err := parseSubvolume(path)
-	if err != nil {
-		btrfsLogger.Info("Error parsing subvolume info", "Err", err.Error(), "Path", path)
-		return err
-	}
+		if stale {
+			if err := dc.removeMeta(name); err != nil {
+				btrfsLogger.Info("Warning: error removing volume metadata", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
+			} else {
+				btrfsLogger.Info("Removed stale volume metadata", "DeviceClass", dc.Name, "Name", name)
+			}
+		}
 
-	_, err = runCmd("/sbin/btrfs", "qgroup", "destroy", "0/"+strconv.FormatUint(subvolId, 10), path)
-	if err != nil {
-		btrfsLogger.Info("Warning: error on qgroup destroy", "Err", err.Error(), "Path", path)
+		c.volumeLock.UnlockByID(name)
 	}
+}
 
-	_, err = runCmd("/sbin/btrfs", "subvol", "delete", "-c", path)
-	if err != nil {
-		btrfsLogger.Info("Error on subvol delete", "Err", err.Error(), "Path", path)
-		return err
+func (c *btrfs) findDeviceClass(name string) *deviceClass {
+	for _, d := range c.deviceClasses {
+		if name == d.Name || (name == "" && d.Default) {
+			return d
+		}
 	}
 
 	return nil
 }
 
-func (c *btrfs) RemoveLV(name, deviceClass string) error {
-	btrfsLogger.Info("RemoveLV", "Name", name, "DeviceClass", deviceClass)
+// findHealthyDeviceClass returns the device class or an error if it does not exist or is unhealthy.
+func (c *btrfs) findHealthyDeviceClass(name string) (*deviceClass, error) {
+	dc := c.findDeviceClass(name)
+	if dc == nil {
+		return nil, lsm.ErrNoDeviceClass
+	}
+	if dc.Err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", lsm.ErrUnhealthy, dc.Name, dc.Err)
+	}
+
+	return dc, nil
+}
 
+// findVolume returns the volume of a healthy device class.
+func (c *btrfs) findVolume(deviceClass, name string) (*deviceClass, *lsm.LogicalVolume, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	dc := c.findDeviceClass(deviceClass)
-	if dc == nil {
-		return lsm.ErrNoDeviceClass
+	dc, err := c.findHealthyDeviceClass(deviceClass)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	v := dc.findVolume(name)
 	if v == nil {
-		return lsm.ErrNoVolume
+		return nil, nil, lsm.ErrNoVolume
 	}
 
-	path := c.GetPath(v)
+	return dc, v, nil
+}
 
-	if err := removeSubvol(path); err != nil {
-		return err
+// fsUsage is the filesystem state needed for device class stats, it is collected without holding the lock.
+type fsUsage struct {
+	// fs is the filesystem space in CapacityFilesystem mode, nil otherwise.
+	fs *lsm.PoolStats
+	// exclusive is the exclusive usage by volume name in AccountingExclusive mode, nil otherwise.
+	exclusive map[string]uint64
+	err       error
+}
+
+func (c *btrfs) fsUsage(ctx context.Context, dc *deviceClass) *fsUsage {
+	u := &fsUsage{}
+	if dc.Err != nil {
+		return u
 	}
 
-	dc.removeVolume(name)
+	c.mu.Lock()
+	capacity := dc.Capacity
+	accounting := dc.Accounting
+	var names []string
+	if accounting == AccountingExclusive {
+		for _, v := range dc.Volumes {
+			names = append(names, v.Name)
+		}
+	}
+	c.mu.Unlock()
 
-	c.notify()
+	if capacity == CapacityFilesystem {
+		u.fs, u.err = dc.driver.PoolStats(ctx, dc.Path)
+		if u.err != nil {
+			btrfsLogger.Info("Error reading filesystem usage", "DeviceClass", dc.Name, "Err", u.err.Error())
+			return u
+		}
+	}
 
-	return nil
+	if accounting == AccountingExclusive {
+		u.exclusive = make(map[string]uint64)
+		for _, name := range names {
+			info, err := dc.driver.VolumeInfo(ctx, dc.volumePath(name))
+			if err != nil {
+				// the volume may be removed concurrently, its limit is used then
+				btrfsLogger.Info("Error reading volume info", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
+				continue
+			}
+			u.exclusive[name] = info.Exclusive
+		}
+	}
+
+	return u
 }
 
-func (c *btrfs) ResizeLV(name, deviceClass string, size uint64) error {
-	btrfsLogger.Info("ResizeLV", "Name", name, "DeviceClass", deviceClass, "Size", size)
+// reserve checks that size more bytes fit into the device class and reserves them for the volume
+// until the pending entry is deleted.
+func (c *btrfs) reserve(ctx context.Context, dc *deviceClass, name string, size uint64) error {
+	u := c.fsUsage(ctx, dc)
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	dc := c.findDeviceClass(deviceClass)
-	if dc == nil {
-		return lsm.ErrNoDeviceClass
+	if err := dc.checkCapacity(size, u); err != nil {
+		return err
 	}
 
-	v := dc.findVolume(name)
-	if v == nil {
-		return lsm.ErrNoVolume
-	}
+	dc.pending[name] = size
 
-	path := c.GetPath(v)
+	return nil
+}
 
-	_, err := runCmd("/sbin/btrfs", "qgroup", "limit", strconv.FormatUint(size, 10), path)
-	if err != nil {
-		return err
+// stats returns the device class stats with overcommit and spare space applied.
+func (d *deviceClass) stats(u *fsUsage) *lsm.DeviceClassStats {
+	var used uint64 = 0
+	for _, v := range d.Volumes {
+		if excl, ok := u.exclusive[v.Name]; ok {
+			used += excl
+		} else {
+			used += v.Size
+		}
+	}
+	for _, size := range d.pending {
+		used += size
 	}
 
-	v.Size = size
+	s := &lsm.DeviceClassStats{VolumeStats: lsm.VolumeStats{TotalBytes: d.Size, UsedBytes: used}, DeviceClass: d.Name, Err: d.Err}
+	if d.Err == nil && d.Capacity == CapacityFilesystem {
+		if u.err != nil {
+			s.Err = u.err
+		} else if u.fs != nil {
+			fs := *u.fs
+			if s.TotalBytes == 0 {
+				s.TotalBytes = fs.SizeBytes
+			}
+			spare := fs.SizeBytes / 100 * uint64(d.Spare)
+			if fs.FreeBytes > spare {
+				fs.FreeBytes -= spare
+			} else {
+				fs.FreeBytes = 0
+			}
+			s.Filesystem = &fs
+		}
+	}
 
-	c.notify()
+	s.TotalBytes = uint64(float64(s.TotalBytes) * d.OvercommitRatio * float64(100-d.Spare) / 100)
 
-	return nil
+	return s
 }
 
-func (c *btrfs) GetPath(v *lsm.LogicalVolume) string {
-	return filepath.Join(c.poolPath, v.DeviceClass, v.Name)
+// checkCapacity returns lsm.ExhaustedError if additional size bytes do not fit into the device class.
+func (d *deviceClass) checkCapacity(size uint64, u *fsUsage) error {
+	s := d.stats(u)
+	if s.Err != nil {
+		return s.Err
+	}
+
+	if available := s.AvailableBytes(); size > available {
+		return &lsm.ExhaustedError{DeviceClass: d.Name, Requested: size, Available: available}
+	}
+
+	return nil
 }
 
-func (c *btrfs) VolumeStats(name, deviceClass string) (*lsm.VolumeStats, error) {
-	btrfsLogger.Info("VolumeStats", "Name", name, "DeviceClass", deviceClass)
+func (d *deviceClass) limit(size uint64) lsm.Limit {
+	return lsm.Limit{Size: size, Mode: d.QuotaMode}
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// quotaMode returns the effective quota mode of a volume, empty mode is the mode of the device class.
+func (d *deviceClass) quotaMode(mode lsm.QuotaMode) lsm.QuotaMode {
+	if mode == "" {
+		return d.QuotaMode
+	}
+	return mode
+}
 
-	dc := c.findDeviceClass(deviceClass)
-	if dc == nil {
-		return nil, lsm.ErrNoDeviceClass
+// volumeLimit returns the limit of an existing volume, the volume may have its own quota mode.
+func (d *deviceClass) volumeLimit(meta *lsm.VolumeMeta, size uint64) lsm.Limit {
+	if meta == nil {
+		return d.limit(size)
 	}
+	return lsm.Limit{Size: size, Mode: d.quotaMode(meta.QuotaMode)}
+}
 
-	v := dc.findVolume(name)
-	if v == nil {
-		return nil, lsm.ErrNoVolume
+// assignGroup adds the new volume to the group of the device class, the volume is removed on failure.
+func (d *deviceClass) assignGroup(ctx context.Context, name string) error {
+	if d.Qgroup == 0 {
+		return nil
 	}
 
-	path := c.GetPath(v)
-	limit, used, _, err := parseSubvolume(path)
+	err := d.driver.(lsm.GroupDriver).AssignGroup(ctx, d.volumePath(name), d.Qgroup)
 	if err != nil {
-		btrfsLogger.Info("Error parsing subvolume info", "DeviceClass", dc.Name, "Name", name, "Err", err.Error())
-		return nil, err
+		btrfsLogger.Info("Error assigning volume to group", "DeviceClass", d.Name, "Name", name, "Err", err.Error())
+		if err := d.driver.RemoveVolume(ctx, d.volumePath(name)); err != nil {
+			btrfsLogger.Info("Warning: error on volume remove", "DeviceClass", d.Name, "Name", name, "Err", err.Error())
+		}
+		return err
 	}
 
-	return &lsm.VolumeStats{TotalBytes: limit, UsedBytes: used}, nil
+	return nil
 }
 
-func (c *btrfs) NodeStats() (*lsm.NodeStats, error) {
-	btrfsLogger.Info("NodeStats called")
+// receive restores the read-only snapshot from r in a temporary directory and creates the volume as
+// a writable snapshot of it, the received snapshot is removed then.
+func (d *deviceClass) receive(ctx context.Context, sd lsm.StreamDriver, name string, size uint64, r io.Reader) error {
+	dir := filepath.Join(d.Path, metaDir, "receive", name)
+	if err := d.removeReceived(ctx, dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err := d.removeReceived(ctx, dir); err != nil {
+			btrfsLogger.Info("Warning: error removing received snapshot", "DeviceClass", d.Name, "Name", name, "Err", err.Error())
+		}
+	}()
 
-	var defaultDc *lsm.DeviceClassStats
-	var stats []*lsm.DeviceClassStats
+	path, err := sd.Receive(ctx, dir, r)
+	if err != nil {
+		return err
+	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return d.driver.CreateSnapshot(ctx, path, d.volumePath(name), d.limit(size), false)
+}
 
-	for _, dc := range c.deviceClasses {
-		var used uint64 = 0
-		for _, v := range dc.Volumes {
-			used += v.Size
-		}
-		s := &lsm.DeviceClassStats{VolumeStats: lsm.VolumeStats{TotalBytes: dc.Size, UsedBytes: used}, DeviceClass: dc.Name}
-		stats = append(stats, s)
-		if dc.Default {
-			defaultDc = s
+// removeReceived removes the directory of a received snapshot, the snapshot may be left by an aborted receive.
+func (d *deviceClass) removeReceived(ctx context.Context, dir string) error {
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := d.driver.RemoveVolume(ctx, filepath.Join(dir, file.Name())); err != nil {
+			return err
 		}
 	}
 
-	return &lsm.NodeStats{DeviceClasses: stats, Default: defaultDc}, nil
+	return os.Remove(dir)
 }
 
-func (c *btrfs) findDeviceClass(name string) *deviceClass {
-	for _, d := range c.deviceClasses {
-		if name == d.Name || (name == "" && d.Default) {
-			return d
+// incrementalDir is the directory of snapshots taken or received by incremental passes, they are named by the pass.
+func (d *deviceClass) incrementalDir(name string) string {
+	return filepath.Join(d.Path, metaDir, "incremental", name)
+}
+
+func (d *deviceClass) incrementalPath(name string, pass int) string {
+	return filepath.Join(d.incrementalDir(name), strconv.Itoa(pass))
+}
+
+// removeIncremental removes snapshots of passes which match.
+func (d *deviceClass) removeIncremental(ctx context.Context, name string, match func(pass int) bool) error {
+	files, err := os.ReadDir(d.incrementalDir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		pass, err := strconv.Atoi(file.Name())
+		if err != nil || !match(pass) {
+			continue
+		}
+		if err := d.driver.RemoveVolume(ctx, filepath.Join(d.incrementalDir(name), file.Name())); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+func (d *deviceClass) volumePath(name string) string {
+	return filepath.Join(d.Path, name)
+}
+
 func (d *deviceClass) findVolume(name string) *lsm.LogicalVolume {
 	for _, v := range d.Volumes {
 		if name == v.Name {
@@ -337,6 +1118,16 @@ func (d *deviceClass) findVolume(name string) *lsm.LogicalVolume {
 	return nil
 }
 
+func (d *deviceClass) findUnknown(name string, kind lsm.EntryKind) *lsm.UnknownEntry {
+	for _, e := range d.Unknown {
+		if name == e.Name && kind == e.Kind {
+			return e
+		}
+	}
+
+	return nil
+}
+
 func (d *deviceClass) removeVolume(name string) {
 	var vs []*lsm.LogicalVolume
 	for _, v := range d.Volumes {
@@ -361,13 +1152,21 @@ func (c *btrfs) Start(ctx context.Context) error {
 	}
 
 	// reload config after watcher is enabled
-	c.loadConfig()
+	c.loadConfig(ctx)
+
+	// unhealthy device classes may become healthy, i.e. when filesystem is mounted later
+	ticker := time.NewTicker(unhealthyRecheckInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			btrfsLogger.Info("Finishing")
 			return nil
+		case <-ticker.C:
+			if c.hasUnhealthy() {
+				c.loadConfig(ctx)
+			}
 		case event, ok := <-w.Events:
 			if !ok {
 				btrfsLogger.Error(nil, "Not OK on fs event")
@@ -378,7 +1177,7 @@ func (c *btrfs) Start(ctx context.Context) error {
 
 			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
 				if filepath.Base(event.Name) == configFile {
-					c.loadConfig()
+					c.loadConfig(ctx)
 				}
 			}
 		case err, ok := <-w.Errors:
@@ -391,147 +1190,221 @@ func (c *btrfs) Start(ctx context.Context) error {
 	}
 }
 
-func (c *btrfs) loadConfig() {
+// loadConfig applies the config file.
+// The config is applied as a whole, current device classes are kept if it is invalid.
+func (c *btrfs) loadConfig(ctx context.Context) {
 	btrfsLogger.Info("Loading config")
 
-	b, err := os.ReadFile(filepath.Join(c.poolPath, configFile))
+	err := c.applyConfig(ctx)
+
+	c.mu.Lock()
+	c.config.Err = err
 	if err != nil {
-		btrfsLogger.Info("Error loading config file", "Err", err.Error())
-		return
+		c.config.Errors++
 	}
+	c.mu.Unlock()
+
+	c.notify()
 
-	cnf := &config{}
-	err = yaml.Unmarshal(b, &cnf)
 	if err != nil {
-		btrfsLogger.Info("Error parsing config", "Err", err.Error())
+		btrfsLogger.Info("Error loading config", "Err", err.Error())
 		return
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	dcMap := make(map[string]bool)
-	var dcs []*deviceClass
-	for _, dcc := range cnf.DeviceClasses {
-		dc := (*deviceClass)(nil)
-		for _, d := range c.deviceClasses {
-			if d.Name == dcc.Name {
-				dc = d
-				break
-			}
-		}
+	btrfsLogger.Info("Config loaded")
 
-		if dc == nil {
-			btrfsLogger.Info("Adding device class", "DeviceClass", dcc.Name)
+	if !c.scanOnly {
+		c.reconcileGroups(ctx)
+	}
+}
 
-			files, err := os.ReadDir(filepath.Join(c.poolPath, dcc.Name))
-			if err != nil {
-				btrfsLogger.Error(err, "Error listing device class path", "DeviceClass", dcc.Name)
-				return
-			}
+func (c *btrfs) applyConfig(ctx context.Context) error {
+	b, err := os.ReadFile(filepath.Join(c.poolPath, configFile))
+	if err != nil {
+		return err
+	}
 
-			var volumes []*lsm.LogicalVolume
-			for _, file := range files {
-				limit, _, _, err := parseSubvolume(filepath.Join(c.poolPath, dcc.Name, file.Name()))
-				if err != nil {
-					btrfsLogger.Info("Error parsing subvolume info", "DeviceClass", dcc.Name, "Path", file.Name(), "Err", err.Error())
-					return
-				}
-				if limit == 0 {
-					btrfsLogger.Info("Error: subvolume limit is undefined", "DeviceClass", dcc.Name, "Path", file.Name())
-					return
-				}
+	dcs, err := c.parseConfig(b)
+	if err != nil {
+		return err
+	}
 
-				volumes = append(volumes, &lsm.LogicalVolume{Name: file.Name(), Size: limit, DeviceClass: dcc.Name})
-			}
+	c.mu.Lock()
+	err = c.checkConfig(dcs)
+	current := make(map[string]*deviceClass)
+	for _, d := range c.deviceClasses {
+		current[d.Name] = d
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
-			dc = &deviceClass{Name: dcc.Name, Volumes: volumes}
+	// filesystem checks of new and unhealthy device classes are done without holding the lock
+	created := make(map[string]*deviceClass)
+	for _, dc := range dcs {
+		if cur := current[dc.Name]; cur != nil && cur.Err == nil {
+			continue
 		}
 
-		dcs = append(dcs, dc)
-		dcMap[dc.Name] = true
+		btrfsLogger.Info("Adding device class", "DeviceClass", dc.Name, "Type", dc.Type, "Path", dc.Path)
 
-		dc.Default = dcc.Default
-		size, err := resource.ParseQuantity(dcc.Size)
+		created[dc.Name], err = c.newDeviceClass(ctx, dc)
 		if err != nil {
-			btrfsLogger.Info("Can't parse size", "DeviceClass", dcc.Name, "Size", dcc.Size, "Err", err.Error())
-			return
+			return fmt.Errorf("device class %s: %w", dc.Name, err)
 		}
-		dc.Size = uint64(size.Value())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// volumes may be created while the lock is released
+	if err := c.checkConfig(dcs); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	var result []*deviceClass
+	for _, dc := range dcs {
+		names[dc.Name] = true
+
+		d := created[dc.Name]
+		if d == nil {
+			d = current[dc.Name]
+			d.apply(dc)
+		}
+		result = append(result, d)
 	}
 
 	for _, d := range c.deviceClasses {
-		if !dcMap[d.Name] {
+		if !names[d.Name] {
 			btrfsLogger.Info("Removing device class", "DeviceClass", d.Name)
 		}
 	}
 
-	c.deviceClasses = dcs
-
-	c.notify()
+	c.deviceClasses = result
 
-	btrfsLogger.Info("Config loaded")
+	return nil
 }
 
-func parseSubvolume(path string) (uint64, uint64, uint64, error) {
-	out, err := runCmd("/sbin/btrfs", "subvol", "show", "--raw", path)
-	if err != nil {
-		return 0, 0, 0, err
+// reconcileGroups applies the size limit to the group of each device class and adds all volumes to it.
+// Volumes created before the group was enabled or by an interrupted CreateLV are assigned here.
+func (c *btrfs) reconcileGroups(ctx context.Context) {
+	type group struct {
+		dc    *deviceClass
+		size  uint64
+		names []string
 	}
 
-	var limit uint64 = 0
-	var used uint64 = 0
-	var volId uint64 = 0
-
-	for _, line := range strings.Split(out, "\n") {
-		err = nil
-		var name string
-		if m := limitRegexp.FindStringSubmatch(line); m != nil {
-			limit, err = strconv.ParseUint(m[1], 10, 64)
-			name = "limit"
-		} else if m := usageRegexp.FindStringSubmatch(line); m != nil {
-			used, err = strconv.ParseUint(m[1], 10, 64)
-			name = "usage"
-		} else if m := subvolRegexp.FindStringSubmatch(line); m != nil {
-			volId, err = strconv.ParseUint(m[1], 10, 64)
-			name = "subvolId"
+	var groups []group
+	c.mu.Lock()
+	for _, dc := range c.deviceClasses {
+		if dc.Err != nil || dc.Qgroup == 0 {
+			continue
 		}
-
-		if err != nil {
-			btrfsLogger.Info("Parse error", "Name", name, "Err", err.Error())
-			return 0, 0, 0, errParseInfo
+		g := group{dc: dc, size: dc.Size}
+		for _, v := range dc.Volumes {
+			g.names = append(g.names, v.Name)
 		}
+		groups = append(groups, g)
 	}
+	c.mu.Unlock()
+
+	for _, g := range groups {
+		gd := g.dc.driver.(lsm.GroupDriver)
+
+		// the group limits all data of the device class, so shared extents are counted once
+		limit := lsm.Limit{Size: g.size, Mode: lsm.QuotaReferenced}
+		if err := gd.SetGroupLimit(ctx, g.dc.Path, g.dc.Qgroup, limit); err != nil {
+			btrfsLogger.Info("Error setting group limit", "DeviceClass", g.dc.Name, "Qgroup", g.dc.Qgroup, "Err", err.Error())
+			continue
+		}
 
-	if volId == 0 {
-		btrfsLogger.Info("No VolumeID", "Path", path)
-		return 0, 0, 0, errParseInfo
+		for _, name := range g.names {
+			// the volume may be removed concurrently, so errors are only logged
+			if err := gd.AssignGroup(ctx, g.dc.volumePath(name), g.dc.Qgroup); err != nil {
+				btrfsLogger.Info("Error assigning volume to group", "DeviceClass", g.dc.Name, "Name", name, "Err", err.Error())
+			}
+		}
 	}
+}
+
+func (c *btrfs) hasUnhealthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return limit, used, volId, nil
+	for _, dc := range c.deviceClasses {
+		if dc.Err != nil {
+			return true
+		}
+	}
+	return false
 }
 
-func runCmd(cmd string, args ...string) (string, error) {
-	c := exec.Command(cmd, args...)
-	c.Stderr = c.Stdout
+// newDeviceClass checks the device class filesystem and reads existing volumes.
+// Device class which fails the check is returned with Err set.
+func (c *btrfs) newDeviceClass(ctx context.Context, cnf *deviceClass) (*deviceClass, error) {
+	name, fsType, path := cnf.Name, cnf.Type, cnf.Path
+	dc := &deviceClass{Name: name, Type: fsType, Path: path, QuotaMode: cnf.QuotaMode, Qgroup: cnf.Qgroup, pending: make(map[string]uint64)}
+	dc.apply(cnf)
 
-	stdout, err := c.StdoutPipe()
+	driver, err := c.drivers.Driver(fsType)
 	if err != nil {
-		return "", err
+		btrfsLogger.Info("Error: unsupported device class type", "DeviceClass", name, "Err", err.Error())
+		dc.Err = err
+		return dc, nil
 	}
-	if err := c.Start(); err != nil {
-		return "", err
+	dc.driver = driver
+
+	if _, ok := driver.(lsm.GroupDriver); dc.Qgroup != 0 && !ok {
+		btrfsLogger.Info("Error: qgroup is not supported by device class type", "DeviceClass", name, "Type", fsType)
+		dc.Err = fmt.Errorf("qgroup: %w", lsm.ErrNotSupported)
+		return dc, nil
 	}
-	out, err := io.ReadAll(stdout)
-	if err != nil {
-		return "", err
+
+	if err := driver.CheckPool(ctx, path); err != nil {
+		btrfsLogger.Info("Error: device class is unhealthy", "DeviceClass", name, "Path", path, "Err", err.Error())
+		dc.Err = err
+		return dc, nil
 	}
-	if err := c.Wait(); err != nil {
-		return "", err
+
+	files, err := os.ReadDir(path)
+	if err != nil {
+		btrfsLogger.Error(err, "Error listing device class path", "DeviceClass", name)
+		return nil, err
 	}
-	if c.ProcessState.ExitCode() != 0 {
-		btrfsLogger.Info("Exit code is non-zero", "ExitCode", c.ProcessState.ExitCode(), "Cmd", cmd, "Args", args)
-		return "", errExec
+
+	for _, file := range files {
+		if file.Name() == metaDir {
+			continue
+		}
+
+		entry := &lsm.UnknownEntry{Name: file.Name(), DeviceClass: name}
+		if !file.IsDir() {
+			entry.Kind = lsm.EntryFile
+		} else {
+			info, err := driver.VolumeInfo(ctx, filepath.Join(path, file.Name()))
+			switch {
+			case errors.Is(err, lsm.ErrNotVolume):
+				entry.Kind = lsm.EntryDirectory
+			case err != nil:
+				btrfsLogger.Info("Error reading volume info", "DeviceClass", name, "Path", file.Name(), "Err", err.Error())
+				return nil, err
+			case info.Limit.Size == 0:
+				entry.Kind = lsm.EntryUnknownVolume
+			default:
+				meta, err := dc.readMeta(file.Name())
+				if err != nil {
+					btrfsLogger.Info("Warning: error reading volume metadata", "DeviceClass", name, "Name", file.Name(), "Err", err.Error())
+				}
+				dc.Volumes = append(dc.Volumes, &lsm.LogicalVolume{Name: file.Name(), Size: info.Limit.Size, DeviceClass: name, Meta: meta})
+				continue
+			}
+		}
+
+		btrfsLogger.Info("Warning: unknown entry in device class directory", "DeviceClass", name, "Name", file.Name(), "Kind", entry.Kind)
+		dc.Unknown = append(dc.Unknown, entry)
 	}
-	return string(out), nil
+
+	return dc, nil
 }
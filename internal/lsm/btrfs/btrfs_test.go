@@ -0,0 +1,278 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kvaster/topols/internal/lock"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc/codes"
+)
+
+func TestDeviceClassCapacity(t *testing.T) {
+	dc := &deviceClass{
+		Name:            "ssd",
+		Size:            100,
+		Capacity:        CapacityConfigured,
+		OvercommitRatio: 1.5,
+		Spare:           10,
+		Volumes:         []*lsm.LogicalVolume{{Name: "a", Size: 100}},
+	}
+
+	s := dc.stats(&fsUsage{})
+	if s.TotalBytes != 135 {
+		t.Errorf("total should be 135: %d", s.TotalBytes)
+	}
+	if s.AvailableBytes() != 35 {
+		t.Errorf("available should be 35: %d", s.AvailableBytes())
+	}
+	if err := dc.checkCapacity(35, &fsUsage{}); err != nil {
+		t.Errorf("35 bytes should fit: %v", err)
+	}
+	if err := dc.checkCapacity(36, &fsUsage{}); !errors.Is(err, lsm.ErrExhausted) {
+		t.Errorf("36 bytes should not fit: %v", err)
+	}
+
+	dc.Capacity = CapacityFilesystem
+	s = dc.stats(&fsUsage{fs: &lsm.PoolStats{SizeBytes: 1000, FreeBytes: 120}})
+	if s.Filesystem.FreeBytes != 20 {
+		t.Errorf("filesystem free should be 20: %d", s.Filesystem.FreeBytes)
+	}
+	if s.AvailableBytes() != 20 {
+		t.Errorf("available should be 20: %d", s.AvailableBytes())
+	}
+
+	fsErr := errors.New("statfs error")
+	if err := dc.checkCapacity(1, &fsUsage{err: fsErr}); !errors.Is(err, fsErr) {
+		t.Errorf("filesystem error should be returned: %v", err)
+	}
+
+	dc.Capacity = CapacityConfigured
+	dc.Accounting = AccountingExclusive
+	s = dc.stats(&fsUsage{exclusive: map[string]uint64{"a": 30}})
+	if s.UsedBytes != 30 {
+		t.Errorf("used should be 30: %d", s.UsedBytes)
+	}
+	if s.AvailableBytes() != 105 {
+		t.Errorf("available should be 105: %d", s.AvailableBytes())
+	}
+}
+
+func TestGroupNotSupported(t *testing.T) {
+	c := &btrfs{drivers: lsm.DriverRegistry{lsm.DefaultFsType: &blockingDriver{}}}
+
+	dc, err := c.newDeviceClass(context.Background(), &deviceClass{Name: "ssd", Path: t.TempDir(), QuotaMode: lsm.QuotaReferenced, Qgroup: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(dc.Err, lsm.ErrNotSupported) {
+		t.Errorf("device class should be unhealthy: %v", dc.Err)
+	}
+}
+
+type blockingDriver struct {
+	lsm.Driver
+	removeStarted chan struct{}
+	removeRelease chan struct{}
+}
+
+func (d *blockingDriver) RemoveVolume(ctx context.Context, path string) error {
+	close(d.removeStarted)
+	<-d.removeRelease
+	return nil
+}
+
+func (d *blockingDriver) VolumeInfo(ctx context.Context, path string) (*lsm.VolumeInfo, error) {
+	return &lsm.VolumeInfo{Limit: lsm.Limit{Size: 10, Mode: lsm.QuotaReferenced}, Referenced: 1, Exclusive: 1}, nil
+}
+
+func TestSlowRemoveDoesNotBlockStats(t *testing.T) {
+	d := &blockingDriver{removeStarted: make(chan struct{}), removeRelease: make(chan struct{})}
+	c := &btrfs{
+		volumeLock: lock.NewLockWithID(),
+		deviceClasses: []*deviceClass{{
+			Name:            "ssd",
+			Size:            100,
+			Capacity:        CapacityConfigured,
+			OvercommitRatio: 1,
+			Volumes:         []*lsm.LogicalVolume{{Name: "a", Size: 10}, {Name: "b", Size: 10}},
+			pending:         make(map[string]uint64),
+			driver:          d,
+		}},
+	}
+
+	removed := make(chan error)
+	go func() {
+		removed <- c.RemoveLV(context.Background(), "a", "ssd")
+	}()
+	<-d.removeStarted
+
+	if _, err := c.VolumeStats(context.Background(), "b", "ssd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.NodeStats(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	close(d.removeRelease)
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, _ := c.GetLVList(context.Background(), "ssd")
+	if len(volumes) != 1 || volumes[0].Name != "b" {
+		t.Errorf("only volume b should remain: %v", volumes)
+	}
+}
+
+// scanDriver reports directories named "plain" as regular directories and "raw" as a volume without a limit.
+type scanDriver struct {
+	staticDriver
+	limits map[string]lsm.Limit
+}
+
+func (d *scanDriver) VolumeInfo(ctx context.Context, path string) (*lsm.VolumeInfo, error) {
+	switch filepath.Base(path) {
+	case "plain":
+		return nil, lsm.ErrNotVolume
+	case "raw":
+		return &lsm.VolumeInfo{Limit: d.limits[path]}, nil
+	}
+	return d.staticDriver.VolumeInfo(ctx, path)
+}
+
+func (d *scanDriver) SetLimit(ctx context.Context, path string, limit lsm.Limit) error {
+	d.limits[path] = limit
+	return nil
+}
+
+func TestScanUnknownEntries(t *testing.T) {
+	path := t.TempDir()
+	for _, name := range []string{"vol", "plain", "raw"} {
+		if err := os.Mkdir(filepath.Join(path, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(path, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := &scanDriver{limits: make(map[string]lsm.Limit)}
+	c := &btrfs{drivers: lsm.DriverRegistry{lsm.DefaultFsType: driver}, volumeLock: lock.NewLockWithID()}
+	dc, err := c.newDeviceClass(context.Background(), &deviceClass{Name: "ssd", Type: lsm.DefaultFsType, Path: path, QuotaMode: lsm.QuotaReferenced})
+	if err != nil || dc.Err != nil {
+		t.Fatalf("device class should be loaded: %v, %v", err, dc.Err)
+	}
+	if len(dc.Volumes) != 1 || dc.Volumes[0].Name != "vol" {
+		t.Errorf("only vol should be adopted: %v", dc.Volumes)
+	}
+	c.deviceClasses = []*deviceClass{dc}
+
+	entries, err := c.UnknownEntries(context.Background(), "ssd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]lsm.EntryKind)
+	for _, e := range entries {
+		kinds[e.Name] = e.Kind
+	}
+	expected := map[string]lsm.EntryKind{"file": lsm.EntryFile, "plain": lsm.EntryDirectory, "raw": lsm.EntryUnknownVolume}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("unexpected unknown entries: %v", kinds)
+	}
+
+	if _, err := c.AdoptLV(context.Background(), "plain", "ssd", 100); !errors.Is(err, lsm.ErrNoVolume) {
+		t.Errorf("directory should not be adopted: %v", err)
+	}
+	v, err := c.AdoptLV(context.Background(), "raw", "ssd", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Size != 100 || driver.limits[filepath.Join(path, "raw")].Size != 100 {
+		t.Errorf("limit should be set to 100: %v", driver.limits)
+	}
+	if len(dc.Volumes) != 2 || len(dc.Unknown) != 2 {
+		t.Errorf("raw should be moved to volumes: %v, %v", dc.Volumes, dc.Unknown)
+	}
+}
+
+// optionsDriver records limits and options set on volumes.
+type optionsDriver struct {
+	dirDriver
+	limits  map[string]lsm.Limit
+	options map[string]lsm.VolumeOptions
+}
+
+func (d *optionsDriver) SetLimit(ctx context.Context, path string, limit lsm.Limit) error {
+	d.limits[filepath.Base(path)] = limit
+	return nil
+}
+
+func (d *optionsDriver) SetOptions(ctx context.Context, path string, opts lsm.VolumeOptions) error {
+	d.options[filepath.Base(path)] = opts
+	return nil
+}
+
+func TestModifyLV(t *testing.T) {
+	ctx := context.Background()
+	driver := &optionsDriver{limits: make(map[string]lsm.Limit), options: make(map[string]lsm.VolumeOptions)}
+	c := &btrfs{drivers: lsm.DriverRegistry{lsm.DefaultFsType: driver}, volumeLock: lock.NewLockWithID()}
+	dc, err := c.newDeviceClass(ctx, &deviceClass{Name: "ssd", Type: lsm.DefaultFsType, Path: t.TempDir(), Size: 100, OvercommitRatio: 1, QuotaMode: lsm.QuotaReferenced})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deviceClasses = []*deviceClass{dc}
+
+	if _, err := c.CreateLV(ctx, "a", "ssd", lsm.VolumeOptions{}, 10, lsm.VolumeOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := lsm.VolumeOptions{Compression: "zstd:3"}
+	if err := c.ModifyLV(ctx, "a", "ssd", opts, lsm.QuotaExclusive); err != nil {
+		t.Fatal(err)
+	}
+	if driver.options["a"] != opts {
+		t.Errorf("options should be set: %+v", driver.options["a"])
+	}
+	if driver.limits["a"] != (lsm.Limit{Size: 10, Mode: lsm.QuotaExclusive}) {
+		t.Errorf("limit should be exclusive: %+v", driver.limits["a"])
+	}
+	volumes, _ := c.GetLVList(ctx, "ssd")
+	if meta := volumes[0].Meta; meta.Options != opts || meta.QuotaMode != lsm.QuotaExclusive {
+		t.Errorf("metadata should be updated: %+v", meta)
+	}
+
+	// the mode of the volume is kept on resize
+	if err := c.ResizeLV(ctx, "a", "ssd", 20); err != nil {
+		t.Fatal(err)
+	}
+	if driver.limits["a"] != (lsm.Limit{Size: 20, Mode: lsm.QuotaExclusive}) {
+		t.Errorf("limit should stay exclusive: %+v", driver.limits["a"])
+	}
+
+	// only differences are applied
+	delete(driver.options, "a")
+	if err := c.ModifyLV(ctx, "a", "ssd", opts, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := driver.options["a"]; ok {
+		t.Error("unchanged options should not be set")
+	}
+	if driver.limits["a"] != (lsm.Limit{Size: 20, Mode: lsm.QuotaReferenced}) {
+		t.Errorf("limit should be reset to the mode of the device class: %+v", driver.limits["a"])
+	}
+
+	if err := c.ModifyLV(ctx, "a", "ssd", lsm.VolumeOptions{NoCow: true, Compression: "zstd"}, ""); lsm.ErrorCode(err) != codes.InvalidArgument {
+		t.Errorf("invalid options should be rejected: %v", err)
+	}
+
+	// drivers without OptionsDriver can't change options
+	dc.driver = &dirDriver{}
+	if err := c.ModifyLV(ctx, "a", "ssd", lsm.VolumeOptions{}, ""); !errors.Is(err, lsm.ErrNotSupported) {
+		t.Errorf("options should not be supported: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package btrfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc/codes"
+)
+
+var limitRegexp = regexp.MustCompile(`\s*Limit referenced:\s*(\d+)\s*`)
+var limitExclRegexp = regexp.MustCompile(`\s*Limit exclusive:\s*(\d+)\s*`)
+var usageRegexp = regexp.MustCompile(`\s*Usage referenced:\s*(\d+)\s*`)
+var usageExclRegexp = regexp.MustCompile(`\s*Usage exclusive:\s*(\d+)\s*`)
+var subvolRegexp = regexp.MustCompile(`\s*Subvolume ID:\s*(\d+)\s*`)
+var deviceSizeRegexp = regexp.MustCompile(`^\s*Device size:\s*(\d+)\s*`)
+var dataRatioRegexp = regexp.MustCompile(`^\s*Data ratio:\s*([\d.]+)\s*`)
+var staleQgroupRegexp = regexp.MustCompile(`^\s*(0/\d+)\s.*<stale>\s*$`)
+var freeRegexp = regexp.MustCompile(`^\s*Free \(estimated\):\s*(\d+)\s*`)
+
+var errParseInfo = errors.New("error parsing info")
+var errExec = errors.New("execute error")
+
+// cmdTimeout limits the time of a single btrfs-progs command.
+const cmdTimeout = 5 * time.Minute
+
+// cliErrorCodes maps btrfs-progs error messages to gRPC codes.
+var cliErrorCodes = []struct {
+	msg  string
+	code codes.Code
+}{
+	{"No space left on device", codes.ResourceExhausted},
+	{"Disk quota exceeded", codes.ResourceExhausted},
+	{"File exists", codes.AlreadyExists},
+	{"No such file or directory", codes.NotFound},
+	{"quota not enabled", codes.FailedPrecondition},
+	{"quotas not enabled", codes.FailedPrecondition},
+	{"Read-only file system", codes.FailedPrecondition},
+	{"not a btrfs filesystem", codes.FailedPrecondition},
+}
+
+// cliBackend implements backend with btrfs-progs.
+type cliBackend struct{}
+
+func (b *cliBackend) createSubvolume(ctx context.Context, path string) error {
+	_, err := runCmd(ctx, "/sbin/btrfs", "subvol", "create", path)
+	return err
+}
+
+func (b *cliBackend) createSnapshot(ctx context.Context, srcPath, path string, readOnly bool) error {
+	args := []string{"subvol", "snapshot"}
+	if readOnly {
+		args = append(args, "-r")
+	}
+	args = append(args, srcPath, path)
+
+	_, err := runCmd(ctx, "/sbin/btrfs", args...)
+	return err
+}
+
+func (b *cliBackend) removeSubvolume(ctx context.Context, path string) error {
+	sv, err := b.subvolumeInfo(ctx, path)
+	if err != nil {
+		btrfsLogger.Info("Error parsing subvolume info", "Err", err.Error(), "Path", path)
+		return err
+	}
+
+	_, err = runCmd(ctx, "/sbin/btrfs", "qgroup", "destroy", "0/"+strconv.FormatUint(sv.ID, 10), path)
+	if err != nil {
+		btrfsLogger.Info("Warning: error on qgroup destroy", "Err", err.Error(), "Path", path)
+	}
+
+	_, err = runCmd(ctx, "/sbin/btrfs", "subvol", "delete", "-c", path)
+	if err != nil {
+		btrfsLogger.Info("Error on subvol delete", "Err", err.Error(), "Path", path)
+		return err
+	}
+
+	return nil
+}
+
+func (b *cliBackend) setLimit(ctx context.Context, path string, limit lsm.Limit) error {
+	return b.limit(ctx, limit, path)
+}
+
+func (b *cliBackend) createQgroup(ctx context.Context, path string, qgroupid uint64) error {
+	_, err := runCmd(ctx, "/sbin/btrfs", "qgroup", "create", formatQgroupID(qgroupid), path)
+	if lsm.ErrorCode(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+func (b *cliBackend) setQgroupLimit(ctx context.Context, path string, qgroupid uint64, limit lsm.Limit) error {
+	return b.limit(ctx, limit, formatQgroupID(qgroupid), path)
+}
+
+func (b *cliBackend) assignQgroup(ctx context.Context, path string, parent uint64) error {
+	sv, err := b.subvolumeInfo(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	// btrfs-progs schedules a rescan if the assignment makes quotas inconsistent
+	_, err = runCmd(ctx, "/sbin/btrfs", "qgroup", "assign", formatQgroupID(qgroupID(0, sv.ID)), formatQgroupID(parent), path)
+	if lsm.ErrorCode(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// limit runs 'btrfs qgroup limit' with the target, which is a path optionally preceded by a qgroup id.
+func (b *cliBackend) limit(ctx context.Context, limit lsm.Limit, target ...string) error {
+	set, unset := []string{"qgroup", "limit"}, []string{"qgroup", "limit"}
+	if limit.Mode == lsm.QuotaExclusive {
+		set = append(set, "-e")
+	} else {
+		unset = append(unset, "-e")
+	}
+	size := "none"
+	if limit.Size != 0 {
+		size = strconv.FormatUint(limit.Size, 10)
+	}
+	set = append(append(set, size), target...)
+	unset = append(append(unset, "none"), target...)
+
+	if _, err := runCmd(ctx, "/sbin/btrfs", set...); err != nil {
+		return err
+	}
+	_, err := runCmd(ctx, "/sbin/btrfs", unset...)
+	return err
+}
+
+// formatQgroupID returns the qgroup id in level/id form.
+func formatQgroupID(qgroupid uint64) string {
+	return fmt.Sprintf("%d/%d", qgroupid>>qgroupLevelShift, qgroupid&(1<<qgroupLevelShift-1))
+}
+
+func (b *cliBackend) subvolumeInfo(ctx context.Context, path string) (*subvolume, error) {
+	if err := checkSubvolume(path); err != nil {
+		return nil, err
+	}
+
+	out, err := runCmd(ctx, "/sbin/btrfs", "subvol", "show", "--raw", path)
+	if err != nil {
+		return nil, err
+	}
+
+	sv, err := parseSubvolumeInfo(out)
+	if err != nil {
+		btrfsLogger.Info("Error parsing subvolume info", "Path", path, "Err", err.Error())
+		return nil, err
+	}
+
+	return sv, nil
+}
+
+func parseSubvolumeInfo(out string) (*subvolume, error) {
+	sv := &subvolume{}
+	var limitRfer, limitExcl uint64
+
+	for _, line := range strings.Split(out, "\n") {
+		var err error
+		var name string
+		if m := limitRegexp.FindStringSubmatch(line); m != nil {
+			limitRfer, err = strconv.ParseUint(m[1], 10, 64)
+			name = "limit"
+		} else if m := limitExclRegexp.FindStringSubmatch(line); m != nil {
+			limitExcl, err = strconv.ParseUint(m[1], 10, 64)
+			name = "limitExclusive"
+		} else if m := usageRegexp.FindStringSubmatch(line); m != nil {
+			sv.Referenced, err = strconv.ParseUint(m[1], 10, 64)
+			name = "usage"
+		} else if m := usageExclRegexp.FindStringSubmatch(line); m != nil {
+			sv.Exclusive, err = strconv.ParseUint(m[1], 10, 64)
+			name = "usageExclusive"
+		} else if m := subvolRegexp.FindStringSubmatch(line); m != nil {
+			sv.ID, err = strconv.ParseUint(m[1], 10, 64)
+			name = "subvolId"
+		}
+
+		if err != nil {
+			btrfsLogger.Info("Parse error", "Name", name, "Err", err.Error())
+			return nil, errParseInfo
+		}
+	}
+
+	if sv.ID == 0 {
+		btrfsLogger.Info("No VolumeID")
+		return nil, errParseInfo
+	}
+
+	sv.Limit = subvolumeLimit(limitRfer, limitExcl)
+
+	return sv, nil
+}
+
+func (b *cliBackend) removeStaleQgroups(ctx context.Context, path string) (int, error) {
+	out, err := runCmd(ctx, "/sbin/btrfs", "qgroup", "show", "--raw", path)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, id := range parseStaleQgroups(out) {
+		if _, err := runCmd(ctx, "/sbin/btrfs", "qgroup", "destroy", id, path); err != nil {
+			// the subvolume may still be cleaned up by the kernel
+			btrfsLogger.Info("Warning: error on stale qgroup destroy", "Qgroup", id, "Path", path, "Err", err.Error())
+			continue
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// parseStaleQgroups returns level-0 qgroups which btrfs-progs show without a subvolume.
+func parseStaleQgroups(out string) []string {
+	var ids []string
+	for _, line := range strings.Split(out, "\n") {
+		if m := staleQgroupRegexp.FindStringSubmatch(line); m != nil {
+			ids = append(ids, m[1])
+		}
+	}
+	return ids
+}
+
+func (b *cliBackend) checkQuota(ctx context.Context, path string) error {
+	// qgroup show fails when quotas are disabled
+	if _, err := runCmd(ctx, "/sbin/btrfs", "qgroup", "show", path); err != nil {
+		return fmt.Errorf("%s: %w", path, lsm.ErrQuotaDisabled)
+	}
+	return nil
+}
+
+func (b *cliBackend) usage(ctx context.Context, path string) (*usage, error) {
+	out, err := runCmd(ctx, "/sbin/btrfs", "filesystem", "usage", "-b", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseUsage(out)
+}
+
+func parseUsage(out string) (*usage, error) {
+	var devSize, free uint64
+	ratio := 1.0
+	found := 0
+
+	for _, line := range strings.Split(out, "\n") {
+		var err error
+		if m := deviceSizeRegexp.FindStringSubmatch(line); m != nil {
+			devSize, err = strconv.ParseUint(m[1], 10, 64)
+			found++
+		} else if m := dataRatioRegexp.FindStringSubmatch(line); m != nil {
+			ratio, err = strconv.ParseFloat(m[1], 64)
+		} else if m := freeRegexp.FindStringSubmatch(line); m != nil {
+			free, err = strconv.ParseUint(m[1], 10, 64)
+			found++
+		}
+
+		if err != nil {
+			btrfsLogger.Info("Usage parse error", "Line", line, "Err", err.Error())
+			return nil, errParseInfo
+		}
+	}
+
+	if found != 2 || ratio <= 0 {
+		return nil, errParseInfo
+	}
+
+	return &usage{Size: uint64(float64(devSize) / ratio), Free: free}, nil
+}
+
+func runCmd(ctx context.Context, cmd string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout)
+	defer cancel()
+
+	// btrfs-progs prints errors to stderr, they are recognized by cliError
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, cmd, args...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			btrfsLogger.Info("Command is aborted", "Cmd", cmd, "Args", args, "Err", ctx.Err().Error())
+			return "", fmt.Errorf("%s %s: %w", cmd, strings.Join(args, " "), ctx.Err())
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", err
+		}
+		out := stdout.String() + stderr.String()
+		btrfsLogger.Info("Exit code is non-zero", "ExitCode", exitErr.ExitCode(), "Cmd", cmd, "Args", args, "Out", out)
+		return "", cliError(out)
+	}
+	return stdout.String(), nil
+}
+
+// cliError returns errExec with the command output, annotated with the gRPC code recognized from the output.
+func cliError(out string) error {
+	err := fmt.Errorf("%w: %s", errExec, strings.TrimSpace(out))
+
+	for _, e := range cliErrorCodes {
+		if strings.Contains(out, e.msg) {
+			return lsm.WrapError(e.code, err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,131 @@
+package btrfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc/codes"
+)
+
+func TestParseUsage(t *testing.T) {
+	out := `Overall:
+    Device size:                 214748364800
+    Device allocated:             23102226432
+    Device unallocated:          191646138368
+    Device missing:                         0
+    Device slack:                           0
+    Used:                         19669348352
+    Free (estimated):             96990806016	(min: 96990806016)
+    Free (statfs, df):            96989757440
+    Data ratio:                          2.00
+    Metadata ratio:                      2.00
+    Global reserve:                  29638656	(used: 0)
+    Multiple profiles:                     no
+
+Data,RAID1: Size:11005853696, Used:9838723072 (89.40%)
+   /dev/sda	11005853696
+   /dev/sdb	11005853696
+`
+
+	u, err := parseUsage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Size != 107374182400 {
+		t.Errorf("size should be 107374182400: %d", u.Size)
+	}
+	if u.Free != 96990806016 {
+		t.Errorf("free should be 96990806016: %d", u.Free)
+	}
+
+	if _, err := parseUsage("Overall:\n"); err == nil {
+		t.Error("parse should fail without usage values")
+	}
+}
+
+func TestParseSubvolumeInfo(t *testing.T) {
+	out := `pvc-1
+	Name: 			pvc-1
+	UUID: 			d5a0fb69-7bb8-4b4e-9e68-1a0b4dd1d5a4
+	Subvolume ID: 		257
+	Generation: 		12
+	Flags: 			-
+	Quota group:		0/257
+	  Limit referenced:	-
+	  Limit exclusive:	1073741824
+	  Usage referenced:	49152
+	  Usage exclusive:	16384
+`
+
+	sv, err := parseSubvolumeInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sv.ID != 257 {
+		t.Errorf("id should be 257: %d", sv.ID)
+	}
+	if sv.Limit.Size != 1073741824 || sv.Limit.Mode != lsm.QuotaExclusive {
+		t.Errorf("limit should be exclusive 1073741824: %+v", sv.Limit)
+	}
+	if sv.Referenced != 49152 || sv.Exclusive != 16384 {
+		t.Errorf("usage should be 49152/16384: %d/%d", sv.Referenced, sv.Exclusive)
+	}
+}
+
+func TestFormatQgroupID(t *testing.T) {
+	if id := formatQgroupID(qgroupID(1, 100)); id != "1/100" {
+		t.Errorf("qgroup id should be 1/100: %s", id)
+	}
+	if id := formatQgroupID(qgroupID(0, 257)); id != "0/257" {
+		t.Errorf("qgroup id should be 0/257: %s", id)
+	}
+}
+
+func TestParseStaleQgroups(t *testing.T) {
+	out := `Qgroupid    Referenced    Exclusive   Path
+--------    ----------    ---------   ----
+0/5              16384        16384   <toplevel>
+0/256          1048576        16384   ssd/pvc-1
+0/257            16384        16384   <stale>
+1/100          1064960      1064960   <0 member qgroups>
+`
+
+	ids := parseStaleQgroups(out)
+	if len(ids) != 1 || ids[0] != "0/257" {
+		t.Errorf("only 0/257 should be stale: %v", ids)
+	}
+}
+
+func TestRunCmd(t *testing.T) {
+	ctx := context.Background()
+
+	out, err := runCmd(ctx, "/bin/sh", "-c", "echo ok; echo warning >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "ok\n" {
+		t.Errorf("only stdout should be returned: %q", out)
+	}
+
+	// btrfs-progs reports an existing qgroup on stderr
+	_, err = runCmd(ctx, "/bin/sh", "-c", "echo 'ERROR: unable to create quota group: File exists' >&2; exit 1")
+	if code := lsm.ErrorCode(err); code != codes.AlreadyExists {
+		t.Errorf("code should be AlreadyExists: %s: %v", code, err)
+	}
+}
+
+func TestRunCmdErrorCodes(t *testing.T) {
+	for _, e := range cliErrorCodes {
+		_, err := runCmd(context.Background(), "/bin/sh", "-c", "echo \"ERROR: $0\" >&2; exit 1", e.msg)
+		if code := lsm.ErrorCode(err); code != e.code {
+			t.Errorf("code for %q should be %s: %s", e.msg, e.code, code)
+		}
+	}
+
+	// errors without a known message are internal
+	_, err := runCmd(context.Background(), "/bin/sh", "-c", "echo 'ERROR: unknown' >&2; exit 1")
+	if code := lsm.ErrorCode(err); code != codes.Internal {
+		t.Errorf("code should be Internal: %s", code)
+	}
+}
@@ -0,0 +1,220 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kvaster/topols/pkg/lsm"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+type deviceClassConfig struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+	Size    string `json:"size"`
+	// Type is the filesystem type of the device class, btrfs by default.
+	Type string `json:"type,omitempty"`
+	// Path is the directory with volumes of the device class.
+	// Relative path is relative to the pool path, default is the device class name.
+	Path string `json:"path,omitempty"`
+	// Capacity is the capacity mode, CapacityConfigured by default.
+	// Size may be omitted in CapacityFilesystem mode, the filesystem size is used then.
+	Capacity string `json:"capacity,omitempty"`
+	// OvercommitRatio multiplies the size, i.e. 1.5 allows volumes with total size of 150%. Default is 1.
+	OvercommitRatio float64 `json:"overcommitRatio,omitempty"`
+	// Spare is the percentage of the size and of the filesystem which is held back and never given to volumes.
+	Spare uint `json:"spare,omitempty"`
+	// QuotaMode is the volume limit mode, referenced by default.
+	// Exclusive limits do not count extents shared with snapshots and clones.
+	QuotaMode string `json:"quotaMode,omitempty"`
+	// Accounting selects how used capacity is counted, AccountingLimit by default.
+	Accounting string `json:"accounting,omitempty"`
+	// Qgroup is N of the level-1 qgroup 1/N which contains all volumes of the device class
+	// and is limited by the size. Zero disables the group.
+	Qgroup uint64 `json:"qgroup,omitempty"`
+}
+
+type config struct {
+	DeviceClasses []*deviceClassConfig `json:"device-classes"`
+}
+
+// parseConfig parses and validates the whole config.
+// Returned device classes have only config values set, all errors found are joined.
+func (c *btrfs) parseConfig(b []byte) ([]*deviceClass, error) {
+	cnf := &config{}
+	if err := yaml.Unmarshal(b, &cnf); err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+
+	var errs []error
+	var dcs []*deviceClass
+	var defaults []string
+	names := make(map[string]bool)
+	paths := make(map[string]string)
+	for i, dcc := range cnf.DeviceClasses {
+		if dcc == nil {
+			errs = append(errs, fmt.Errorf("device class #%d is empty", i+1))
+			continue
+		}
+
+		dc, err := c.deviceClassFromConfig(dcc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("device class %s: %w", dcc.Name, err))
+			continue
+		}
+
+		if names[dc.Name] {
+			errs = append(errs, fmt.Errorf("device class %s is defined more than once", dc.Name))
+			continue
+		}
+		names[dc.Name] = true
+
+		if other, ok := paths[dc.Path]; ok {
+			errs = append(errs, fmt.Errorf("device classes %s and %s have the same path %s", other, dc.Name, dc.Path))
+		}
+		paths[dc.Path] = dc.Name
+
+		if dc.Default {
+			defaults = append(defaults, dc.Name)
+		}
+
+		dcs = append(dcs, dc)
+	}
+
+	if len(defaults) > 1 {
+		errs = append(errs, fmt.Errorf("only one device class can be default: %s", strings.Join(defaults, ", ")))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return dcs, nil
+}
+
+func (c *btrfs) deviceClassFromConfig(dcc *deviceClassConfig) (*deviceClass, error) {
+	if dcc.Name == "" || strings.Contains(dcc.Name, "/") {
+		return nil, errors.New("name should be non-empty and should not contain '/'")
+	}
+
+	dc := &deviceClass{
+		Name:    dcc.Name,
+		Default: dcc.Default,
+		Type:    dcc.Type,
+		Path:    c.deviceClassPath(dcc),
+		Spare:   dcc.Spare,
+		Qgroup:  dcc.Qgroup,
+	}
+
+	switch dcc.Capacity {
+	case "", CapacityConfigured:
+		dc.Capacity = CapacityConfigured
+	case CapacityFilesystem:
+		dc.Capacity = CapacityFilesystem
+	default:
+		return nil, fmt.Errorf("unknown capacity mode: %s", dcc.Capacity)
+	}
+
+	switch dcc.Accounting {
+	case "", AccountingLimit:
+		dc.Accounting = AccountingLimit
+	case AccountingExclusive:
+		dc.Accounting = AccountingExclusive
+	default:
+		return nil, fmt.Errorf("unknown accounting mode: %s", dcc.Accounting)
+	}
+
+	switch lsm.QuotaMode(dcc.QuotaMode) {
+	case "", lsm.QuotaReferenced:
+		dc.QuotaMode = lsm.QuotaReferenced
+	case lsm.QuotaExclusive:
+		dc.QuotaMode = lsm.QuotaExclusive
+	default:
+		return nil, fmt.Errorf("unknown quota mode: %s", dcc.QuotaMode)
+	}
+
+	switch {
+	case dcc.OvercommitRatio < 0:
+		return nil, fmt.Errorf("overcommit ratio can't be negative: %v", dcc.OvercommitRatio)
+	case dcc.OvercommitRatio == 0:
+		dc.OvercommitRatio = 1
+	default:
+		dc.OvercommitRatio = dcc.OvercommitRatio
+	}
+
+	if dcc.Spare >= 100 {
+		return nil, fmt.Errorf("spare should be less than 100 percent: %d", dcc.Spare)
+	}
+
+	if dcc.Qgroup >= 1<<qgroupLevelShift {
+		return nil, fmt.Errorf("qgroup is too large: %d", dcc.Qgroup)
+	}
+
+	if dcc.Size != "" || dc.Capacity != CapacityFilesystem {
+		size, err := resource.ParseQuantity(dcc.Size)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse size %q: %w", dcc.Size, err)
+		}
+		if size.Sign() < 0 {
+			return nil, fmt.Errorf("size can't be negative: %s", dcc.Size)
+		}
+		dc.Size = uint64(size.Value())
+	}
+
+	return dc, nil
+}
+
+func (c *btrfs) deviceClassPath(dcc *deviceClassConfig) string {
+	if dcc.Path == "" {
+		return filepath.Join(c.poolPath, dcc.Name)
+	}
+	if filepath.IsAbs(dcc.Path) {
+		return filepath.Clean(dcc.Path)
+	}
+	return filepath.Join(c.poolPath, dcc.Path)
+}
+
+// checkConfig checks that the current device classes can be replaced with dcs.
+// Type, path, quota mode and qgroup of a device class can't be changed,
+// and a device class with volumes can't be removed. It must be called with the lock held.
+func (c *btrfs) checkConfig(dcs []*deviceClass) error {
+	var errs []error
+
+	names := make(map[string]bool)
+	for _, dc := range dcs {
+		names[dc.Name] = true
+
+		cur := c.findDeviceClass(dc.Name)
+		if cur == nil {
+			continue
+		}
+		// an unhealthy class without volumes is created again, i.e. to fix a typo in its path
+		if cur.Err != nil && len(cur.Volumes) == 0 && len(cur.pending) == 0 {
+			continue
+		}
+		if cur.Type != dc.Type || cur.Path != dc.Path || cur.QuotaMode != dc.QuotaMode || cur.Qgroup != dc.Qgroup {
+			errs = append(errs, fmt.Errorf("device class %s: type, path, quota mode and qgroup can't be changed", dc.Name))
+		}
+	}
+
+	for _, cur := range c.deviceClasses {
+		if !names[cur.Name] && (len(cur.Volumes) > 0 || len(cur.pending) > 0) {
+			errs = append(errs, fmt.Errorf("device class %s has %d volumes and can't be removed", cur.Name, len(cur.Volumes)+len(cur.pending)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// apply copies config values which can be changed at runtime.
+func (d *deviceClass) apply(dc *deviceClass) {
+	d.Default = dc.Default
+	d.Size = dc.Size
+	d.Capacity = dc.Capacity
+	d.OvercommitRatio = dc.OvercommitRatio
+	d.Spare = dc.Spare
+	d.Accounting = dc.Accounting
+}
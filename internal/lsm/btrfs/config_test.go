@@ -0,0 +1,246 @@
+package btrfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kvaster/topols/internal/lock"
+	"github.com/kvaster/topols/pkg/lsm"
+)
+
+func TestParseConfig(t *testing.T) {
+	c := &btrfs{poolPath: "/mnt/pool"}
+
+	dcs, err := c.parseConfig([]byte(`
+device-classes:
+  - name: ssd
+    default: true
+    size: 100Gi
+  - name: hdd
+    path: /mnt/hdd
+    capacity: filesystem
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dcs) != 2 || dcs[0].Path != "/mnt/pool/ssd" || dcs[0].Size != 100<<30 || dcs[1].Path != "/mnt/hdd" {
+		t.Errorf("unexpected device classes: %+v %+v", dcs[0], dcs[1])
+	}
+
+	cases := map[string]string{
+		"duplicate name": `
+device-classes:
+  - name: ssd
+    size: 1Gi
+  - name: ssd
+    size: 2Gi
+`,
+		"several defaults": `
+device-classes:
+  - name: ssd
+    default: true
+    size: 1Gi
+  - name: hdd
+    default: true
+    size: 2Gi
+`,
+		"bad size": `
+device-classes:
+  - name: ssd
+    size: 1Gb
+`,
+		"negative size": `
+device-classes:
+  - name: ssd
+    size: -1Gi
+`,
+		"missing size": `
+device-classes:
+  - name: ssd
+`,
+		"same path": `
+device-classes:
+  - name: ssd
+    size: 1Gi
+  - name: hdd
+    size: 1Gi
+    path: ssd
+`,
+	}
+	for name, cnf := range cases {
+		if _, err := c.parseConfig([]byte(cnf)); err == nil {
+			t.Errorf("%s: should be error", name)
+		}
+	}
+}
+
+type staticDriver struct {
+	lsm.Driver
+}
+
+func (d *staticDriver) CheckPool(ctx context.Context, path string) error {
+	return nil
+}
+
+func (d *staticDriver) VolumeInfo(ctx context.Context, path string) (*lsm.VolumeInfo, error) {
+	return &lsm.VolumeInfo{Limit: lsm.Limit{Size: 10, Mode: lsm.QuotaReferenced}}, nil
+}
+
+func TestLoadConfigKeepsClassesWithVolumes(t *testing.T) {
+	pool := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(pool, "ssd", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(pool, "hdd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(cnf string) {
+		if err := os.WriteFile(filepath.Join(pool, configFile), []byte(cnf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &btrfs{poolPath: pool, drivers: lsm.DriverRegistry{lsm.DefaultFsType: &staticDriver{}}, volumeLock: lock.NewLockWithID()}
+
+	writeConfig(`
+device-classes:
+  - name: ssd
+    size: 100
+  - name: hdd
+    size: 100
+`)
+	c.loadConfig(context.Background())
+	if c.config.Err != nil || len(c.deviceClasses) != 2 {
+		t.Fatalf("config should be loaded: %v", c.config.Err)
+	}
+
+	writeConfig(`
+device-classes:
+  - name: hdd
+    size: 200
+`)
+	c.loadConfig(context.Background())
+	if c.config.Err == nil || !strings.Contains(c.config.Err.Error(), "ssd") || c.config.Errors != 1 {
+		t.Errorf("removal of ssd with volumes should fail: %v", c.config.Err)
+	}
+	if len(c.deviceClasses) != 2 || c.findDeviceClass("hdd").Size != 100 {
+		t.Errorf("config should not be applied partially")
+	}
+
+	writeConfig(`
+device-classes:
+  - name: ssd
+    size: 100
+`)
+	c.loadConfig(context.Background())
+	if c.config.Err != nil || len(c.deviceClasses) != 1 {
+		t.Errorf("hdd without volumes should be removed: %v", c.config.Err)
+	}
+}
+
+type groupsDriver struct {
+	staticDriver
+	groups  int
+	assigns int
+}
+
+func (d *groupsDriver) SetGroupLimit(ctx context.Context, path string, group uint64, limit lsm.Limit) error {
+	d.groups++
+	return nil
+}
+
+func (d *groupsDriver) AssignGroup(ctx context.Context, path string, group uint64) error {
+	d.assigns++
+	return nil
+}
+
+func TestScanDoesNotReconcileGroups(t *testing.T) {
+	pool := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(pool, "ssd", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cnf := `
+device-classes:
+  - name: ssd
+    size: 100
+    qgroup: 1
+`
+	if err := os.WriteFile(filepath.Join(pool, configFile), []byte(cnf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &groupsDriver{}
+	c, err := ScanBtrfs(pool, lsm.DriverRegistry{lsm.DefaultFsType: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := c.GetLVList(context.Background(), "ssd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 {
+		t.Errorf("volume a should be found: %v", volumes)
+	}
+	if d.groups != 0 || d.assigns != 0 {
+		t.Errorf("groups should not be changed: %d limits, %d assigns", d.groups, d.assigns)
+	}
+
+	if _, err := NewBtrfs(pool, lsm.DriverRegistry{lsm.DefaultFsType: d}); err != nil {
+		t.Fatal(err)
+	}
+	if d.groups != 1 || d.assigns != 1 {
+		t.Errorf("groups should be reconciled: %d limits, %d assigns", d.groups, d.assigns)
+	}
+}
+
+// pathDriver reports pools which do not exist unhealthy.
+type pathDriver struct {
+	staticDriver
+}
+
+func (d *pathDriver) CheckPool(ctx context.Context, path string) error {
+	_, err := os.Stat(path)
+	return err
+}
+
+func TestLoadConfigFixesUnhealthyClass(t *testing.T) {
+	pool := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(pool, "ssd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(cnf string) {
+		if err := os.WriteFile(filepath.Join(pool, configFile), []byte(cnf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &btrfs{poolPath: pool, drivers: lsm.DriverRegistry{lsm.DefaultFsType: &pathDriver{}}, volumeLock: lock.NewLockWithID()}
+
+	writeConfig(`
+device-classes:
+  - name: ssd
+    path: sdd
+    size: 100
+`)
+	c.loadConfig(context.Background())
+	if c.config.Err != nil || c.findDeviceClass("ssd").Err == nil {
+		t.Fatalf("ssd should be loaded unhealthy: %v", c.config.Err)
+	}
+
+	writeConfig(`
+device-classes:
+  - name: ssd
+    path: ssd
+    size: 100
+`)
+	c.loadConfig(context.Background())
+	if c.config.Err != nil {
+		t.Fatalf("path of unhealthy ssd should be changed: %v", c.config.Err)
+	}
+	if dc := c.findDeviceClass("ssd"); dc.Err != nil || dc.Path != filepath.Join(pool, "ssd") {
+		t.Errorf("ssd should be healthy: %v", dc.Err)
+	}
+}
@@ -0,0 +1,181 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/g0rbe/go-chattr"
+	"github.com/kvaster/topols/pkg/lsm"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+)
+
+const compressionXattr = "btrfs.compression"
+
+// driver implements lsm.Driver and lsm.GroupDriver with btrfs subvolumes and qgroups.
+// Groups are level-1 qgroups 1/N.
+type driver struct {
+	backend backend
+}
+
+var _ lsm.GroupDriver = &driver{}
+var _ lsm.StaleDriver = &driver{}
+var _ lsm.OptionsDriver = &driver{}
+
+// NewDriver returns lsm.Driver for btrfs.
+// backendName selects how btrfs is accessed, either BackendCLI or BackendIoctl.
+func NewDriver(backendName string) (lsm.Driver, error) {
+	b, err := newBackend(backendName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &driver{backend: b}, nil
+}
+
+func (d *driver) CheckPool(ctx context.Context, path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	if st.Type != unix.BTRFS_SUPER_MAGIC {
+		return fmt.Errorf("%s is not on btrfs filesystem", path)
+	}
+
+	return d.backend.checkQuota(ctx, path)
+}
+
+func (d *driver) PoolStats(ctx context.Context, path string) (*lsm.PoolStats, error) {
+	u, err := d.backend.usage(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lsm.PoolStats{SizeBytes: u.Size, FreeBytes: u.Free}, nil
+}
+
+func (d *driver) CreateVolume(ctx context.Context, path string, limit lsm.Limit, opts lsm.VolumeOptions) error {
+	if err := opts.Validate(); err != nil {
+		return lsm.WrapError(codes.InvalidArgument, err)
+	}
+
+	err := d.backend.createSubvolume(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	err = d.backend.setLimit(ctx, path, limit)
+	if err == nil {
+		err = setProperties(path, opts)
+	}
+	if err != nil {
+		_ = d.backend.removeSubvolume(ctx, path)
+		return err
+	}
+
+	return nil
+}
+
+// setProperties applies volume options to the subvolume root directory,
+// new files inherit them, and snapshots keep them as they copy the root directory.
+func setProperties(path string, opts lsm.VolumeOptions) error {
+	// nodatacow disables data checksums too, btrfs has no separate per-file flag for nodatasum
+	if opts.NoCow {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0666)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+
+		if err := chattr.SetAttr(f, chattr.FS_NOCOW_FL); err != nil {
+			return err
+		}
+	}
+
+	// the same as 'btrfs property set <path> compression <value>'
+	if opts.Compression != "" {
+		if err := unix.Setxattr(path, compressionXattr, []byte(opts.Compression), 0); err != nil {
+			return fmt.Errorf("set compression %s on %s: %w", opts.Compression, path, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *driver) CreateSnapshot(ctx context.Context, srcPath, path string, limit lsm.Limit, readOnly bool) error {
+	err := d.backend.createSnapshot(ctx, srcPath, path, readOnly)
+	if err != nil {
+		return err
+	}
+
+	err = d.backend.setLimit(ctx, path, limit)
+	if err != nil {
+		_ = d.backend.removeSubvolume(ctx, path)
+		return err
+	}
+
+	return nil
+}
+
+// SetOptions replaces options of the subvolume root directory. Options which are turned off are cleared first,
+// as btrfs refuses compression together with nodatacow.
+func (d *driver) SetOptions(ctx context.Context, path string, opts lsm.VolumeOptions) error {
+	if err := opts.Validate(); err != nil {
+		return lsm.WrapError(codes.InvalidArgument, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	if !opts.NoCow {
+		if err := chattr.UnsetAttr(f, chattr.FS_NOCOW_FL); err != nil {
+			return fmt.Errorf("clear nodatacow on %s: %w", path, err)
+		}
+	}
+	if opts.Compression == "" {
+		if err := unix.Removexattr(path, compressionXattr); err != nil && !errors.Is(err, unix.ENODATA) {
+			return fmt.Errorf("clear compression on %s: %w", path, err)
+		}
+	}
+
+	return setProperties(path, opts)
+}
+
+func (d *driver) RemoveVolume(ctx context.Context, path string) error {
+	return d.backend.removeSubvolume(ctx, path)
+}
+
+func (d *driver) SetLimit(ctx context.Context, path string, limit lsm.Limit) error {
+	return d.backend.setLimit(ctx, path, limit)
+}
+
+func (d *driver) VolumeInfo(ctx context.Context, path string) (*lsm.VolumeInfo, error) {
+	sv, err := d.backend.subvolumeInfo(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lsm.VolumeInfo{Limit: sv.Limit, Referenced: sv.Referenced, Exclusive: sv.Exclusive}, nil
+}
+
+func (d *driver) SetGroupLimit(ctx context.Context, path string, group uint64, limit lsm.Limit) error {
+	qgroupid := qgroupID(1, group)
+	if err := d.backend.createQgroup(ctx, path, qgroupid); err != nil {
+		return err
+	}
+
+	return d.backend.setQgroupLimit(ctx, path, qgroupid, limit)
+}
+
+func (d *driver) AssignGroup(ctx context.Context, path string, group uint64) error {
+	return d.backend.assignQgroup(ctx, path, qgroupID(1, group))
+}
+
+func (d *driver) RemoveStale(ctx context.Context, path string) (int, error) {
+	return d.backend.removeStaleQgroups(ctx, path)
+}
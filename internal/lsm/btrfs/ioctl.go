@@ -0,0 +1,745 @@
+package btrfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/kvaster/topols/pkg/lsm"
+	"golang.org/x/sys/unix"
+)
+
+// Definitions below mirror include/uapi/linux/btrfs.h and btrfs_tree.h.
+
+const (
+	btrfsIoctlMagic = 0x94
+
+	iocNone  = 0
+	iocWrite = 1
+	iocRead  = 2
+
+	btrfsPathNameMax   = 4087
+	btrfsSubvolNameMax = 4039
+	btrfsInoLookupPath = 4080
+	btrfsSearchBufSize = 4096 - 104
+
+	btrfsRootTreeObjectID  = 1
+	btrfsFsTreeObjectID    = 5
+	btrfsFirstFreeObjectID = 256
+	btrfsQuotaTreeObjectID = 8
+
+	btrfsRootItemKey = 132
+
+	btrfsQgroupStatusKey = 240
+	btrfsQgroupInfoKey   = 242
+	btrfsQgroupLimitKey  = 244
+
+	btrfsSubvolRdonly = 1 << 1
+
+	btrfsQgroupLimitMaxRfer = 1 << 0
+	btrfsQgroupLimitMaxExcl = 1 << 1
+
+	// btrfsQgroupClearLimit removes the limit when used as a value
+	btrfsQgroupClearLimit = math.MaxUint64
+
+	btrfsQgroupStatusFlagOn = 1 << 0
+
+	btrfsBlockGroupData    = 1 << 0
+	btrfsBlockGroupRaid1   = 1 << 4
+	btrfsBlockGroupDup     = 1 << 5
+	btrfsBlockGroupRaid10  = 1 << 6
+	btrfsBlockGroupRaid5   = 1 << 7
+	btrfsBlockGroupRaid6   = 1 << 8
+	btrfsBlockGroupRaid1C3 = 1 << 9
+	btrfsBlockGroupRaid1C4 = 1 << 10
+)
+
+type btrfsVolArgs struct {
+	fd   int64
+	name [btrfsPathNameMax + 1]byte
+}
+
+type btrfsVolArgsV2 struct {
+	fd            int64
+	transid       uint64
+	flags         uint64
+	size          uint64
+	qgroupInherit uint64
+	unused        [2]uint64
+	name          [btrfsSubvolNameMax + 1]byte
+}
+
+type btrfsQgroupLimit struct {
+	flags   uint64
+	maxRfer uint64
+	maxExcl uint64
+	rsvRfer uint64
+	rsvExcl uint64
+}
+
+type btrfsQgroupLimitArgs struct {
+	qgroupid uint64
+	lim      btrfsQgroupLimit
+}
+
+type btrfsQgroupCreateArgs struct {
+	create   uint64
+	qgroupid uint64
+}
+
+type btrfsQgroupAssignArgs struct {
+	assign uint64
+	src    uint64
+	dst    uint64
+}
+
+type btrfsQuotaRescanArgs struct {
+	flags    uint64
+	progress uint64
+	reserved [6]uint64
+}
+
+type btrfsInoLookupArgs struct {
+	treeid   uint64
+	objectid uint64
+	name     [btrfsInoLookupPath]byte
+}
+
+type btrfsSearchKey struct {
+	treeID      uint64
+	minObjectID uint64
+	maxObjectID uint64
+	minOffset   uint64
+	maxOffset   uint64
+	minTransID  uint64
+	maxTransID  uint64
+	minType     uint32
+	maxType     uint32
+	nrItems     uint32
+	unused      uint32
+	unused1     uint64
+	unused2     uint64
+	unused3     uint64
+	unused4     uint64
+}
+
+type btrfsSearchArgs struct {
+	key btrfsSearchKey
+	buf [btrfsSearchBufSize]byte
+}
+
+type btrfsSearchHeader struct {
+	transid  uint64
+	objectid uint64
+	offset   uint64
+	typ      uint32
+	len      uint32
+}
+
+type btrfsSpaceInfo struct {
+	flags      uint64
+	totalBytes uint64
+	usedBytes  uint64
+}
+
+type btrfsSpaceArgs struct {
+	spaceSlots  uint64
+	totalSpaces uint64
+}
+
+type btrfsFsInfoArgs struct {
+	maxID          uint64
+	numDevices     uint64
+	fsid           [16]byte
+	nodesize       uint32
+	sectorsize     uint32
+	cloneAlignment uint32
+	csumType       uint16
+	csumSize       uint16
+	flags          uint64
+	generation     uint64
+	metadataUUID   [16]byte
+	reserved       [944]byte
+}
+
+type btrfsDevInfoArgs struct {
+	devid      uint64
+	uuid       [16]byte
+	bytesUsed  uint64
+	totalBytes uint64
+	unused     [379]uint64
+	path       [1024]byte
+}
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | btrfsIoctlMagic<<8 | nr
+}
+
+var (
+	ioctlSync          = ioc(iocNone, 8, 0)
+	ioctlSubvolCreate  = ioc(iocWrite, 14, unsafe.Sizeof(btrfsVolArgs{}))
+	ioctlSnapDestroy   = ioc(iocWrite, 15, unsafe.Sizeof(btrfsVolArgs{}))
+	ioctlTreeSearch    = ioc(iocWrite|iocRead, 17, unsafe.Sizeof(btrfsSearchArgs{}))
+	ioctlInoLookup     = ioc(iocWrite|iocRead, 18, unsafe.Sizeof(btrfsInoLookupArgs{}))
+	ioctlSpaceInfo     = ioc(iocWrite|iocRead, 20, unsafe.Sizeof(btrfsSpaceArgs{}))
+	ioctlSnapCreateV2  = ioc(iocWrite, 23, unsafe.Sizeof(btrfsVolArgsV2{}))
+	ioctlDevInfo       = ioc(iocWrite|iocRead, 30, unsafe.Sizeof(btrfsDevInfoArgs{}))
+	ioctlFsInfo        = ioc(iocRead, 31, unsafe.Sizeof(btrfsFsInfoArgs{}))
+	ioctlQgroupAssign  = ioc(iocWrite, 41, unsafe.Sizeof(btrfsQgroupAssignArgs{}))
+	ioctlQgroupCreate  = ioc(iocWrite, 42, unsafe.Sizeof(btrfsQgroupCreateArgs{}))
+	ioctlQgroupLimit   = ioc(iocRead, 43, unsafe.Sizeof(btrfsQgroupLimitArgs{}))
+	ioctlQuotaRescan   = ioc(iocWrite, 44, unsafe.Sizeof(btrfsQuotaRescanArgs{}))
+	errNameTooLong     = errors.New("name is too long")
+	btrfsSearchHdrSize = int(unsafe.Sizeof(btrfsSearchHeader{}))
+)
+
+// IoctlError is returned by the ioctl backend when the kernel rejects a request.
+// Errno can be checked with errors.Is, e.g. errors.Is(err, unix.ENOSPC).
+type IoctlError struct {
+	Op    string
+	Path  string
+	Errno unix.Errno
+}
+
+func (e *IoctlError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Path, e.Errno.Error())
+}
+
+func (e *IoctlError) Unwrap() error {
+	return e.Errno
+}
+
+func ioctl(f *os.File, op string, req uintptr, arg unsafe.Pointer) error {
+	_, err := ioctlRet(f, op, req, arg)
+	return err
+}
+
+// ioctlRet is ioctl which also returns the non-negative result of the call.
+func ioctlRet(f *os.File, op string, req uintptr, arg unsafe.Pointer) (uintptr, error) {
+	r, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return 0, &IoctlError{Op: op, Path: f.Name(), Errno: errno}
+	}
+	return r, nil
+}
+
+func copyName(dst []byte, name string) error {
+	// the name must be NUL terminated
+	if len(name) >= len(dst) {
+		return errNameTooLong
+	}
+	copy(dst, name)
+	return nil
+}
+
+// ioctlBackend implements backend with btrfs ioctls and does not need btrfs-progs.
+// Ioctls can't be interrupted, so the context is checked only before an operation starts.
+type ioctlBackend struct{}
+
+func (b *ioctlBackend) createSubvolume(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dir.Close() }()
+
+	args := &btrfsVolArgs{}
+	if err := copyName(args.name[:], filepath.Base(path)); err != nil {
+		return err
+	}
+
+	return ioctl(dir, "BTRFS_IOC_SUBVOL_CREATE", ioctlSubvolCreate, unsafe.Pointer(args))
+}
+
+func (b *ioctlBackend) createSnapshot(ctx context.Context, srcPath, path string, readOnly bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dir.Close() }()
+
+	args := &btrfsVolArgsV2{fd: int64(src.Fd())}
+	if readOnly {
+		args.flags |= btrfsSubvolRdonly
+	}
+	if err := copyName(args.name[:], filepath.Base(path)); err != nil {
+		return err
+	}
+
+	return ioctl(dir, "BTRFS_IOC_SNAP_CREATE_V2", ioctlSnapCreateV2, unsafe.Pointer(args))
+}
+
+func (b *ioctlBackend) removeSubvolume(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sv, err := b.subvolumeInfo(ctx, path)
+	if err != nil {
+		btrfsLogger.Info("Error reading subvolume info", "Err", err.Error(), "Path", path)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dir.Close() }()
+
+	qargs := &btrfsQgroupCreateArgs{create: 0, qgroupid: sv.ID}
+	if err := ioctl(dir, "BTRFS_IOC_QGROUP_CREATE", ioctlQgroupCreate, unsafe.Pointer(qargs)); err != nil {
+		btrfsLogger.Info("Warning: error on qgroup destroy", "Err", err.Error(), "Path", path)
+	}
+
+	args := &btrfsVolArgs{}
+	if err := copyName(args.name[:], filepath.Base(path)); err != nil {
+		return err
+	}
+	if err := ioctl(dir, "BTRFS_IOC_SNAP_DESTROY", ioctlSnapDestroy, unsafe.Pointer(args)); err != nil {
+		btrfsLogger.Info("Error on subvol delete", "Err", err.Error(), "Path", path)
+		return err
+	}
+
+	// wait for transaction commit, the same as 'btrfs subvol delete -c'
+	return ioctl(dir, "BTRFS_IOC_SYNC", ioctlSync, nil)
+}
+
+func (b *ioctlBackend) setLimit(ctx context.Context, path string, limit lsm.Limit) error {
+	// qgroupid 0 means the qgroup of the subvolume path belongs to
+	return b.setQgroupLimit(ctx, path, 0, limit)
+}
+
+func (b *ioctlBackend) createQgroup(ctx context.Context, path string, qgroupid uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	args := &btrfsQgroupCreateArgs{create: 1, qgroupid: qgroupid}
+	err = ioctl(f, "BTRFS_IOC_QGROUP_CREATE", ioctlQgroupCreate, unsafe.Pointer(args))
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+func (b *ioctlBackend) setQgroupLimit(ctx context.Context, path string, qgroupid uint64, limit lsm.Limit) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	args := &btrfsQgroupLimitArgs{
+		qgroupid: qgroupid,
+		lim: btrfsQgroupLimit{
+			flags:   btrfsQgroupLimitMaxRfer | btrfsQgroupLimitMaxExcl,
+			maxRfer: btrfsQgroupClearLimit,
+			maxExcl: btrfsQgroupClearLimit,
+		},
+	}
+	if limit.Size != 0 {
+		if limit.Mode == lsm.QuotaExclusive {
+			args.lim.maxExcl = limit.Size
+		} else {
+			args.lim.maxRfer = limit.Size
+		}
+	}
+
+	return ioctl(f, "BTRFS_IOC_QGROUP_LIMIT", ioctlQgroupLimit, unsafe.Pointer(args))
+}
+
+func (b *ioctlBackend) assignQgroup(ctx context.Context, path string, parent uint64) error {
+	sv, err := b.subvolumeInfo(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	args := &btrfsQgroupAssignArgs{assign: 1, src: qgroupID(0, sv.ID), dst: parent}
+	r, err := ioctlRet(f, "BTRFS_IOC_QGROUP_ASSIGN", ioctlQgroupAssign, unsafe.Pointer(args))
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// positive result means quotas became inconsistent, the same as in btrfs-progs a rescan is started
+	if r > 0 {
+		rescan := &btrfsQuotaRescanArgs{}
+		err := ioctl(f, "BTRFS_IOC_QUOTA_RESCAN", ioctlQuotaRescan, unsafe.Pointer(rescan))
+		if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+			btrfsLogger.Info("Warning: error on quota rescan", "Err", err.Error(), "Path", path)
+		}
+	}
+
+	return nil
+}
+
+func (b *ioctlBackend) subvolumeInfo(ctx context.Context, path string) (*subvolume, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := checkSubvolume(path); err != nil {
+		return nil, err
+	}
+
+	lookup := &btrfsInoLookupArgs{objectid: btrfsFirstFreeObjectID}
+	if err := ioctl(f, "BTRFS_IOC_INO_LOOKUP", ioctlInoLookup, unsafe.Pointer(lookup)); err != nil {
+		return nil, err
+	}
+
+	sv := &subvolume{ID: lookup.treeid}
+
+	info, err := searchQuotaItem(f, btrfsQgroupInfoKey, sv.ID)
+	if errors.Is(err, unix.ENOENT) {
+		// quota tree does not exist, quotas are disabled
+		return sv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(info) >= 32 {
+		// struct btrfs_qgroup_info_item: generation, rfer, rfer_cmpr, excl, excl_cmpr
+		sv.Referenced = binary.LittleEndian.Uint64(info[8:16])
+		sv.Exclusive = binary.LittleEndian.Uint64(info[24:32])
+	}
+
+	limit, err := searchQuotaItem(f, btrfsQgroupLimitKey, sv.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(limit) >= 24 {
+		// struct btrfs_qgroup_limit_item: flags, max_rfer, max_excl, rsv_rfer, rsv_excl
+		var rfer, excl uint64
+		flags := binary.LittleEndian.Uint64(limit[0:8])
+		if flags&btrfsQgroupLimitMaxRfer != 0 {
+			rfer = binary.LittleEndian.Uint64(limit[8:16])
+		}
+		if flags&btrfsQgroupLimitMaxExcl != 0 {
+			excl = binary.LittleEndian.Uint64(limit[16:24])
+		}
+		sv.Limit = subvolumeLimit(rfer, excl)
+	}
+
+	return sv, nil
+}
+
+func (b *ioctlBackend) removeStaleQgroups(ctx context.Context, path string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	// level-0 qgroup info items have offsets below 1/0
+	var ids []uint64
+	err = searchTree(f, btrfsSearchKey{
+		treeID:    btrfsQuotaTreeObjectID,
+		maxOffset: qgroupID(1, 0) - 1,
+		minType:   btrfsQgroupInfoKey,
+		maxType:   btrfsQgroupInfoKey,
+	}, func(hdr *btrfsSearchHeader, _ []byte) bool {
+		ids = append(ids, hdr.offset)
+		return true
+	})
+	if errors.Is(err, unix.ENOENT) {
+		// quota tree does not exist, quotas are disabled
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, id := range ids {
+		if id == btrfsFsTreeObjectID {
+			continue
+		}
+
+		exists := false
+		err := searchTree(f, btrfsSearchKey{
+			treeID:      btrfsRootTreeObjectID,
+			minObjectID: id,
+			maxObjectID: id,
+			maxOffset:   math.MaxUint64,
+			minType:     btrfsRootItemKey,
+			maxType:     btrfsRootItemKey,
+		}, func(*btrfsSearchHeader, []byte) bool {
+			exists = true
+			return false
+		})
+		if err != nil {
+			return removed, err
+		}
+		if exists {
+			continue
+		}
+
+		args := &btrfsQgroupCreateArgs{create: 0, qgroupid: id}
+		if err := ioctl(f, "BTRFS_IOC_QGROUP_CREATE", ioctlQgroupCreate, unsafe.Pointer(args)); err != nil {
+			// the subvolume may still be cleaned up by the kernel
+			btrfsLogger.Info("Warning: error on stale qgroup destroy", "Qgroup", id, "Path", path, "Err", err.Error())
+			continue
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+func (b *ioctlBackend) checkQuota(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	status, err := searchQuotaItem(f, btrfsQgroupStatusKey, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("%s: %w", path, lsm.ErrQuotaDisabled)
+	}
+	if err != nil {
+		return err
+	}
+	// struct btrfs_qgroup_status_item: version, generation, flags, rescan
+	if len(status) < 24 || binary.LittleEndian.Uint64(status[16:24])&btrfsQgroupStatusFlagOn == 0 {
+		return fmt.Errorf("%s: %w", path, lsm.ErrQuotaDisabled)
+	}
+
+	return nil
+}
+
+func (b *ioctlBackend) usage(ctx context.Context, path string) (*usage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	spaces, err := spaceInfo(f)
+	if err != nil {
+		return nil, err
+	}
+
+	fsInfo := &btrfsFsInfoArgs{}
+	if err := ioctl(f, "BTRFS_IOC_FS_INFO", ioctlFsInfo, unsafe.Pointer(fsInfo)); err != nil {
+		return nil, err
+	}
+
+	var devSize, unallocated uint64
+	for id := uint64(1); id <= fsInfo.maxID; id++ {
+		dev := &btrfsDevInfoArgs{devid: id}
+		err := ioctl(f, "BTRFS_IOC_DEV_INFO", ioctlDevInfo, unsafe.Pointer(dev))
+		if errors.Is(err, unix.ENODEV) {
+			// device ids may have holes after device removal
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		devSize += dev.totalBytes
+		if dev.totalBytes > dev.bytesUsed {
+			unallocated += dev.totalBytes - dev.bytesUsed
+		}
+	}
+
+	// space info sizes are logical, device sizes are raw
+	ratio := 1.0
+	var dataFree uint64
+	for _, sp := range spaces {
+		if sp.flags&btrfsBlockGroupData == 0 {
+			continue
+		}
+		ratio = max(ratio, dataRatio(sp.flags, fsInfo.numDevices))
+		if sp.totalBytes > sp.usedBytes {
+			dataFree += sp.totalBytes - sp.usedBytes
+		}
+	}
+
+	return &usage{
+		Size: uint64(float64(devSize) / ratio),
+		Free: dataFree + uint64(float64(unallocated)/ratio),
+	}, nil
+}
+
+func spaceInfo(f *os.File) ([]btrfsSpaceInfo, error) {
+	// the first call with zero slots returns the number of spaces
+	args := &btrfsSpaceArgs{}
+	if err := ioctl(f, "BTRFS_IOC_SPACE_INFO", ioctlSpaceInfo, unsafe.Pointer(args)); err != nil {
+		return nil, err
+	}
+	if args.totalSpaces == 0 {
+		return nil, nil
+	}
+
+	// struct btrfs_ioctl_space_args followed by the array of struct btrfs_ioctl_space_info
+	n := args.totalSpaces
+	buf := make([]uint64, 2+3*n)
+	buf[0] = n
+	if err := ioctl(f, "BTRFS_IOC_SPACE_INFO", ioctlSpaceInfo, unsafe.Pointer(&buf[0])); err != nil {
+		return nil, err
+	}
+
+	n = min(n, buf[1])
+	spaces := make([]btrfsSpaceInfo, 0, n)
+	for i := uint64(0); i < n; i++ {
+		o := 2 + 3*i
+		spaces = append(spaces, btrfsSpaceInfo{flags: buf[o], totalBytes: buf[o+1], usedBytes: buf[o+2]})
+	}
+
+	return spaces, nil
+}
+
+// dataRatio returns how many raw bytes are used for one logical byte with the block group profile.
+func dataRatio(flags, numDevices uint64) float64 {
+	switch {
+	case flags&(btrfsBlockGroupRaid1|btrfsBlockGroupDup|btrfsBlockGroupRaid10) != 0:
+		return 2
+	case flags&btrfsBlockGroupRaid1C3 != 0:
+		return 3
+	case flags&btrfsBlockGroupRaid1C4 != 0:
+		return 4
+	case flags&btrfsBlockGroupRaid5 != 0 && numDevices > 1:
+		return float64(numDevices) / float64(numDevices-1)
+	case flags&btrfsBlockGroupRaid6 != 0 && numDevices > 2:
+		return float64(numDevices) / float64(numDevices-2)
+	}
+	return 1
+}
+
+// searchTree calls fn for every item matching the key until fn returns false.
+// Object id and type ranges of the key must be single values or offsets must be unrestricted,
+// as the search is continued from the offset after the last found item.
+func searchTree(f *os.File, key btrfsSearchKey, fn func(hdr *btrfsSearchHeader, item []byte) bool) error {
+	args := &btrfsSearchArgs{key: key}
+	args.key.maxTransID = math.MaxUint64
+
+	for {
+		args.key.nrItems = math.MaxUint32
+		if err := ioctl(f, "BTRFS_IOC_TREE_SEARCH", ioctlTreeSearch, unsafe.Pointer(args)); err != nil {
+			return err
+		}
+		if args.key.nrItems == 0 {
+			return nil
+		}
+
+		var last *btrfsSearchHeader
+		off := 0
+		for i := uint32(0); i < args.key.nrItems; i++ {
+			if off+btrfsSearchHdrSize > len(args.buf) {
+				break
+			}
+			hdr := (*btrfsSearchHeader)(unsafe.Pointer(&args.buf[off]))
+			off += btrfsSearchHdrSize
+			end := off + int(hdr.len)
+			if end > len(args.buf) {
+				break
+			}
+			if !fn(hdr, args.buf[off:end]) {
+				return nil
+			}
+			last = hdr
+			off = end
+		}
+
+		if last == nil || last.offset == math.MaxUint64 || last.offset >= args.key.maxOffset {
+			return nil
+		}
+		args.key.minObjectID = last.objectid
+		args.key.minType = last.typ
+		args.key.minOffset = last.offset + 1
+	}
+}
+
+// searchQuotaItem returns the raw item of the given type for a qgroup from the quota tree.
+// It returns nil if there is no such item.
+func searchQuotaItem(f *os.File, typ uint32, qgroupid uint64) ([]byte, error) {
+	args := &btrfsSearchArgs{
+		key: btrfsSearchKey{
+			treeID:     btrfsQuotaTreeObjectID,
+			minOffset:  qgroupid,
+			maxOffset:  qgroupid,
+			maxTransID: math.MaxUint64,
+			minType:    typ,
+			maxType:    typ,
+			nrItems:    1,
+		},
+	}
+
+	if err := ioctl(f, "BTRFS_IOC_TREE_SEARCH", ioctlTreeSearch, unsafe.Pointer(args)); err != nil {
+		return nil, err
+	}
+
+	off := 0
+	for i := uint32(0); i < args.key.nrItems; i++ {
+		if off+btrfsSearchHdrSize > len(args.buf) {
+			break
+		}
+		hdr := (*btrfsSearchHeader)(unsafe.Pointer(&args.buf[off]))
+		off += btrfsSearchHdrSize
+		end := off + int(hdr.len)
+		if end > len(args.buf) {
+			break
+		}
+		if hdr.typ == typ && hdr.offset == qgroupid {
+			return args.buf[off:end], nil
+		}
+		off = end
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,85 @@
+package btrfs
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestIoctlArgsSize(t *testing.T) {
+	sizes := []struct {
+		name     string
+		actual   uintptr
+		expected uintptr
+	}{
+		{"btrfs_ioctl_vol_args", unsafe.Sizeof(btrfsVolArgs{}), 4096},
+		{"btrfs_ioctl_vol_args_v2", unsafe.Sizeof(btrfsVolArgsV2{}), 4096},
+		{"btrfs_ioctl_ino_lookup_args", unsafe.Sizeof(btrfsInoLookupArgs{}), 4096},
+		{"btrfs_ioctl_search_key", unsafe.Sizeof(btrfsSearchKey{}), 104},
+		{"btrfs_ioctl_search_args", unsafe.Sizeof(btrfsSearchArgs{}), 4096},
+		{"btrfs_ioctl_search_header", unsafe.Sizeof(btrfsSearchHeader{}), 32},
+		{"btrfs_ioctl_qgroup_limit_args", unsafe.Sizeof(btrfsQgroupLimitArgs{}), 48},
+		{"btrfs_ioctl_qgroup_create_args", unsafe.Sizeof(btrfsQgroupCreateArgs{}), 16},
+		{"btrfs_ioctl_qgroup_assign_args", unsafe.Sizeof(btrfsQgroupAssignArgs{}), 24},
+		{"btrfs_ioctl_quota_rescan_args", unsafe.Sizeof(btrfsQuotaRescanArgs{}), 64},
+		{"btrfs_ioctl_space_args", unsafe.Sizeof(btrfsSpaceArgs{}), 16},
+		{"btrfs_ioctl_space_info", unsafe.Sizeof(btrfsSpaceInfo{}), 24},
+		{"btrfs_ioctl_fs_info_args", unsafe.Sizeof(btrfsFsInfoArgs{}), 1024},
+		{"btrfs_ioctl_dev_info_args", unsafe.Sizeof(btrfsDevInfoArgs{}), 4096},
+	}
+
+	for _, s := range sizes {
+		if s.actual != s.expected {
+			t.Errorf("size of %s should be %d: %d", s.name, s.expected, s.actual)
+		}
+	}
+}
+
+func TestIoctlNumbers(t *testing.T) {
+	// values from linux/btrfs.h as computed by the C preprocessor
+	numbers := []struct {
+		name     string
+		actual   uintptr
+		expected uintptr
+	}{
+		{"BTRFS_IOC_SYNC", ioctlSync, 0x9408},
+		{"BTRFS_IOC_SUBVOL_CREATE", ioctlSubvolCreate, 0x5000940e},
+		{"BTRFS_IOC_SNAP_DESTROY", ioctlSnapDestroy, 0x5000940f},
+		{"BTRFS_IOC_TREE_SEARCH", ioctlTreeSearch, 0xd0009411},
+		{"BTRFS_IOC_INO_LOOKUP", ioctlInoLookup, 0xd0009412},
+		{"BTRFS_IOC_SPACE_INFO", ioctlSpaceInfo, 0xc0109414},
+		{"BTRFS_IOC_SNAP_CREATE_V2", ioctlSnapCreateV2, 0x50009417},
+		{"BTRFS_IOC_DEV_INFO", ioctlDevInfo, 0xd000941e},
+		{"BTRFS_IOC_FS_INFO", ioctlFsInfo, 0x8400941f},
+		{"BTRFS_IOC_QGROUP_ASSIGN", ioctlQgroupAssign, 0x40189429},
+		{"BTRFS_IOC_QGROUP_CREATE", ioctlQgroupCreate, 0x4010942a},
+		{"BTRFS_IOC_QGROUP_LIMIT", ioctlQgroupLimit, 0x8030942b},
+		{"BTRFS_IOC_QUOTA_RESCAN", ioctlQuotaRescan, 0x4040942c},
+	}
+
+	for _, n := range numbers {
+		if n.actual != n.expected {
+			t.Errorf("%s should be %#x: %#x", n.name, n.expected, n.actual)
+		}
+	}
+}
+
+func TestDataRatio(t *testing.T) {
+	ratios := []struct {
+		flags      uint64
+		numDevices uint64
+		expected   float64
+	}{
+		{btrfsBlockGroupData, 1, 1},
+		{btrfsBlockGroupData | btrfsBlockGroupDup, 1, 2},
+		{btrfsBlockGroupData | btrfsBlockGroupRaid1, 2, 2},
+		{btrfsBlockGroupData | btrfsBlockGroupRaid1C3, 3, 3},
+		{btrfsBlockGroupData | btrfsBlockGroupRaid5, 4, 4.0 / 3},
+		{btrfsBlockGroupData | btrfsBlockGroupRaid6, 4, 2},
+	}
+
+	for _, r := range ratios {
+		if actual := dataRatio(r.flags, r.numDevices); actual != r.expected {
+			t.Errorf("ratio for flags %#x and %d devices should be %v: %v", r.flags, r.numDevices, r.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package btrfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kvaster/topols/pkg/lsm"
+)
+
+// metaDir is the directory in the device class path with metadata records of volumes.
+// It is skipped when volumes are scanned.
+const metaDir = ".topols"
+
+const metaExt = ".json"
+
+func (d *deviceClass) metaPath(name string) string {
+	return filepath.Join(d.Path, metaDir, name+metaExt)
+}
+
+// readMeta returns the metadata record of the volume, nil if the volume has no record.
+func (d *deviceClass) readMeta(name string) (*lsm.VolumeMeta, error) {
+	b, err := os.ReadFile(d.metaPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &lsm.VolumeMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// writeMeta replaces the metadata record of the volume atomically.
+func (d *deviceClass) writeMeta(meta *lsm.VolumeMeta) error {
+	if err := os.MkdirAll(filepath.Join(d.Path, metaDir), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	path := d.metaPath(meta.Name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (d *deviceClass) removeMeta(name string) error {
+	err := os.Remove(d.metaPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// saveMeta writes the metadata record and only logs errors, the record is not required to use the volume.
+func (d *deviceClass) saveMeta(meta *lsm.VolumeMeta) {
+	if err := d.writeMeta(meta); err != nil {
+		btrfsLogger.Info("Warning: error writing volume metadata", "DeviceClass", d.Name, "Name", meta.Name, "Err", err.Error())
+	}
+}
+
+// metaNames returns names of volumes which have metadata records.
+func (d *deviceClass) metaNames() ([]string, error) {
+	files, err := os.ReadDir(filepath.Join(d.Path, metaDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if name, ok := strings.CutSuffix(file.Name(), metaExt); ok && !file.IsDir() {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,111 @@
+package btrfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kvaster/topols/internal/lock"
+	"github.com/kvaster/topols/pkg/lsm"
+)
+
+// dirDriver creates volumes as plain directories.
+type dirDriver struct {
+	staticDriver
+}
+
+func (d *dirDriver) CreateVolume(ctx context.Context, path string, limit lsm.Limit, opts lsm.VolumeOptions) error {
+	return os.Mkdir(path, 0755)
+}
+
+func (d *dirDriver) RemoveVolume(ctx context.Context, path string) error {
+	return os.Remove(path)
+}
+
+func (d *dirDriver) SetLimit(ctx context.Context, path string, limit lsm.Limit) error {
+	return nil
+}
+
+func TestVolumeMeta(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+	c := &btrfs{drivers: lsm.DriverRegistry{lsm.DefaultFsType: &dirDriver{}}, volumeLock: lock.NewLockWithID()}
+	cnf := &deviceClass{Name: "ssd", Type: lsm.DefaultFsType, Path: path, Size: 100, OvercommitRatio: 1, QuotaMode: lsm.QuotaReferenced}
+	dc, err := c.newDeviceClass(ctx, cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deviceClasses = []*deviceClass{dc}
+
+	owner := lsm.VolumeOwner{LogicalVolume: "pvc-1", PVCNamespace: "default", PVCName: "data"}
+	if _, err := c.CreateLV(ctx, "a", "ssd", lsm.VolumeOptions{NoCow: true}, 10, owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResizeLV(ctx, "a", "ssd", 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// the node is restarted, metadata is read from the record
+	dc, err = c.newDeviceClass(ctx, cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.Volumes) != 1 || len(dc.Unknown) != 0 {
+		t.Fatalf("metadata directory should be skipped: %v, %v", dc.Volumes, dc.Unknown)
+	}
+	meta := dc.Volumes[0].Meta
+	if meta == nil || meta.VolumeOwner != owner || !meta.Options.NoCow || meta.Size != 20 || meta.CreatedAt.IsZero() {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	c.deviceClasses = []*deviceClass{dc}
+
+	// a record left by a crash is removed as stale
+	if err := dc.writeMeta(&lsm.VolumeMeta{Name: "b", DeviceClass: "ssd"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveLV(ctx, "a", "ssd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dc.metaPath("a")); !os.IsNotExist(err) {
+		t.Errorf("record should be removed with the volume: %v", err)
+	}
+	if _, err := c.RemoveStale(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := dc.metaNames(); len(names) != 0 {
+		t.Errorf("stale records should be removed: %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(path, metaDir)); err != nil {
+		t.Errorf("metadata directory should stay: %v", err)
+	}
+}
+
+func TestSetBlock(t *testing.T) {
+	ctx := context.Background()
+	c := &btrfs{drivers: lsm.DriverRegistry{lsm.DefaultFsType: &dirDriver{}}, volumeLock: lock.NewLockWithID()}
+	cnf := &deviceClass{Name: "ssd", Type: lsm.DefaultFsType, Path: t.TempDir(), Size: 100, OvercommitRatio: 1, QuotaMode: lsm.QuotaReferenced}
+	dc, err := c.newDeviceClass(ctx, cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deviceClasses = []*deviceClass{dc}
+
+	owner := lsm.VolumeOwner{LogicalVolume: "pvc-1"}
+	if _, err := c.CreateLV(ctx, "a", "ssd", lsm.VolumeOptions{}, 10, owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetBlock(ctx, "a", "ssd"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the node is restarted, the mode is read from the record
+	dc, err = c.newDeviceClass(ctx, cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := dc.Volumes[0].Meta
+	if meta == nil || !meta.Block || meta.VolumeOwner != owner {
+		t.Errorf("block volume should be recorded: %+v", meta)
+	}
+}
@@ -0,0 +1,79 @@
+package btrfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kvaster/topols/pkg/lsm"
+)
+
+var _ lsm.StreamDriver = &driver{}
+
+// Send runs btrfs send with any backend, the kernel send stream is only produced by btrfs-progs.
+func (d *driver) Send(ctx context.Context, path, parent string, w io.Writer) error {
+	args := []string{"send", "-q"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	return runStreamCmd(ctx, nil, w, "/sbin/btrfs", append(args, path)...)
+}
+
+// Receive runs btrfs receive with any backend, the send stream is applied by btrfs-progs in userspace.
+func (d *driver) Receive(ctx context.Context, dir string, r io.Reader) (string, error) {
+	before, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if err := runStreamCmd(ctx, r, nil, "/sbin/btrfs", "receive", dir); err != nil {
+		return "", err
+	}
+
+	// the received subvolume has the name of the sent one, it is the only new entry
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var received []string
+	for _, f := range after {
+		if !slices.ContainsFunc(before, func(b os.DirEntry) bool { return b.Name() == f.Name() }) {
+			received = append(received, f.Name())
+		}
+	}
+	if len(received) != 1 {
+		return "", fmt.Errorf("%s: one received subvolume is expected, found %d new entries", dir, len(received))
+	}
+
+	return filepath.Join(dir, received[0]), nil
+}
+
+// runStreamCmd is runCmd for commands which stream data through stdin or stdout.
+// It has no timeout because the time depends on the volume size.
+func runStreamCmd(ctx context.Context, stdin io.Reader, stdout io.Writer, cmd string, args ...string) error {
+	var stderr bytes.Buffer
+
+	c := exec.CommandContext(ctx, cmd, args...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = &stderr
+
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s %s: %w", cmd, strings.Join(args, " "), ctx.Err())
+		}
+		btrfsLogger.Info("Stream command failed", "Cmd", cmd, "Args", args, "Err", err.Error(), "Out", stderr.String())
+		if stderr.Len() == 0 {
+			return err
+		}
+		return cliError(stderr.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package btrfs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kvaster/topols/internal/lock"
+	"github.com/kvaster/topols/pkg/lsm"
+)
+
+// streamDriver keeps the content of a volume in the data file and sends it together with the snapshot names.
+type streamDriver struct {
+	dirDriver
+}
+
+func (d *streamDriver) CreateSnapshot(ctx context.Context, srcPath, path string, limit lsm.Limit, readOnly bool) error {
+	data, err := os.ReadFile(filepath.Join(srcPath, "data"))
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(path, "data"), data, 0644)
+}
+
+func (d *streamDriver) RemoveVolume(ctx context.Context, path string) error {
+	return os.RemoveAll(path)
+}
+
+func (d *streamDriver) Send(ctx context.Context, path, parent string, w io.Writer) error {
+	data, err := os.ReadFile(filepath.Join(path, "data"))
+	if err != nil {
+		return err
+	}
+	if parent != "" {
+		parent = filepath.Base(parent)
+	}
+	_, err = fmt.Fprintf(w, "%s\n%s\n%s", filepath.Base(path), parent, data)
+	return err
+}
+
+func (d *streamDriver) Receive(ctx context.Context, dir string, r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+	name, _ := br.ReadString('\n')
+	parent, _ := br.ReadString('\n')
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return "", err
+	}
+	if parent = strings.TrimSpace(parent); parent != "" {
+		if _, err := os.Stat(filepath.Join(dir, parent)); err != nil {
+			return "", fmt.Errorf("parent is not received: %w", err)
+		}
+	}
+	path := filepath.Join(dir, strings.TrimSpace(name))
+	if err := os.Mkdir(path, 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(filepath.Join(path, "data"), data, 0644)
+}
+
+func newStreamClient(t *testing.T) (*btrfs, *deviceClass) {
+	c := &btrfs{drivers: lsm.DriverRegistry{lsm.DefaultFsType: &streamDriver{}}, volumeLock: lock.NewLockWithID()}
+	dc, err := c.newDeviceClass(context.Background(), &deviceClass{Name: "ssd", Type: lsm.DefaultFsType, Path: t.TempDir(), Size: 100, OvercommitRatio: 1, QuotaMode: lsm.QuotaReferenced})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deviceClasses = []*deviceClass{dc}
+	return c, dc
+}
+
+func TestIncrementalPasses(t *testing.T) {
+	ctx := context.Background()
+	src, srcDc := newStreamClient(t)
+	dst, dstDc := newStreamClient(t)
+
+	if _, err := src.CreateLV(ctx, "a", "ssd", lsm.VolumeOptions{}, 10, lsm.VolumeOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pass := func(pass int, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(srcDc.volumePath("a"), "data"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(src.SendLVIncremental(ctx, "a", "ssd", pass, pw))
+		}()
+		if err := dst.ReceiveLVIncremental(ctx, "a", "ssd", pass, pr); err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+	}
+
+	pass(0, "v0")
+	pass(1, "v1")
+	pass(2, "v2")
+	// the pass is repeated, i.e. after the status update failed
+	pass(2, "v3")
+
+	for _, dc := range []*deviceClass{srcDc, dstDc} {
+		files, err := os.ReadDir(dc.incrementalDir("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 || files[0].Name() != "1" || files[1].Name() != "2" {
+			t.Errorf("only snapshots of the last two passes should be kept: %v", files)
+		}
+	}
+
+	v, err := dst.CompleteLVIncremental(ctx, "a", "ssd", 2, lsm.VolumeOptions{}, 10, lsm.VolumeOwner{LogicalVolume: "pvc-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Meta == nil || v.Meta.LogicalVolume != "pvc-a" {
+		t.Errorf("unexpected volume: %+v", v)
+	}
+	if data, err := os.ReadFile(filepath.Join(dstDc.volumePath("a"), "data")); err != nil || string(data) != "v3" {
+		t.Errorf("volume should have the data of the last pass: %q, %v", data, err)
+	}
+	if _, err := os.Stat(dstDc.incrementalDir("a")); !os.IsNotExist(err) {
+		t.Errorf("received snapshots should be removed: %v", err)
+	}
+	if _, err := dst.CompleteLVIncremental(ctx, "a", "ssd", 2, lsm.VolumeOptions{}, 10, lsm.VolumeOwner{}); err != lsm.ErrAlreadyExists {
+		t.Errorf("ErrAlreadyExists should be returned: %v", err)
+	}
+
+	if err := src.RemoveLVIncremental(ctx, "a", "ssd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(srcDc.incrementalDir("a")); !os.IsNotExist(err) {
+		t.Errorf("snapshots should be removed: %v", err)
+	}
+}
+
+func TestReceiveSnapshotAsPass(t *testing.T) {
+	ctx := context.Background()
+	src, srcDc := newStreamClient(t)
+	dst, dstDc := newStreamClient(t)
+
+	if _, err := src.CreateLV(ctx, "a", "ssd", lsm.VolumeOptions{}, 10, lsm.VolumeOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDc.volumePath("a"), "data"), []byte("backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.CreateLVSnapshot(ctx, "snap", "ssd", "a", 10, "ro", lsm.VolumeOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// streams of backups are received as passes of the restored volume
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.SendLV(ctx, "snap", "ssd", "", pw))
+	}()
+	if err := dst.ReceiveLVIncremental(ctx, "restored", "ssd", 0, pr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dstDc.incrementalPath("restored", 0)); err != nil {
+		t.Errorf("received snapshot should be renamed to the pass: %v", err)
+	}
+
+	if _, err := dst.CompleteLVIncremental(ctx, "restored", "ssd", 0, lsm.VolumeOptions{}, 10, lsm.VolumeOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dstDc.volumePath("restored"), "data")); err != nil || string(data) != "backup" {
+		t.Errorf("volume should have the data of the snapshot: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,367 @@
+// Package projquota implements lsm.Driver for XFS and ext4 with project quotas.
+//
+// Every volume is a directory with its own project ID. The directory has
+// the PROJINHERIT flag, so everything created inside belongs to the same project,
+// and the block hard limit of the project is the volume size.
+// The filesystem must be mounted with project quotas enabled (prjquota),
+// and the kernel must support quotactl_fd (Linux 5.14 or later).
+// Quota syscalls can't be interrupted, so the context is checked only before an operation starts.
+package projquota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/kvaster/topols/pkg/lsm"
+	"golang.org/x/sys/unix"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	FsTypeXFS  = "xfs"
+	FsTypeExt4 = "ext4"
+)
+
+var pqLogger = ctrl.Log.WithName("lsm").WithName("projquota")
+
+// Definitions below mirror include/uapi/linux/fs.h and include/uapi/linux/quota.h.
+
+const (
+	fsXflagProjinherit = 0x200
+
+	prjQuota = 2
+
+	qGetQuota     = 0x800007
+	qSetQuota     = 0x800008
+	qGetNextQuota = 0x800009
+
+	qifBLimits = 1
+
+	// quota block limits are in 1KiB units
+	qifDqblkSize = 1024
+)
+
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+type ifNextDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+	id         uint32
+}
+
+var (
+	ioctlFsGetXattr = uintptr(2<<30 | unsafe.Sizeof(fsxattr{})<<16 | 'X'<<8 | 31)
+	ioctlFsSetXattr = uintptr(1<<30 | unsafe.Sizeof(fsxattr{})<<16 | 'X'<<8 | 32)
+)
+
+func qcmd(cmd, typ uint32) uintptr {
+	return uintptr(cmd<<8 | typ&0xff)
+}
+
+type driver struct {
+	fsType string
+	magic  int64
+
+	// protects project id allocation
+	mu sync.Mutex
+}
+
+// NewDriver returns lsm.Driver for the filesystem type, FsTypeXFS or FsTypeExt4.
+func NewDriver(fsType string) (lsm.Driver, error) {
+	switch fsType {
+	case FsTypeXFS:
+		return &driver{fsType: fsType, magic: unix.XFS_SUPER_MAGIC}, nil
+	case FsTypeExt4:
+		return &driver{fsType: fsType, magic: unix.EXT4_SUPER_MAGIC}, nil
+	}
+
+	return nil, fmt.Errorf("project quotas are not supported for filesystem type: %s", fsType)
+}
+
+func (d *driver) CheckPool(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := d.checkFs(path); err != nil {
+		return err
+	}
+
+	// fails when project quotas are not enabled
+	if _, err := getQuota(path, 0); err != nil {
+		return fmt.Errorf("%w: %s: %w", lsm.ErrQuotaDisabled, path, err)
+	}
+
+	return nil
+}
+
+func (d *driver) PoolStats(ctx context.Context, path string) (*lsm.PoolStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+
+	return &lsm.PoolStats{SizeBytes: st.Blocks * uint64(st.Bsize), FreeBytes: st.Bavail * uint64(st.Bsize)}, nil
+}
+
+func (d *driver) CreateVolume(ctx context.Context, path string, limit lsm.Limit, opts lsm.VolumeOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if limit.Mode == lsm.QuotaExclusive || opts.NoCow || opts.Compression != "" {
+		return lsm.ErrNotSupported
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkFs(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	projID, err := nextProjectID(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		return err
+	}
+
+	err = setProjectID(path, projID)
+	if err == nil {
+		err = setQuota(path, projID, limit.Size)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+
+	return nil
+}
+
+func (d *driver) CreateSnapshot(ctx context.Context, srcPath, path string, limit lsm.Limit, readOnly bool) error {
+	return lsm.ErrNotSupported
+}
+
+func (d *driver) RemoveVolume(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	projID, err := getProjectID(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	// the project is not used anymore, drop the limit on the parent
+	if err := setQuota(filepath.Dir(path), projID, 0); err != nil {
+		pqLogger.Info("Warning: error on quota reset", "Err", err.Error(), "Path", path, "ProjectID", projID)
+	}
+
+	return nil
+}
+
+func (d *driver) SetLimit(ctx context.Context, path string, limit lsm.Limit) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if limit.Mode == lsm.QuotaExclusive {
+		return lsm.ErrNotSupported
+	}
+
+	projID, err := getProjectID(path)
+	if err != nil {
+		return err
+	}
+
+	return setQuota(path, projID, limit.Size)
+}
+
+func (d *driver) VolumeInfo(ctx context.Context, path string) (*lsm.VolumeInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	projID, err := getProjectID(path)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := getQuota(path, projID)
+	if err != nil {
+		return nil, err
+	}
+
+	// project data is never shared, so all of it is exclusive
+	return &lsm.VolumeInfo{
+		Limit:      lsm.Limit{Size: q.bhardlimit * qifDqblkSize, Mode: lsm.QuotaReferenced},
+		Referenced: q.curspace,
+		Exclusive:  q.curspace,
+	}, nil
+}
+
+func (d *driver) checkFs(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	if int64(st.Type) != d.magic {
+		return fmt.Errorf("%s is not on %s filesystem", path, d.fsType)
+	}
+	return nil
+}
+
+func getProjectID(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var attr fsxattr
+	if err := ioctl(f, ioctlFsGetXattr, unsafe.Pointer(&attr)); err != nil {
+		return 0, err
+	}
+	if attr.projid == 0 {
+		// volumes always have a project id
+		return 0, fmt.Errorf("%s: %w", path, lsm.ErrNotVolume)
+	}
+
+	return attr.projid, nil
+}
+
+func setProjectID(path string, projID uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	var attr fsxattr
+	if err := ioctl(f, ioctlFsGetXattr, unsafe.Pointer(&attr)); err != nil {
+		return err
+	}
+
+	attr.projid = projID
+	attr.xflags |= fsXflagProjinherit
+
+	return ioctl(f, ioctlFsSetXattr, unsafe.Pointer(&attr))
+}
+
+// nextProjectID returns a project id which is not used on the filesystem of path.
+func nextProjectID(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var maxID uint32
+	id := uint32(0)
+	for {
+		var q ifNextDqblk
+		err := quotactl(f, qcmd(qGetNextQuota, prjQuota), id, unsafe.Pointer(&q))
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ESRCH) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		maxID = max(maxID, q.id)
+		if q.id == ^uint32(0) {
+			return 0, errors.New("no free project id")
+		}
+		id = q.id + 1
+	}
+
+	return maxID + 1, nil
+}
+
+func getQuota(path string, projID uint32) (*ifDqblk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	q := &ifDqblk{}
+	if err := quotactl(f, qcmd(qGetQuota, prjQuota), projID, unsafe.Pointer(q)); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func setQuota(path string, projID uint32, size uint64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	q := &ifDqblk{
+		bhardlimit: (size + qifDqblkSize - 1) / qifDqblkSize,
+		valid:      qifBLimits,
+	}
+
+	return quotactl(f, qcmd(qSetQuota, prjQuota), projID, unsafe.Pointer(q))
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return fmt.Errorf("ioctl %#x on %s: %w", req, f.Name(), errno)
+	}
+	return nil
+}
+
+func quotactl(f *os.File, cmd uintptr, id uint32, addr unsafe.Pointer) error {
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, f.Fd(), cmd, uintptr(id), uintptr(addr), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("quotactl %#x id %d on %s: %w", cmd, id, f.Name(), errno)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package projquota
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestStructSize(t *testing.T) {
+	if s := unsafe.Sizeof(fsxattr{}); s != 28 {
+		t.Errorf("size of fsxattr should be 28: %d", s)
+	}
+	if s := unsafe.Sizeof(ifDqblk{}); s != 72 {
+		t.Errorf("size of if_dqblk should be 72: %d", s)
+	}
+	if s := unsafe.Sizeof(ifNextDqblk{}); s != 72 {
+		t.Errorf("size of if_nextdqblk should be 72: %d", s)
+	}
+	if o := unsafe.Offsetof(ifNextDqblk{}.id); o != 68 {
+		t.Errorf("offset of if_nextdqblk.dqb_id should be 68: %d", o)
+	}
+}
+
+func TestIoctlNumbers(t *testing.T) {
+	if ioctlFsGetXattr != 0x801c581f {
+		t.Errorf("FS_IOC_FSGETXATTR should be 0x801c581f: %#x", ioctlFsGetXattr)
+	}
+	if ioctlFsSetXattr != 0x401c5820 {
+		t.Errorf("FS_IOC_FSSETXATTR should be 0x401c5820: %#x", ioctlFsSetXattr)
+	}
+	if c := qcmd(qGetQuota, prjQuota); c != 0x80000702 {
+		t.Errorf("QCMD(Q_GETQUOTA, PRJQUOTA) should be 0x80000702: %#x", c)
+	}
+}
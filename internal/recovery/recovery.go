@@ -0,0 +1,264 @@
+// Package recovery recreates LogicalVolume and PersistentVolume resources for volumes which exist on a node.
+package recovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/kvaster/topols"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var logger = ctrl.Log.WithName("recovery")
+
+// Options configures what is recreated.
+type Options struct {
+	// PersistentVolumes enables creation of PersistentVolumes, they are bound to the PVC if it is known.
+	PersistentVolumes bool
+	// StorageClass is the storage class of created PersistentVolumes.
+	StorageClass string
+	// ReclaimPolicy is the reclaim policy of created PersistentVolumes.
+	ReclaimPolicy corev1.PersistentVolumeReclaimPolicy
+}
+
+// Plan is the set of resources to create.
+type Plan struct {
+	LogicalVolumes    []*topolsv1.LogicalVolume
+	PersistentVolumes []*corev1.PersistentVolume
+	// Skipped are volumes which can't be recovered with the reason.
+	Skipped map[string]string
+}
+
+// NewPlan returns resources to create for volumes of the node which have no LogicalVolume.
+// The name of LogicalVolume is taken from the volume metadata, the volume name is used if there is no metadata.
+func NewPlan(nodeName string, volumes []*lsm.LogicalVolume, lvs []topolsv1.LogicalVolume, pvs []corev1.PersistentVolume, opts Options) *Plan {
+	p := &Plan{Skipped: make(map[string]string)}
+
+	known := make(map[string]bool)
+	names := make(map[string]bool)
+	// lvNames maps volume IDs to names of their LogicalVolumes to find sources of snapshots and clones
+	lvNames := make(map[string]string)
+	for _, lv := range lvs {
+		names[lv.Name] = true
+		if lv.Status.VolumeID != "" {
+			lvNames[lv.Status.VolumeID] = lv.Name
+		}
+		if lv.Spec.NodeName != nodeName {
+			continue
+		}
+		known[string(lv.UID)] = true
+		for _, name := range []string{lv.Status.VolumeID, lv.Annotations[topols.RecoveredVolumeKey]} {
+			if name != "" {
+				known[name] = true
+			}
+		}
+	}
+
+	pvNames := make(map[string]bool)
+	handles := make(map[string]bool)
+	for _, pv := range pvs {
+		pvNames[pv.Name] = true
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == topols.PluginName {
+			handles[pv.Spec.CSI.VolumeHandle] = true
+		}
+	}
+
+	// names are chosen first, a source may be recovered together with its snapshots
+	var recovered []*lsm.LogicalVolume
+	for _, v := range volumes {
+		if known[v.Name] {
+			continue
+		}
+
+		name := v.Name
+		if v.Meta != nil && v.Meta.LogicalVolume != "" {
+			name = v.Meta.LogicalVolume
+		}
+		if names[name] {
+			p.Skipped[v.Name] = fmt.Sprintf("LogicalVolume %s exists for another volume", name)
+			continue
+		}
+		names[name] = true
+		lvNames[v.Name] = name
+		recovered = append(recovered, v)
+	}
+
+	for _, v := range recovered {
+		name := lvNames[v.Name]
+		lv := newLogicalVolume(name, nodeName, v, lvNames)
+		p.LogicalVolumes = append(p.LogicalVolumes, lv)
+
+		// snapshots are not bound to PVCs
+		if opts.PersistentVolumes && lv.Spec.AccessType != "ro" && !pvNames[name] && !handles[v.Name] {
+			p.PersistentVolumes = append(p.PersistentVolumes, newPersistentVolume(lv, v.Meta, opts))
+		}
+	}
+
+	sort.Slice(p.LogicalVolumes, func(i, j int) bool { return p.LogicalVolumes[i].Name < p.LogicalVolumes[j].Name })
+	sort.Slice(p.PersistentVolumes, func(i, j int) bool { return p.PersistentVolumes[i].Name < p.PersistentVolumes[j].Name })
+
+	return p
+}
+
+func newLogicalVolume(name, nodeName string, v *lsm.LogicalVolume, lvNames map[string]string) *topolsv1.LogicalVolume {
+	size := resource.NewQuantity(int64(v.Size), resource.BinarySI)
+	lv := &topolsv1.LogicalVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: topolsv1.GroupVersion.String(), Kind: "LogicalVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{topols.RecoveredVolumeKey: v.Name},
+		},
+		Spec: topolsv1.LogicalVolumeSpec{
+			Name:        name,
+			NodeName:    nodeName,
+			Size:        *size,
+			DeviceClass: v.DeviceClass,
+		},
+		Status: topolsv1.LogicalVolumeStatus{
+			VolumeID:    v.Name,
+			CurrentSize: size,
+			Code:        codes.OK,
+		},
+	}
+
+	if m := v.Meta; m != nil {
+		lv.Spec.NoCow = m.Options.NoCow
+		lv.Spec.Compression = m.Options.Compression
+		lv.Spec.QuotaMode = string(m.QuotaMode)
+		if m.Source != "" {
+			// the volume ID is kept if the source is gone, so a snapshot stays a read-only snapshot
+			lv.Spec.Source = m.Source
+			if source, ok := lvNames[m.Source]; ok {
+				lv.Spec.Source = source
+			}
+			lv.Spec.AccessType = m.AccessType
+		}
+		if m.PVCName != "" {
+			lv.Annotations[topols.PVCNamespaceKey] = m.PVCNamespace
+			lv.Annotations[topols.PVCNameKey] = m.PVCName
+		}
+	}
+
+	return lv
+}
+
+func newPersistentVolume(lv *topolsv1.LogicalVolume, meta *lsm.VolumeMeta, opts Options) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        lv.Spec.Name,
+			Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": topols.PluginName},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:                      corev1.ResourceList{corev1.ResourceStorage: lv.Spec.Size},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: opts.ReclaimPolicy,
+			StorageClassName:              opts.StorageClass,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       topols.PluginName,
+					VolumeHandle: lv.Status.VolumeID,
+				},
+			},
+			NodeAffinity: &corev1.VolumeNodeAffinity{
+				Required: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{{
+							Key:      topols.TopologyNodeKey,
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{lv.Spec.NodeName},
+						}},
+					}},
+				},
+			},
+		},
+	}
+
+	if meta != nil && meta.Block {
+		mode := corev1.PersistentVolumeBlock
+		pv.Spec.VolumeMode = &mode
+	}
+	if meta != nil && meta.PVCName != "" {
+		pv.Spec.ClaimRef = &corev1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: meta.PVCNamespace, Name: meta.PVCName}
+	}
+
+	return pv
+}
+
+// Print writes resources of the plan as a diff against the cluster, i.e. all lines are additions.
+func (p *Plan) Print(w io.Writer) error {
+	var objs []client.Object
+	for _, lv := range p.LogicalVolumes {
+		objs = append(objs, lv)
+	}
+	for _, pv := range p.PersistentVolumes {
+		objs = append(objs, pv)
+	}
+
+	for _, obj := range objs {
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, "+---"); err != nil {
+			return err
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+			if _, err := fmt.Fprintf(w, "+%s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(p.Skipped))
+	for name := range p.Skipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "# skipped volume %s: %s\n", name, p.Skipped[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Apply creates resources of the plan. Status of LogicalVolume is set after it is created,
+// topols-node sets the same status from the annotation if it reconciles LogicalVolume first.
+func (p *Plan) Apply(ctx context.Context, c client.Client) error {
+	for _, lv := range p.LogicalVolumes {
+		status := lv.Status
+		if err := c.Create(ctx, lv); err != nil {
+			return fmt.Errorf("failed to create LogicalVolume %s: %w", lv.Name, err)
+		}
+		lv.Status = status
+		if err := c.Status().Update(ctx, lv); apierrors.IsConflict(err) {
+			logger.Info("status of LogicalVolume is set by topols-node", "name", lv.Name)
+		} else if err != nil {
+			return fmt.Errorf("failed to update status of LogicalVolume %s: %w", lv.Name, err)
+		}
+		logger.Info("created LogicalVolume", "name", lv.Name, "volumeID", lv.Status.VolumeID)
+	}
+
+	for _, pv := range p.PersistentVolumes {
+		if err := c.Create(ctx, pv); err != nil {
+			return fmt.Errorf("failed to create PersistentVolume %s: %w", pv.Name, err)
+		}
+		logger.Info("created PersistentVolume", "name", pv.Name, "volumeHandle", pv.Spec.CSI.VolumeHandle)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package recovery
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/kvaster/topols"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewPlan(t *testing.T) {
+	volumes := []*lsm.LogicalVolume{
+		{Name: "uid-1", DeviceClass: "ssd", Size: 1 << 30},
+		{Name: "uid-2", DeviceClass: "ssd", Size: 1 << 30, Meta: &lsm.VolumeMeta{
+			VolumeOwner: lsm.VolumeOwner{LogicalVolume: "pvc-2", PVCNamespace: "default", PVCName: "data"},
+			Options:     lsm.VolumeOptions{NoCow: true},
+		}},
+		{Name: "uid-3", DeviceClass: "hdd", Size: 1 << 30},
+		{Name: "uid-4", DeviceClass: "hdd", Size: 1 << 30, Meta: &lsm.VolumeMeta{VolumeOwner: lsm.VolumeOwner{LogicalVolume: "pvc-4"}}},
+	}
+	lvs := []topolsv1.LogicalVolume{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-3", UID: "uid-3"}, Spec: topolsv1.LogicalVolumeSpec{NodeName: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-4", UID: "uid-5"}, Spec: topolsv1.LogicalVolumeSpec{NodeName: "node2"}},
+	}
+	pvs := []corev1.PersistentVolume{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}, Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: topols.PluginName, VolumeHandle: "uid-1"},
+		}}},
+	}
+
+	p := NewPlan("node1", volumes, lvs, pvs, Options{PersistentVolumes: true, ReclaimPolicy: corev1.PersistentVolumeReclaimRetain})
+
+	if len(p.LogicalVolumes) != 2 || p.LogicalVolumes[0].Name != "pvc-2" || p.LogicalVolumes[1].Name != "uid-1" {
+		t.Fatalf("LogicalVolumes should be created for uid-1 and uid-2: %v", p.LogicalVolumes)
+	}
+	lv := p.LogicalVolumes[0]
+	if lv.Status.VolumeID != "uid-2" || lv.Spec.NodeName != "node1" || !lv.Spec.NoCow || lv.Spec.Size.Value() != 1<<30 ||
+		lv.Annotations[topols.RecoveredVolumeKey] != "uid-2" || lv.Annotations[topols.PVCNameKey] != "data" {
+		t.Errorf("unexpected LogicalVolume: %+v", lv)
+	}
+	if _, ok := p.Skipped["uid-4"]; !ok {
+		t.Errorf("uid-4 should be skipped because pvc-4 exists: %v", p.Skipped)
+	}
+
+	if len(p.PersistentVolumes) != 1 || p.PersistentVolumes[0].Name != "pvc-2" {
+		t.Fatalf("PersistentVolume should be created for uid-2 only: %v", p.PersistentVolumes)
+	}
+	pv := p.PersistentVolumes[0]
+	if pv.Spec.CSI.VolumeHandle != "uid-2" || pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Name != "data" {
+		t.Errorf("unexpected PersistentVolume: %+v", pv)
+	}
+
+	var out bytes.Buffer
+	if err := p.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if !strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "#") {
+			t.Errorf("unexpected diff line: %s", line)
+		}
+	}
+}
+
+func TestNewPlanSnapshot(t *testing.T) {
+	volumes := []*lsm.LogicalVolume{
+		{Name: "uid-2", DeviceClass: "ssd", Size: 1 << 30, Meta: &lsm.VolumeMeta{
+			VolumeOwner: lsm.VolumeOwner{LogicalVolume: "snap-2"},
+			QuotaMode:   lsm.QuotaExclusive,
+			Source:      "uid-1",
+			AccessType:  "ro",
+		}},
+		{Name: "uid-3", DeviceClass: "ssd", Size: 1 << 30, Meta: &lsm.VolumeMeta{
+			VolumeOwner: lsm.VolumeOwner{LogicalVolume: "snap-3"},
+			Source:      "uid-4",
+			AccessType:  "ro",
+		}},
+		{Name: "uid-4", DeviceClass: "ssd", Size: 1 << 30, Meta: &lsm.VolumeMeta{VolumeOwner: lsm.VolumeOwner{LogicalVolume: "pvc-4"}}},
+	}
+	lvs := []topolsv1.LogicalVolume{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", UID: "uid-1"}, Spec: topolsv1.LogicalVolumeSpec{NodeName: "node1"},
+			Status: topolsv1.LogicalVolumeStatus{VolumeID: "uid-1"}},
+	}
+
+	p := NewPlan("node1", volumes, lvs, nil, Options{PersistentVolumes: true, ReclaimPolicy: corev1.PersistentVolumeReclaimRetain})
+
+	if len(p.LogicalVolumes) != 3 {
+		t.Fatalf("LogicalVolumes should be created for all volumes: %v", p.LogicalVolumes)
+	}
+	lv := p.LogicalVolumes[1]
+	if lv.Name != "snap-2" || lv.Spec.Source != "pvc-1" || lv.Spec.AccessType != "ro" || lv.Spec.QuotaMode != string(lsm.QuotaExclusive) {
+		t.Errorf("snapshot of the existing volume should be restored: %+v", lv.Spec)
+	}
+	lv = p.LogicalVolumes[2]
+	if lv.Name != "snap-3" || lv.Spec.Source != "pvc-4" || lv.Spec.AccessType != "ro" {
+		t.Errorf("snapshot of the recovered volume should be restored: %+v", lv.Spec)
+	}
+
+	if len(p.PersistentVolumes) != 1 || p.PersistentVolumes[0].Name != "pvc-4" {
+		t.Errorf("PersistentVolume should be created for pvc-4 only: %v", p.PersistentVolumes)
+	}
+}
+
+func TestNewPlanBlock(t *testing.T) {
+	volumes := []*lsm.LogicalVolume{
+		{Name: "uid-1", DeviceClass: "ssd", Size: 1 << 30, Meta: &lsm.VolumeMeta{VolumeOwner: lsm.VolumeOwner{LogicalVolume: "pvc-1"}, Block: true}},
+		{Name: "uid-2", DeviceClass: "ssd", Size: 1 << 30, Meta: &lsm.VolumeMeta{VolumeOwner: lsm.VolumeOwner{LogicalVolume: "pvc-2"}}},
+	}
+
+	p := NewPlan("node1", volumes, nil, nil, Options{PersistentVolumes: true, ReclaimPolicy: corev1.PersistentVolumeReclaimRetain})
+
+	if len(p.PersistentVolumes) != 2 {
+		t.Fatalf("PersistentVolumes should be created for all volumes: %v", p.PersistentVolumes)
+	}
+	if mode := p.PersistentVolumes[0].Spec.VolumeMode; mode == nil || *mode != corev1.PersistentVolumeBlock {
+		t.Errorf("PersistentVolume of the block volume should be block: %v", mode)
+	}
+	if mode := p.PersistentVolumes[1].Spec.VolumeMode; mode != nil {
+		t.Errorf("PersistentVolume of the filesystem volume should have the default mode: %v", *mode)
+	}
+}
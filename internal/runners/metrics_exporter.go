@@ -2,6 +2,7 @@ package runners
 
 import (
 	"context"
+	"encoding/json"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +13,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -26,16 +28,28 @@ var meLogger = ctrl.Log.WithName("runners").WithName("metrics_exporter")
 type metricsExporter struct {
 	client         client.Client
 	nodeName       string
+	recorder       record.EventRecorder
 	availableBytes *prometheus.GaugeVec
 	sizeBytes      *prometheus.GaugeVec
+	healthy        *prometheus.GaugeVec
+	fsFreeBytes    *prometheus.GaugeVec
+	volumeBytes    *prometheus.GaugeVec
+	unknownEntries *prometheus.GaugeVec
+	configErrors   prometheus.Counter
 	lsmc           lsm.Client
+
+	// config is the last reported config status, nil before the first report
+	config *lsm.ConfigStatus
 }
 
 var _ manager.LeaderElectionRunnable = &metricsExporter{}
 
+//+kubebuilder:rbac:groups=core,resources=nodes/status,verbs=patch
+
 // NewMetricsExporter creates controller-runtime's manager.Runnable to run
 // a metrics exporter for a node.
-func NewMetricsExporter(client client.Client, lsmc lsm.Client, nodeName string) manager.Runnable {
+// It also reports the device class config status with the node condition and events.
+func NewMetricsExporter(client client.Client, lsmc lsm.Client, nodeName string, recorder record.EventRecorder) manager.Runnable {
 	availableBytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace:   metricsNamespace,
 		Subsystem:   "volumegroup",
@@ -54,11 +68,62 @@ func NewMetricsExporter(client client.Client, lsmc lsm.Client, nodeName string)
 	}, []string{"device_class"})
 	metrics.Registry.MustRegister(sizeBytes)
 
+	healthy := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "device_class",
+		Name:        "healthy",
+		Help:        "1 if the device class passed filesystem checks, 0 otherwise",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	}, []string{"device_class"})
+	metrics.Registry.MustRegister(healthy)
+
+	fsFreeBytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "volumegroup",
+		Name:        "filesystem_free_bytes",
+		Help:        "estimated free bytes of the filesystem for device classes with filesystem capacity mode",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	}, []string{"device_class"})
+	metrics.Registry.MustRegister(fsFreeBytes)
+
+	volumeBytes := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "volume",
+		Name:        "usage_bytes",
+		Help:        "volume usage bytes by type: referenced, exclusive and shared with snapshots and clones",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	}, []string{"device_class", "volume", "type"})
+	metrics.Registry.MustRegister(volumeBytes)
+
+	unknownEntries := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "device_class",
+		Name:        "unknown_entries",
+		Help:        "number of entries in the device class directory which are not managed volumes by kind",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	}, []string{"device_class", "kind"})
+	metrics.Registry.MustRegister(unknownEntries)
+
+	configErrors := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "config",
+		Name:        "load_errors_total",
+		Help:        "number of failed device class config loads",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	})
+	metrics.Registry.MustRegister(configErrors)
+
 	return &metricsExporter{
 		client:         client,
 		nodeName:       nodeName,
+		recorder:       recorder,
 		availableBytes: availableBytes,
 		sizeBytes:      sizeBytes,
+		healthy:        healthy,
+		fsFreeBytes:    fsFreeBytes,
+		volumeBytes:    volumeBytes,
+		unknownEntries: unknownEntries,
+		configErrors:   configErrors,
 		lsmc:           lsmc,
 	}
 }
@@ -72,8 +137,16 @@ func (m *metricsExporter) Start(ctx context.Context) error {
 			case <-ctx.Done():
 				return
 			case met := <-metricsCh:
-				m.availableBytes.WithLabelValues(met.DeviceClass).Set(float64(met.TotalBytes - met.UsedBytes))
+				m.availableBytes.WithLabelValues(met.DeviceClass).Set(float64(met.AvailableBytes()))
 				m.sizeBytes.WithLabelValues(met.DeviceClass).Set(float64(met.TotalBytes))
+				if met.Filesystem != nil {
+					m.fsFreeBytes.WithLabelValues(met.DeviceClass).Set(float64(met.Filesystem.FreeBytes))
+				}
+				if met.Err == nil {
+					m.healthy.WithLabelValues(met.DeviceClass).Set(1)
+				} else {
+					m.healthy.WithLabelValues(met.DeviceClass).Set(0)
+				}
 			}
 		}
 	}()
@@ -112,8 +185,97 @@ func (m *metricsExporter) NeedLeaderElection() bool {
 	return false
 }
 
+// updateConfigStatus reports changes of the config status with the node condition, events and metrics.
+func (m *metricsExporter) updateConfigStatus(ctx context.Context, status lsm.ConfigStatus) error {
+	prev := m.config
+	if prev != nil && prev.Errors == status.Errors && (prev.Err == nil) == (status.Err == nil) {
+		return nil
+	}
+
+	node := &corev1.ObjectReference{Kind: "Node", Name: m.nodeName, UID: types.UID(m.nodeName)}
+	cond := corev1.NodeCondition{
+		Type:               topols.NodeConditionConfigLoaded,
+		Status:             corev1.ConditionTrue,
+		Reason:             "ConfigLoaded",
+		Message:            "device class config is applied",
+		LastHeartbeatTime:  v1.Now(),
+		LastTransitionTime: v1.Now(),
+	}
+	if status.Err != nil {
+		cond.Status = corev1.ConditionFalse
+		cond.Reason = "ConfigInvalid"
+		cond.Message = status.Err.Error()
+	}
+
+	// conditions are merged by type, so other conditions are not touched
+	patch, err := json.Marshal(map[string]any{"status": map[string]any{"conditions": []corev1.NodeCondition{cond}}})
+	if err != nil {
+		return err
+	}
+	obj := &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: m.nodeName}}
+	if err := m.client.Status().Patch(ctx, obj, client.RawPatch(types.StrategicMergePatchType, patch)); err != nil {
+		// the status is reported again on the next update
+		meLogger.Error(err, "failed to update node condition")
+		return nil
+	}
+
+	if prev != nil {
+		m.configErrors.Add(float64(status.Errors - prev.Errors))
+	} else {
+		m.configErrors.Add(float64(status.Errors))
+	}
+	if status.Err != nil {
+		m.recorder.Event(node, corev1.EventTypeWarning, cond.Reason, cond.Message)
+	} else if prev != nil && prev.Err != nil {
+		m.recorder.Event(node, corev1.EventTypeNormal, cond.Reason, cond.Message)
+	}
+
+	m.config = &status
+	return nil
+}
+
+// updateVolumes exports usage of volumes and the number of unknown entries in healthy device classes.
+func (m *metricsExporter) updateVolumes(ctx context.Context, stats *lsm.NodeStats) {
+	m.volumeBytes.Reset()
+	m.unknownEntries.Reset()
+
+	for _, s := range stats.DeviceClasses {
+		if s.Err != nil {
+			continue
+		}
+
+		for _, kind := range []lsm.EntryKind{lsm.EntryUnknownVolume, lsm.EntryFile, lsm.EntryDirectory} {
+			m.unknownEntries.WithLabelValues(s.DeviceClass, string(kind)).Set(0)
+		}
+		entries, err := m.lsmc.UnknownEntries(ctx, s.DeviceClass)
+		if err != nil {
+			meLogger.Info("Error listing unknown entries", "DeviceClass", s.DeviceClass, "Err", err.Error())
+		}
+		for _, e := range entries {
+			m.unknownEntries.WithLabelValues(s.DeviceClass, string(e.Kind)).Inc()
+		}
+
+		volumes, err := m.lsmc.GetLVList(ctx, s.DeviceClass)
+		if err != nil {
+			meLogger.Info("Error listing volumes", "DeviceClass", s.DeviceClass, "Err", err.Error())
+			continue
+		}
+
+		for _, v := range volumes {
+			vs, err := m.lsmc.VolumeStats(ctx, v.Name, v.DeviceClass)
+			if err != nil {
+				// the volume may be removed concurrently
+				continue
+			}
+			m.volumeBytes.WithLabelValues(v.DeviceClass, v.Name, "referenced").Set(float64(vs.ReferencedBytes))
+			m.volumeBytes.WithLabelValues(v.DeviceClass, v.Name, "exclusive").Set(float64(vs.ExclusiveBytes))
+			m.volumeBytes.WithLabelValues(v.DeviceClass, v.Name, "shared").Set(float64(vs.SharedBytes))
+		}
+	}
+}
+
 func (m *metricsExporter) updateNode(ctx context.Context, ch chan<- *lsm.DeviceClassStats) error {
-	stats, err := m.lsmc.NodeStats()
+	stats, err := m.lsmc.NodeStats(ctx)
 
 	if err != nil {
 		return err
@@ -123,6 +285,12 @@ func (m *metricsExporter) updateNode(ctx context.Context, ch chan<- *lsm.DeviceC
 		ch <- s
 	}
 
+	m.updateVolumes(ctx, stats)
+
+	if err := m.updateConfigStatus(ctx, stats.Config); err != nil {
+		return err
+	}
+
 	var nodeMetadata v1.PartialObjectMetadata
 
 	nodeMetadata.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Node"))
@@ -146,15 +314,21 @@ func (m *metricsExporter) updateNode(ctx context.Context, ch chan<- *lsm.DeviceC
 
 	capacityKeys := make(map[string]struct{})
 	for k := range nodeMetadata2.Annotations {
-		if strings.HasPrefix(k, topols.CapacityKeyPrefix) {
+		if strings.HasPrefix(k, topols.CapacityKeyPrefix) || strings.HasPrefix(k, topols.UnhealthyKeyPrefix) {
 			capacityKeys[k] = struct{}{}
 		}
 	}
 
 	for _, s := range stats.DeviceClasses {
 		key := topols.CapacityKeyPrefix + s.DeviceClass
-		nodeMetadata2.Annotations[key] = strconv.FormatUint(s.TotalBytes-s.UsedBytes, 10)
+		nodeMetadata2.Annotations[key] = strconv.FormatUint(s.AvailableBytes(), 10)
 		delete(capacityKeys, key)
+
+		if s.Err != nil {
+			key = topols.UnhealthyKeyPrefix + s.DeviceClass
+			nodeMetadata2.Annotations[key] = s.Err.Error()
+			delete(capacityKeys, key)
+		}
 	}
 
 	for k := range capacityKeys {
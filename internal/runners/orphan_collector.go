@@ -0,0 +1,230 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var ocLogger = ctrl.Log.WithName("runners").WithName("orphan_collector")
+
+// OrphanCollectorOptions configures the orphan collector.
+type OrphanCollectorOptions struct {
+	// Interval is the time between checks.
+	Interval time.Duration
+	// Remove enables removal of orphan volumes.
+	Remove bool
+	// GracePeriod is how long a volume must stay orphan before it is removed.
+	GracePeriod time.Duration
+}
+
+type orphanCollector struct {
+	client   client.Client
+	lsmc     lsm.Client
+	nodeName string
+	recorder record.EventRecorder
+	opts     OrphanCollectorOptions
+
+	// found is the time each orphan was found first, by device class and volume name
+	found map[orphanKey]time.Time
+
+	orphans      *prometheus.GaugeVec
+	removed      *prometheus.CounterVec
+	staleRemoved prometheus.Counter
+}
+
+type orphanKey struct {
+	deviceClass string
+	name        string
+}
+
+var _ manager.LeaderElectionRunnable = &orphanCollector{}
+
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// NewOrphanCollector creates controller-runtime's manager.Runnable to find volumes on a node
+// which have no LogicalVolume, and to remove stale btrfs qgroups.
+// Orphans are reported with events on the node and metrics, and are removed after the grace period if enabled.
+func NewOrphanCollector(client client.Client, lsmc lsm.Client, nodeName string, recorder record.EventRecorder, opts OrphanCollectorOptions) manager.Runnable {
+	orphans := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "orphan",
+		Name:        "volumes",
+		Help:        "number of volumes without LogicalVolume",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	}, []string{"device_class"})
+	metrics.Registry.MustRegister(orphans)
+
+	removed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "orphan",
+		Name:        "volumes_removed_total",
+		Help:        "number of removed volumes without LogicalVolume",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	}, []string{"device_class"})
+	metrics.Registry.MustRegister(removed)
+
+	staleRemoved := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "qgroup",
+		Name:        "stale_removed_total",
+		Help:        "number of removed qgroups of deleted subvolumes",
+		ConstLabels: prometheus.Labels{"node": nodeName},
+	})
+	metrics.Registry.MustRegister(staleRemoved)
+
+	return &orphanCollector{
+		client:       client,
+		lsmc:         lsmc,
+		nodeName:     nodeName,
+		recorder:     recorder,
+		opts:         opts,
+		found:        make(map[orphanKey]time.Time),
+		orphans:      orphans,
+		removed:      removed,
+		staleRemoved: staleRemoved,
+	}
+}
+
+// Start implements controller-runtime's manager.Runnable.
+func (c *orphanCollector) Start(ctx context.Context) error {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.collect(ctx); err != nil {
+				ocLogger.Error(err, "orphan collection failed")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection implements controller-runtime's manager.LeaderElectionRunnable.
+func (c *orphanCollector) NeedLeaderElection() bool {
+	return false
+}
+
+func (c *orphanCollector) collect(ctx context.Context) error {
+	stats, err := c.lsmc.NodeStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	// volumes are listed before LogicalVolumes, so a volume created in between is never taken for an orphan
+	var volumes []*lsm.LogicalVolume
+	for _, s := range stats.DeviceClasses {
+		if s.Err != nil {
+			continue
+		}
+		vs, err := c.lsmc.GetLVList(ctx, s.DeviceClass)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, vs...)
+	}
+
+	var lvs topolsv1.LogicalVolumeList
+	if err := c.client.List(ctx, &lvs); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	found := make(map[orphanKey]time.Time)
+	c.orphans.Reset()
+	for _, s := range stats.DeviceClasses {
+		if s.Err == nil {
+			c.orphans.WithLabelValues(s.DeviceClass).Set(0)
+		}
+	}
+
+	for _, v := range findOrphans(volumes, lvs.Items, c.nodeName) {
+		key := orphanKey{deviceClass: v.DeviceClass, name: v.Name}
+		first, ok := c.found[key]
+		if !ok {
+			first = now
+			ocLogger.Info("found orphan volume", "DeviceClass", v.DeviceClass, "Name", v.Name, "Owner", owner(v))
+			c.recorder.Eventf(c.nodeRef(), corev1.EventTypeWarning, "OrphanVolume",
+				"volume %s of device class %s has no LogicalVolume, owner: %s", v.Name, v.DeviceClass, owner(v))
+		}
+
+		if c.opts.Remove && now.Sub(first) >= c.opts.GracePeriod {
+			if err := c.lsmc.RemoveLV(ctx, v.Name, v.DeviceClass); err != nil {
+				ocLogger.Error(err, "failed to remove orphan volume", "DeviceClass", v.DeviceClass, "Name", v.Name)
+			} else {
+				ocLogger.Info("removed orphan volume", "DeviceClass", v.DeviceClass, "Name", v.Name, "Owner", owner(v))
+				c.recorder.Eventf(c.nodeRef(), corev1.EventTypeNormal, "OrphanVolumeRemoved",
+					"volume %s of device class %s without LogicalVolume is removed", v.Name, v.DeviceClass)
+				c.removed.WithLabelValues(v.DeviceClass).Inc()
+				continue
+			}
+		}
+
+		found[key] = first
+		c.orphans.WithLabelValues(v.DeviceClass).Inc()
+	}
+	c.found = found
+
+	n, err := c.lsmc.RemoveStale(ctx)
+	if n > 0 {
+		ocLogger.Info("removed stale qgroups", "Count", n)
+		c.staleRemoved.Add(float64(n))
+	}
+
+	return err
+}
+
+func (c *orphanCollector) nodeRef() *corev1.ObjectReference {
+	// the same reference as kubelet uses for node events
+	return &corev1.ObjectReference{Kind: "Node", Name: c.nodeName, UID: types.UID(c.nodeName)}
+}
+
+// owner describes Kubernetes objects of the volume from its metadata, the metadata stays on the node
+// after LogicalVolume is lost.
+func owner(v *lsm.LogicalVolume) string {
+	if v.Meta == nil || v.Meta.LogicalVolume == "" {
+		return "unknown"
+	}
+	if v.Meta.PVCName == "" {
+		return "LogicalVolume " + v.Meta.LogicalVolume
+	}
+	return fmt.Sprintf("LogicalVolume %s, PVC %s/%s", v.Meta.LogicalVolume, v.Meta.PVCNamespace, v.Meta.PVCName)
+}
+
+// findOrphans returns volumes which do not belong to any LogicalVolume of the node.
+func findOrphans(volumes []*lsm.LogicalVolume, lvs []topolsv1.LogicalVolume, nodeName string) []*lsm.LogicalVolume {
+	known := make(map[string]bool)
+	for _, lv := range lvs {
+		if lv.Spec.NodeName != nodeName {
+			continue
+		}
+		// the volume is named by the uid, volume id is set when the volume is created
+		known[string(lv.UID)] = true
+		if lv.Status.VolumeID != "" {
+			known[lv.Status.VolumeID] = true
+		}
+	}
+
+	var orphans []*lsm.LogicalVolume
+	for _, v := range volumes {
+		if !known[v.Name] {
+			orphans = append(orphans, v)
+		}
+	}
+
+	return orphans
+}
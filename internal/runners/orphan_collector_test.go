@@ -0,0 +1,29 @@
+package runners
+
+import (
+	"testing"
+
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFindOrphans(t *testing.T) {
+	volumes := []*lsm.LogicalVolume{
+		{Name: "uid-1", DeviceClass: "ssd"},
+		{Name: "uid-2", DeviceClass: "ssd"},
+		{Name: "uid-3", DeviceClass: "hdd"},
+		{Name: "uid-4", DeviceClass: "hdd"},
+	}
+	lvs := []topolsv1.LogicalVolume{
+		{ObjectMeta: metav1.ObjectMeta{UID: "uid-1"}, Spec: topolsv1.LogicalVolumeSpec{NodeName: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{UID: "uid-5"}, Spec: topolsv1.LogicalVolumeSpec{NodeName: "node1"},
+			Status: topolsv1.LogicalVolumeStatus{VolumeID: "uid-2"}},
+		{ObjectMeta: metav1.ObjectMeta{UID: "uid-3"}, Spec: topolsv1.LogicalVolumeSpec{NodeName: "node2"}},
+	}
+
+	orphans := findOrphans(volumes, lvs, "node1")
+	if len(orphans) != 2 || orphans[0].Name != "uid-3" || orphans[1].Name != "uid-4" {
+		t.Errorf("uid-3 and uid-4 should be orphans: %v", orphans)
+	}
+}
@@ -0,0 +1,154 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kvaster/topols"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Receiver creates volumes from snapshots of other nodes.
+type Receiver struct {
+	client client.Reader
+	lsmc   lsm.Client
+	dial   func(ctx context.Context, addr string) (*grpc.ClientConn, error)
+}
+
+// NewReceiver returns Receiver which connects to other nodes with creds.
+func NewReceiver(client client.Reader, lsmc lsm.Client, creds *Credentials) *Receiver {
+	return &Receiver{
+		client: client,
+		lsmc:   lsmc,
+		dial: func(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+			return grpc.DialContext(ctx, addr,
+				grpc.WithTransportCredentials(credentials.NewTLS(creds.clientConfig())),
+				grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+		},
+	}
+}
+
+// Receive creates the volume from the read-only snapshot source which is on another node.
+func (r *Receiver) Receive(ctx context.Context, source *topolsv1.LogicalVolume, name, deviceClass string, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner) (*lsm.LogicalVolume, error) {
+	req := &SendRequest{DeviceClass: source.Spec.DeviceClass, Volume: source.Status.VolumeID}
+
+	logger.Info("receiving volume", "Node", source.Spec.NodeName, "Source", source.Status.VolumeID, "Name", name)
+	var v *lsm.LogicalVolume
+	_, err := r.receive(ctx, source.Spec.NodeName, sendMethod, req, func(pr io.Reader) error {
+		var err error
+		v, err = r.lsmc.ReceiveLV(ctx, name, deviceClass, opts, size, owner, pr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("volume is received", "Node", source.Spec.NodeName, "Source", source.Status.VolumeID, "Name", name)
+	return v, nil
+}
+
+// ReceiveIncremental receives the pass of the volume from the node and returns the size of the stream.
+// The volume has the same name on both nodes.
+func (r *Receiver) ReceiveIncremental(ctx context.Context, nodeName, name, deviceClass string, pass int) (int64, error) {
+	req := &SendRequest{DeviceClass: deviceClass, Volume: name, Pass: pass}
+
+	logger.Info("receiving volume pass", "Node", nodeName, "Name", name, "Pass", pass)
+	n, err := r.receive(ctx, nodeName, sendIncrementalMethod, req, func(pr io.Reader) error {
+		return r.lsmc.ReceiveLVIncremental(ctx, name, deviceClass, pass, pr)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	logger.Info("volume pass is received", "Node", nodeName, "Name", name, "Pass", pass, "Bytes", n)
+	return n, nil
+}
+
+// receive calls the send method of the node and passes the stream to apply, it returns the size of the stream.
+func (r *Receiver) receive(ctx context.Context, nodeName, method string, req *SendRequest, apply func(io.Reader) error) (int64, error) {
+	addr, err := r.address(ctx, nodeName)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := r.dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	stream, err := conn.NewStream(ctx, desc, method)
+	if err != nil {
+		return 0, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return 0, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return 0, err
+	}
+
+	size := make(chan int64, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		n, err := readChunks(stream, pw)
+		pw.CloseWithError(err)
+		size <- n
+	}()
+
+	err = apply(pr)
+	// unblock the reader if the stream is not applied completely
+	pr.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return <-size, nil
+}
+
+func (r *Receiver) address(ctx context.Context, nodeName string) (string, error) {
+	var node metav1.PartialObjectMetadata
+	node.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Node"))
+	if err := r.client.Get(ctx, types.NamespacedName{Name: nodeName}, &node); err != nil {
+		return "", err
+	}
+
+	addr := node.Annotations[topols.TransferAddressKey]
+	if addr == "" {
+		return "", fmt.Errorf("%s: %w", nodeName, ErrDisabled)
+	}
+
+	return addr, nil
+}
+
+// readChunks writes chunks of the stream to w until the stream ends and returns the number of written bytes.
+func readChunks(stream grpc.ClientStream, w io.Writer) (int64, error) {
+	var n int64
+	chunk := &Chunk{}
+	for {
+		err := stream.RecvMsg(chunk)
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return n, err
+		}
+		n += int64(len(chunk.Data))
+	}
+}
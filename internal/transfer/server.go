@@ -0,0 +1,123 @@
+package transfer
+
+import (
+	"context"
+	"net"
+
+	"github.com/kvaster/topols"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+type server struct {
+	client    client.Client
+	lsmc      lsm.Client
+	nodeName  string
+	addr      string
+	advertise string
+	creds     *Credentials
+}
+
+var _ manager.LeaderElectionRunnable = &server{}
+
+// NewServer creates controller-runtime's manager.Runnable which serves snapshots of the node on addr.
+// The advertised address is published in the Node annotation, so other nodes can find the server.
+func NewServer(client client.Client, lsmc lsm.Client, nodeName, addr, advertise string, creds *Credentials) manager.Runnable {
+	return &server{
+		client:    client,
+		lsmc:      lsmc,
+		nodeName:  nodeName,
+		addr:      addr,
+		advertise: advertise,
+		creds:     creds,
+	}
+}
+
+// Start implements controller-runtime's manager.Runnable.
+func (s *server) Start(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(s.creds.serverConfig())), grpc.ForceServerCodec(codec{}))
+	srv.RegisterService(&serviceDesc, s)
+
+	go srv.Serve(lis)
+
+	if err := s.annotate(ctx); err != nil {
+		srv.Stop()
+		return err
+	}
+	logger.Info("transfer server is started", "Address", s.addr, "Advertise", s.advertise)
+
+	<-ctx.Done()
+
+	srv.GracefulStop()
+	return nil
+}
+
+// NeedLeaderElection implements controller-runtime's manager.LeaderElectionRunnable.
+func (s *server) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *server) annotate(ctx context.Context) error {
+	var node metav1.PartialObjectMetadata
+	node.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Node"))
+	if err := s.client.Get(ctx, types.NamespacedName{Name: s.nodeName}, &node); err != nil {
+		return err
+	}
+
+	node2 := node.DeepCopy()
+	if node2.Annotations == nil {
+		node2.Annotations = map[string]string{}
+	}
+	node2.Annotations[topols.TransferAddressKey] = s.advertise
+
+	return s.client.Patch(ctx, node2, client.MergeFrom(&node))
+}
+
+func (s *server) send(req *SendRequest, stream grpc.ServerStream) error {
+	logger.Info("sending volume", "DeviceClass", req.DeviceClass, "Volume", req.Volume)
+
+	err := s.lsmc.SendLV(stream.Context(), req.Volume, req.DeviceClass, "", &chunkWriter{stream: stream})
+	if err != nil {
+		logger.Error(err, "failed to send volume", "DeviceClass", req.DeviceClass, "Volume", req.Volume)
+		return err
+	}
+
+	logger.Info("volume is sent", "DeviceClass", req.DeviceClass, "Volume", req.Volume)
+	return nil
+}
+
+func (s *server) sendIncremental(req *SendRequest, stream grpc.ServerStream) error {
+	logger.Info("sending volume pass", "DeviceClass", req.DeviceClass, "Volume", req.Volume, "Pass", req.Pass)
+
+	err := s.lsmc.SendLVIncremental(stream.Context(), req.Volume, req.DeviceClass, req.Pass, &chunkWriter{stream: stream})
+	if err != nil {
+		logger.Error(err, "failed to send volume pass", "DeviceClass", req.DeviceClass, "Volume", req.Volume, "Pass", req.Pass)
+		return err
+	}
+
+	logger.Info("volume pass is sent", "DeviceClass", req.DeviceClass, "Volume", req.Volume, "Pass", req.Pass)
+	return nil
+}
+
+// chunkWriter sends each write as a chunk.
+type chunkWriter struct {
+	stream grpc.ServerStream
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if err := w.stream.SendMsg(&Chunk{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,146 @@
+// Package transfer implements the volume transfer service of topols-node.
+// A node receives a read-only snapshot from the node of the snapshot over a gRPC stream protected with mutual TLS.
+package transfer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+)
+
+var logger = ctrl.Log.WithName("transfer")
+
+const (
+	serviceName = "topols.transfer.v1.Transfer"
+	sendMethod  = "/" + serviceName + "/Send"
+
+	sendIncrementalMethod = "/" + serviceName + "/SendIncremental"
+
+	// ServerName is the DNS name in the certificate of topols-node, nodes are dialed by address,
+	// so the name is the same for all nodes.
+	ServerName = "topols-node-transfer"
+)
+
+// ErrDisabled is returned when the node of the snapshot does not run the transfer service.
+var ErrDisabled = lsm.NewError(codes.FailedPrecondition, "volume transfer is not enabled on the node")
+
+// SendRequest asks the node to send the read-only snapshot, or the volume for SendIncremental.
+type SendRequest struct {
+	DeviceClass string `json:"deviceClass"`
+	Volume      string `json:"volume"`
+	// Pass is the incremental pass, the stream of the pass has the snapshot of the previous pass as the parent.
+	Pass int `json:"pass,omitempty"`
+}
+
+// Chunk is a part of the send stream.
+type Chunk struct {
+	Data []byte
+}
+
+// codec encodes chunks as is and other messages as JSON, so no generated protobuf code is needed.
+type codec struct{}
+
+func (codec) Name() string {
+	return "topols-transfer"
+}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	if c, ok := v.(*Chunk); ok {
+		// grpc may keep the buffer after SendMsg returns
+		return append([]byte(nil), c.Data...), nil
+	}
+	return json.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	if c, ok := v.(*Chunk); ok {
+		c.Data = append(c.Data[:0], data...)
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// sender is implemented by the server, grpc checks it on registration.
+type sender interface {
+	send(req *SendRequest, stream grpc.ServerStream) error
+	sendIncremental(req *SendRequest, stream grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*sender)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Send",
+		ServerStreams: true,
+		Handler:       sendHandler(sender.send),
+	}, {
+		StreamName:    "SendIncremental",
+		ServerStreams: true,
+		Handler:       sendHandler(sender.sendIncremental),
+	}},
+}
+
+func sendHandler(f func(sender, *SendRequest, grpc.ServerStream) error) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		req := &SendRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		return f(srv.(sender), req, stream)
+	}
+}
+
+// Credentials are the certificate of the node and the CA which signs certificates of all nodes.
+type Credentials struct {
+	watcher *certwatcher.CertWatcher
+	ca      *x509.CertPool
+}
+
+// NewCredentials loads tls.crt, tls.key and ca.crt from dir.
+// The certificate is reloaded on change when the returned watcher runs.
+func NewCredentials(dir string) (*Credentials, *certwatcher.CertWatcher, error) {
+	watcher, err := certwatcher.New(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(b) {
+		return nil, nil, fmt.Errorf("%s: no certificates found", filepath.Join(dir, "ca.crt"))
+	}
+
+	return &Credentials{watcher: watcher, ca: ca}, watcher, nil
+}
+
+func (c *Credentials) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.watcher.GetCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      c.ca,
+	}
+}
+
+func (c *Credentials) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.watcher.GetCertificate(nil)
+		},
+		RootCAs:    c.ca,
+		ServerName: ServerName,
+	}
+}
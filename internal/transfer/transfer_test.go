@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/kvaster/topols"
+	topolsv1 "github.com/kvaster/topols/api/v1"
+	"github.com/kvaster/topols/pkg/lsm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type fakeLsm struct {
+	lsm.Client
+	data     []byte
+	received bytes.Buffer
+}
+
+func (f *fakeLsm) SendLV(ctx context.Context, name, deviceClass, parent string, w io.Writer) error {
+	// several writes to get several chunks
+	for i := 0; i < len(f.data); i += 1000 {
+		if _, err := w.Write(f.data[i:min(i+1000, len(f.data))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeLsm) ReceiveLV(ctx context.Context, name, deviceClass string, opts lsm.VolumeOptions, size uint64, owner lsm.VolumeOwner, r io.Reader) (*lsm.LogicalVolume, error) {
+	if _, err := io.Copy(&f.received, r); err != nil {
+		return nil, err
+	}
+	return &lsm.LogicalVolume{Name: name, DeviceClass: deviceClass, Size: size}, nil
+}
+
+func (f *fakeLsm) SendLVIncremental(ctx context.Context, name, deviceClass string, pass int, w io.Writer) error {
+	return f.SendLV(ctx, name, deviceClass, "", w)
+}
+
+func (f *fakeLsm) ReceiveLVIncremental(ctx context.Context, name, deviceClass string, pass int, r io.Reader) error {
+	f.received.Reset()
+	_, err := io.Copy(&f.received, r)
+	return err
+}
+
+func TestReceive(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	source := &fakeLsm{data: data}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	srv.RegisterService(&serviceDesc, &server{lsmc: source})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node1",
+		Annotations: map[string]string{topols.TransferAddressKey: "node1:9444"},
+	}}
+	dest := &fakeLsm{}
+	r := &Receiver{
+		client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(node, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}).Build(),
+		lsmc:   dest,
+		dial: func(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+			if addr != "node1:9444" {
+				t.Errorf("unexpected address: %s", addr)
+			}
+			return grpc.DialContext(ctx, "bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})))
+		},
+	}
+
+	lv := &topolsv1.LogicalVolume{
+		Spec:   topolsv1.LogicalVolumeSpec{NodeName: "node1", DeviceClass: "ssd"},
+		Status: topolsv1.LogicalVolumeStatus{VolumeID: "snap"},
+	}
+	v, err := r.Receive(context.Background(), lv, "vol", "ssd", lsm.VolumeOptions{}, 1<<30, lsm.VolumeOwner{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "vol" {
+		t.Errorf("unexpected volume: %+v", v)
+	}
+	if !bytes.Equal(dest.received.Bytes(), data) {
+		t.Errorf("received data differs: %d bytes", dest.received.Len())
+	}
+
+	n, err := r.ReceiveIncremental(context.Background(), "node1", "vol", "ssd", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(dest.received.Bytes(), data) {
+		t.Errorf("received pass differs: %d bytes", n)
+	}
+
+	lv.Spec.NodeName = "node2"
+	if _, err := r.Receive(context.Background(), lv, "vol", "ssd", lsm.VolumeOptions{}, 1<<30, lsm.VolumeOwner{}); !errors.Is(err, ErrDisabled) {
+		t.Errorf("ErrDisabled should be returned for the node without the service: %v", err)
+	}
+}
@@ -9,6 +9,6 @@ import (
 
 // SetupLogicalVolumeReconcilerWithServices creates LogicalVolumeReconciler and sets up with manager.
 func SetupLogicalVolumeReconcilerWithServices(mgr ctrl.Manager, client client.Client, lvmc lsm.Client, nodeName string) error {
-	reconciler := internalController.NewLogicalVolumeReconciler(client, lvmc, nodeName)
+	reconciler := internalController.NewLogicalVolumeReconciler(client, lvmc, nodeName, false, nil)
 	return reconciler.SetupWithManager(mgr)
 }
@@ -0,0 +1,172 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultFsType is the filesystem type of device classes which do not specify one.
+const DefaultFsType = "btrfs"
+
+// QuotaMode selects which bytes of a volume are limited.
+type QuotaMode string
+
+const (
+	// QuotaReferenced limits all bytes referenced by the volume, including extents shared with snapshots and clones.
+	QuotaReferenced QuotaMode = "referenced"
+	// QuotaExclusive limits only bytes which are not shared with other volumes.
+	QuotaExclusive QuotaMode = "exclusive"
+)
+
+// Limit is the size limit of a volume.
+type Limit struct {
+	Size uint64
+	Mode QuotaMode
+}
+
+// VolumeInfo is the quota information of a single volume.
+type VolumeInfo struct {
+	Limit Limit
+	// Referenced is the number of bytes referenced by the volume.
+	Referenced uint64
+	// Exclusive is the number of bytes referenced only by the volume.
+	Exclusive uint64
+}
+
+// Stats returns volume stats, used bytes are counted according to the limit mode.
+func (i *VolumeInfo) Stats() *VolumeStats {
+	s := &VolumeStats{
+		TotalBytes:      i.Limit.Size,
+		UsedBytes:       i.Referenced,
+		ReferencedBytes: i.Referenced,
+		ExclusiveBytes:  i.Exclusive,
+	}
+	if i.Limit.Mode == QuotaExclusive {
+		s.UsedBytes = i.Exclusive
+	}
+	if i.Referenced > i.Exclusive {
+		s.SharedBytes = i.Referenced - i.Exclusive
+	}
+	return s
+}
+
+// VolumeOptions are filesystem properties of a volume set at creation.
+// Snapshots and clones inherit them from the source volume.
+type VolumeOptions struct {
+	// NoCow disables copy-on-write (nodatacow), data checksums are disabled with it.
+	NoCow bool `json:"noCow,omitempty"`
+	// Compression is the compression algorithm with optional level, i.e. zstd:3. Empty means filesystem default.
+	Compression string `json:"compression,omitempty"`
+}
+
+// compressionLevels holds the maximum compression level for each algorithm, 0 if level is not supported.
+var compressionLevels = map[string]int{
+	"no":   0,
+	"none": 0,
+	"lzo":  0,
+	"zlib": 9,
+	"zstd": 15,
+}
+
+// Validate checks that options are consistent.
+func (o VolumeOptions) Validate() error {
+	if o.Compression == "" {
+		return nil
+	}
+
+	if o.NoCow {
+		return errors.New("compression can't be used with nodatacow")
+	}
+
+	alg, level, hasLevel := strings.Cut(o.Compression, ":")
+	maxLevel, ok := compressionLevels[alg]
+	if !ok {
+		return fmt.Errorf("unknown compression algorithm: %s", alg)
+	}
+	if hasLevel {
+		l, err := strconv.Atoi(level)
+		if err != nil || l < 1 || l > maxLevel {
+			return fmt.Errorf("invalid compression level for %s: %s", alg, level)
+		}
+	}
+
+	return nil
+}
+
+// PoolStats is the space of the filesystem a device class is located on.
+type PoolStats struct {
+	// SizeBytes is the usable size of the filesystem.
+	SizeBytes uint64
+	// FreeBytes is the estimated space which can still be written.
+	FreeBytes uint64
+}
+
+// Driver implements directories with a hard size limit on a specific filesystem.
+// All paths are absolute paths of volumes.
+// Calls may block for a long time, they are aborted when ctx is done if the filesystem allows it.
+type Driver interface {
+	// CheckPool checks that path is a directory on a filesystem usable by the driver.
+	CheckPool(ctx context.Context, path string) error
+	// PoolStats returns the space of the filesystem path is located on.
+	PoolStats(ctx context.Context, path string) (*PoolStats, error)
+	CreateVolume(ctx context.Context, path string, limit Limit, opts VolumeOptions) error
+	CreateSnapshot(ctx context.Context, srcPath, path string, limit Limit, readOnly bool) error
+	RemoveVolume(ctx context.Context, path string) error
+	SetLimit(ctx context.Context, path string, limit Limit) error
+	// VolumeInfo returns ErrNotVolume if path is a directory which is not a volume.
+	VolumeInfo(ctx context.Context, path string) (*VolumeInfo, error)
+}
+
+// GroupDriver is implemented by drivers which can additionally limit a group of volumes as a whole.
+type GroupDriver interface {
+	// SetGroupLimit creates the group on the filesystem of path if it does not exist and sets its limit.
+	// Zero size removes the limit.
+	SetGroupLimit(ctx context.Context, path string, group uint64, limit Limit) error
+	// AssignGroup adds the volume to the group, it is not an error if the volume is already in the group.
+	AssignGroup(ctx context.Context, path string, group uint64) error
+}
+
+// OptionsDriver is implemented by drivers which can change options of an existing volume.
+type OptionsDriver interface {
+	// SetOptions changes options of the volume at path, only files written afterwards get them,
+	// existing files keep their attributes.
+	SetOptions(ctx context.Context, path string, opts VolumeOptions) error
+}
+
+// StaleDriver is implemented by drivers which may leave accounting objects of removed volumes behind.
+type StaleDriver interface {
+	// RemoveStale removes accounting objects of volumes which do not exist anymore on the filesystem of path.
+	// It returns the number of removed objects.
+	RemoveStale(ctx context.Context, path string) (int, error)
+}
+
+// StreamDriver is implemented by drivers which can serialize a read-only snapshot to a stream and
+// restore it from the stream, e.g. on another node.
+type StreamDriver interface {
+	// Send writes the read-only snapshot at path to w. If parent is not empty, only the difference
+	// from the read-only snapshot at parent is written, the receiver must have the parent.
+	Send(ctx context.Context, path, parent string, w io.Writer) error
+	// Receive creates a read-only snapshot in the directory dir from r and returns its path.
+	Receive(ctx context.Context, dir string, r io.Reader) (string, error)
+}
+
+// DriverRegistry holds drivers by the filesystem type used in the device class config.
+type DriverRegistry map[string]Driver
+
+// Driver returns a driver for the filesystem type, empty type means DefaultFsType.
+func (r DriverRegistry) Driver(fsType string) (Driver, error) {
+	if fsType == "" {
+		fsType = DefaultFsType
+	}
+
+	d, ok := r[fsType]
+	if !ok {
+		return nil, fmt.Errorf("no driver for filesystem type: %s", fsType)
+	}
+
+	return d, nil
+}
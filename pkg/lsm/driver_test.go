@@ -0,0 +1,33 @@
+package lsm
+
+import (
+	"testing"
+)
+
+func TestVolumeOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		opts  VolumeOptions
+		valid bool
+	}{
+		{VolumeOptions{}, true},
+		{VolumeOptions{NoCow: true}, true},
+		{VolumeOptions{Compression: "zstd"}, true},
+		{VolumeOptions{Compression: "zstd:3"}, true},
+		{VolumeOptions{Compression: "zlib:9"}, true},
+		{VolumeOptions{Compression: "none"}, true},
+		{VolumeOptions{Compression: "zstd:16"}, false},
+		{VolumeOptions{Compression: "lzo:1"}, false},
+		{VolumeOptions{Compression: "gzip"}, false},
+		{VolumeOptions{Compression: "zstd", NoCow: true}, false},
+	}
+
+	for _, tc := range testCases {
+		err := tc.opts.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v should be valid: %v", tc.opts, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v should be invalid", tc.opts)
+		}
+	}
+}
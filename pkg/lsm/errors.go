@@ -0,0 +1,119 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrNoDeviceClass = NewError(codes.NotFound, "no such device class")
+	ErrNoVolume      = NewError(codes.NotFound, "no such volume")
+	ErrAlreadyExists = NewError(codes.AlreadyExists, "volume already exists")
+	ErrExhausted     = NewError(codes.ResourceExhausted, "device class capacity is exhausted")
+	ErrUnhealthy     = NewError(codes.FailedPrecondition, "device class is unhealthy")
+	ErrQuotaDisabled = NewError(codes.FailedPrecondition, "quotas are not enabled")
+	ErrNotSupported  = NewError(codes.FailedPrecondition, "operation is not supported by the device class filesystem")
+	ErrNotVolume     = NewError(codes.FailedPrecondition, "not a volume")
+)
+
+// Error is an error with the gRPC code which is reported to CSI callers.
+// status.FromError and status.Code recognize it even if it is wrapped.
+type Error struct {
+	Code codes.Code
+	Err  error
+}
+
+// NewError returns a new error with the gRPC code.
+func NewError(code codes.Code, msg string) error {
+	return &Error{Code: code, Err: errors.New(msg)}
+}
+
+// WrapError annotates err with the gRPC code.
+func WrapError(code codes.Code, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Err.Error())
+}
+
+// ExhaustedError is returned when a volume does not fit into the effective capacity of the device class.
+// It matches ErrExhausted with errors.Is.
+type ExhaustedError struct {
+	DeviceClass string
+	Requested   uint64
+	Available   uint64
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("%s: %s, requested %d, available %d", ErrExhausted.Error(), e.DeviceClass, e.Requested, e.Available)
+}
+
+func (e *ExhaustedError) Is(target error) bool {
+	return target == ErrExhausted
+}
+
+func (e *ExhaustedError) GRPCStatus() *status.Status {
+	return status.New(codes.ResourceExhausted, e.Error())
+}
+
+// ErrorCode returns the gRPC code for err.
+// Errors without a code are mapped by the underlying errno if any, otherwise codes.Internal is returned.
+func ErrorCode(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return ErrnoCode(errno)
+	}
+
+	return codes.Internal
+}
+
+// ErrnoCode maps errno returned by the kernel to the gRPC code.
+func ErrnoCode(errno syscall.Errno) codes.Code {
+	switch errno {
+	case syscall.ENOSPC, syscall.EDQUOT:
+		return codes.ResourceExhausted
+	case syscall.EEXIST:
+		return codes.AlreadyExists
+	case syscall.ENOENT:
+		return codes.NotFound
+	case syscall.EROFS, syscall.ENOTTY, syscall.EOPNOTSUPP, syscall.ENOTDIR:
+		return codes.FailedPrecondition
+	case syscall.EINVAL, syscall.ENAMETOOLONG:
+		return codes.InvalidArgument
+	case syscall.EPERM, syscall.EACCES:
+		return codes.PermissionDenied
+	case syscall.EBUSY, syscall.EAGAIN, syscall.EINTR:
+		return codes.Unavailable
+	}
+
+	return codes.Internal
+}
@@ -0,0 +1,40 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestErrorCode(t *testing.T) {
+	testCases := []struct {
+		err  error
+		code codes.Code
+	}{
+		{nil, codes.OK},
+		{errors.New("unknown"), codes.Internal},
+		{ErrNoVolume, codes.NotFound},
+		{fmt.Errorf("create: %w", ErrQuotaDisabled), codes.FailedPrecondition},
+		{&ExhaustedError{DeviceClass: "ssd", Requested: 2, Available: 1}, codes.ResourceExhausted},
+		{fmt.Errorf("%w: ssd: %w", ErrUnhealthy, ErrQuotaDisabled), codes.FailedPrecondition},
+		{fmt.Errorf("snapshot: %w", ErrNotSupported), codes.FailedPrecondition},
+		{&os.PathError{Op: "mkdir", Path: "/a", Err: syscall.EEXIST}, codes.AlreadyExists},
+		{fmt.Errorf("ioctl: %w", syscall.ENOSPC), codes.ResourceExhausted},
+		{fmt.Errorf("exec: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+	}
+
+	for _, tc := range testCases {
+		if code := ErrorCode(tc.err); code != tc.code {
+			t.Errorf("code for %v should be %s: %s", tc.err, tc.code, code)
+		}
+	}
+
+	if !errors.Is(&ExhaustedError{}, ErrExhausted) {
+		t.Error("ExhaustedError should match ErrExhausted")
+	}
+}
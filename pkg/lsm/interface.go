@@ -1,48 +1,159 @@
 package lsm
 
 import (
-	"errors"
+	"context"
+	"io"
+	"time"
 
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
-var ErrNoDeviceClass = errors.New("no such device class")
-var ErrNoVolume = errors.New("no such volume")
-
 type LogicalVolume struct {
 	Name        string
 	DeviceClass string
 	Size        uint64
+	// Meta is the metadata stored on the node with the volume, nil if the volume has no metadata.
+	Meta *VolumeMeta
+}
+
+// VolumeOwner identifies Kubernetes objects of a volume.
+type VolumeOwner struct {
+	// LogicalVolume is the name of the LogicalVolume.
+	LogicalVolume string `json:"logicalVolume,omitempty"`
+	PVCNamespace  string `json:"pvcNamespace,omitempty"`
+	PVCName       string `json:"pvcName,omitempty"`
+}
+
+// VolumeMeta is the information about a volume which is stored on the node together with the volume,
+// so volumes can be identified and recovered without the API server.
+type VolumeMeta struct {
+	VolumeOwner
+
+	Name        string        `json:"name"`
+	DeviceClass string        `json:"deviceClass"`
+	Size        uint64        `json:"size"`
+	Options     VolumeOptions `json:"options"`
+	// QuotaMode is the mode of the volume limit, empty means the mode of the device class.
+	QuotaMode QuotaMode `json:"quotaMode,omitempty"`
+	// Source is the name of the source volume for snapshots and clones.
+	Source     string    `json:"source,omitempty"`
+	AccessType string    `json:"accessType,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Block is set for block volumes, their directory holds the backing file of the device.
+	Block bool `json:"block,omitempty"`
+}
+
+// EntryKind is the kind of an entry of a device class directory which is not adopted as a volume.
+type EntryKind string
+
+const (
+	// EntryUnknownVolume is a volume without a limit, i.e. a subvolume created manually.
+	EntryUnknownVolume EntryKind = "unknown-volume"
+	// EntryFile is a file which is not a directory.
+	EntryFile EntryKind = "file"
+	// EntryDirectory is a directory which is not a volume, i.e. lost+found.
+	EntryDirectory EntryKind = "directory"
+)
+
+// UnknownEntry is an entry of a device class directory which is not a managed volume.
+type UnknownEntry struct {
+	Name        string
+	DeviceClass string
+	Kind        EntryKind
 }
 
 type NodeStats struct {
 	DeviceClasses []*DeviceClassStats
 	Default       *DeviceClassStats
+	Config        ConfigStatus
+}
+
+// ConfigStatus is the result of device class config loads.
+type ConfigStatus struct {
+	// Err is the reason why the last load failed, nil if the config is applied.
+	Err error
+	// Errors is the number of failed loads since start.
+	Errors uint64
 }
 
 type VolumeStats struct {
 	TotalBytes uint64
 	UsedBytes  uint64
+
+	// Referenced, exclusive and shared bytes are reported for volumes only.
+	ReferencedBytes uint64
+	ExclusiveBytes  uint64
+	SharedBytes     uint64
 }
 
 type DeviceClassStats struct {
 	VolumeStats
 	DeviceClass string
+	// Filesystem is the space of the underlying filesystem with spare space excluded,
+	// nil if capacity of the device class is defined by configuration only.
+	Filesystem *PoolStats
+	// Err is the reason why the device class is unhealthy, nil if it is healthy.
+	Err error
+}
+
+// AvailableBytes returns the capacity which can be used for new volumes.
+// It is the smaller of the configured and the physical availability, unhealthy device classes have no capacity.
+func (s *DeviceClassStats) AvailableBytes() uint64 {
+	if s.Err != nil || s.UsedBytes > s.TotalBytes {
+		return 0
+	}
+
+	available := s.TotalBytes - s.UsedBytes
+	if s.Filesystem != nil {
+		available = min(available, s.Filesystem.FreeBytes)
+	}
+
+	return available
 }
 
 type Client interface {
 	manager.Runnable
 
-	GetLVList(deviceClass string) ([]*LogicalVolume, error)
-	CreateLV(name, deviceClass string, noCow bool, size uint64) (*LogicalVolume, error)
-	RemoveLV(name, deviceClass string) error
-	ResizeLV(name, deviceClass string, size uint64) error
-	CreateLVSnapshot(name, deviceClass, sourceVolID string, size uint64, accessType string) (*LogicalVolume, error)
+	GetLVList(ctx context.Context, deviceClass string) ([]*LogicalVolume, error)
+	CreateLV(ctx context.Context, name, deviceClass string, opts VolumeOptions, size uint64, owner VolumeOwner) (*LogicalVolume, error)
+	RemoveLV(ctx context.Context, name, deviceClass string) error
+	ResizeLV(ctx context.Context, name, deviceClass string, size uint64) error
+	CreateLVSnapshot(ctx context.Context, name, deviceClass, sourceVolID string, size uint64, accessType string, owner VolumeOwner) (*LogicalVolume, error)
+	// ModifyLV changes options and the quota mode of the volume, empty mode means the mode of the device class.
+	// Only options which differ from the current ones are applied.
+	ModifyLV(ctx context.Context, name, deviceClass string, opts VolumeOptions, mode QuotaMode) error
+	// SetBlock records in the metadata that the volume is a block volume, snapshots of the volume inherit it.
+	SetBlock(ctx context.Context, name, deviceClass string) error
+
+	// SendLV writes the read-only snapshot to w, the stream is restored with ReceiveLV.
+	// If parent is not empty, only the difference from the read-only snapshot parent is written.
+	SendLV(ctx context.Context, name, deviceClass, parent string, w io.Writer) error
+	// ReceiveLV creates a volume from the stream written by SendLV.
+	ReceiveLV(ctx context.Context, name, deviceClass string, opts VolumeOptions, size uint64, owner VolumeOwner, r io.Reader) (*LogicalVolume, error)
+
+	// SendLVIncremental takes the read-only snapshot of the volume for the pass and writes it to w,
+	// the snapshot of the previous pass is the parent of the stream.
+	SendLVIncremental(ctx context.Context, name, deviceClass string, pass int, w io.Writer) error
+	// ReceiveLVIncremental applies the stream written by SendLVIncremental for the same pass.
+	ReceiveLVIncremental(ctx context.Context, name, deviceClass string, pass int, r io.Reader) error
+	// CompleteLVIncremental creates the volume from the snapshot received on the pass and removes received snapshots.
+	CompleteLVIncremental(ctx context.Context, name, deviceClass string, pass int, opts VolumeOptions, size uint64, owner VolumeOwner) (*LogicalVolume, error)
+	// RemoveLVIncremental removes snapshots of the volume taken or received by incremental passes.
+	RemoveLVIncremental(ctx context.Context, name, deviceClass string) error
 
 	GetPath(v *LogicalVolume) string
 
-	VolumeStats(name, deviceClass string) (*VolumeStats, error)
-	NodeStats() (*NodeStats, error)
+	VolumeStats(ctx context.Context, name, deviceClass string) (*VolumeStats, error)
+	NodeStats(ctx context.Context) (*NodeStats, error)
+
+	// UnknownEntries returns entries of the device class directory which are not managed volumes.
+	UnknownEntries(ctx context.Context, deviceClass string) ([]*UnknownEntry, error)
+	// AdoptLV sets the limit of an unknown volume and makes it managed.
+	// It returns ErrNoVolume if there is no unknown volume with the name.
+	AdoptLV(ctx context.Context, name, deviceClass string, size uint64) (*LogicalVolume, error)
+
+	// RemoveStale removes leftovers of deleted volumes, e.g. stale btrfs qgroups, and returns their number.
+	RemoveStale(ctx context.Context) (int, error)
 
 	Watch() chan struct{}
 }
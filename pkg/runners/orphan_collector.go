@@ -0,0 +1,9 @@
+package runners
+
+import (
+	internalRunners "github.com/kvaster/topols/internal/runners"
+)
+
+type OrphanCollectorOptions = internalRunners.OrphanCollectorOptions
+
+var NewOrphanCollector = internalRunners.NewOrphanCollector